@@ -0,0 +1,609 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package veela
+
+import (
+	"fmt"
+
+	vpb "github.com/turingcell/veela/proto/veela"
+	"github.com/turingcell/veela/util"
+)
+
+// The acceptor serves the five acceptor rpcs below. Every change of the state
+// is persisted before the reply: the AcceptValue (if it is new to this
+// acceptor) and the new state of the inst are appended to the logdb in one
+// AppendAndSync3, see AcceptorRecord. Every acceptorCheckpointInterval
+// records, or when DeleteInstBefore drops some insts, the whole
+// AcceptorStateSummary is appended as a checkpoint instead, and all the idx
+// before both the checkpoint and the AcceptValues still referenced are
+// deleted. LoadAcceptorFromLogDb replays the inst records after the last
+// checkpoint.
+//
+// The AcceptValues which could never be chosen are dropped from the
+// acceptValueLogdbIdxMap once the inst is chosen, and the whole states of
+// the insts less than DeleteInstBeforeEpoch are dropped.
+//
+// The errors are replied by StatusCode and errStr:
+//   GROUP_NAME_DONT_MATCH, ACCEPTOR_ID_DONT_MATCH  the request is not for this acceptor
+//   UNSPECIFIED           the request is invalid or conflicts with a chosen value
+//   EAGAIN                the Accept only carries an AcceptValueID which this
+//                         acceptor does not hold, resend it with the AcceptValue
+//   RESOURCE_UNAVAILABLE  the logdb failed, nothing is changed
+// A reply with StatusCode OK but without promisedFlag or acceptedFlag means
+// it is rejected by a higher prepareEpoch, which is in the returned state.
+
+type acceptorErr struct {
+	code   vpb.StatusCode
+	errStr string
+}
+
+func newAcceptorErr(code vpb.StatusCode, format string, v ...interface{}) *acceptorErr {
+	return &acceptorErr{code: code, errStr: fmt.Sprintf(format, v...)}
+}
+
+func (e *acceptorErr) reply() (int32, string) {
+	if e == nil {
+		return int32(vpb.StatusCode_OK), ""
+	}
+	return int32(e.code), e.errStr
+}
+
+func (a *Acceptor) GetID() Epoch {
+	return a.id
+}
+
+// Close closes the logdb of the acceptor, it should not serve any rpc after.
+func (a *Acceptor) Close() error {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	return a.db.Close()
+}
+
+func (a *Acceptor) checkTarget(groupName string, acceptorID uint64) *acceptorErr {
+	if groupName != a.pg.groupName {
+		return newAcceptorErr(vpb.StatusCode_GROUP_NAME_DONT_MATCH, "group name %q does not match %q",
+			groupName, a.pg.groupName)
+	}
+	if acceptorID != a.id.ToUint64() {
+		return newAcceptorErr(vpb.StatusCode_ACCEPTOR_ID_DONT_MATCH, "acceptor id %d does not match %d",
+			acceptorID, a.id.ToUint64())
+	}
+	return nil
+}
+
+// findInst returns the state of the paxos instance instE and the term holding it.
+func (a *Acceptor) findInst(groupName string, acceptorID uint64, instE uint64) (
+	*vpb.AcceptorTermState, *vpb.AcceptorInOnePaxosInstanceState, *acceptorErr) {
+
+	aerr := a.checkTarget(groupName, acceptorID)
+	if aerr != nil {
+		return nil, nil, aerr
+	}
+	if instE == 0 {
+		return nil, nil, newAcceptorErr(vpb.StatusCode_UNSPECIFIED, "instE should > 0")
+	}
+	if instE < a.stateSummary.DeleteInstBeforeEpoch {
+		return nil, nil, newAcceptorErr(vpb.StatusCode_UNSPECIFIED, "inst %d is already deleted", instE)
+	}
+	term, inst := a.locateInst(instE)
+	if term != nil {
+		return term, inst, nil
+	}
+	return nil, nil, newAcceptorErr(vpb.StatusCode_UNSPECIFIED, "inst %d is not in any term of acceptor %d",
+		instE, a.id.ToUint64())
+}
+
+func cloneInstState(inst *vpb.AcceptorInOnePaxosInstanceState) *vpb.AcceptorInOnePaxosInstanceState {
+	ret := *inst
+	ret.AcceptValueLogdbIdxMap = make(map[uint64]uint64, len(inst.AcceptValueLogdbIdxMap))
+	for k, v := range inst.AcceptValueLogdbIdxMap {
+		ret.AcceptValueLogdbIdxMap[k] = v
+	}
+	return &ret
+}
+
+// readAcceptValues returns the marshaled AcceptValues of ids held by inst,
+// the ids not held are skipped.
+func (a *Acceptor) readAcceptValues(inst *vpb.AcceptorInOnePaxosInstanceState, ids []uint64) (
+	map[uint64][]byte, *acceptorErr) {
+
+	ret := make(map[uint64][]byte, len(ids))
+	for _, id := range ids {
+		logdbIdx, ok := inst.AcceptValueLogdbIdxMap[id]
+		if !ok {
+			continue
+		}
+		bs, err := a.db.GetValueByIdx(logdbIdx)
+		if err == nil {
+			var r *AcceptorRecord
+			r, err = ParseAcceptorRecord(bs)
+			if err == nil && r.Kind != AcceptorRecordValue {
+				err = fmt.Errorf("got a record of kind %d", r.Kind)
+			}
+			if err == nil {
+				bs = r.ValueBs
+			}
+		}
+		if err != nil {
+			return nil, newAcceptorErr(vpb.StatusCode_RESOURCE_UNAVAILABLE, "read the accept value %d at idx %d: %v",
+				id, logdbIdx, err)
+		}
+		ret[id] = bs
+	}
+	return ret, nil
+}
+
+// acceptorCheckpointInterval is the max count of the inst records after a
+// checkpoint, which LoadAcceptorFromLogDb replays.
+const acceptorCheckpointInterval = 64
+
+type AcceptorRecordKind byte
+
+const (
+	// the whole AcceptorStateSummary
+	AcceptorRecordCheckpoint AcceptorRecordKind = 1
+	// the new state of one inst and the AllChosenFlag of its term
+	AcceptorRecordInst AcceptorRecordKind = 2
+	// a marshaled AcceptValue referenced by the acceptValueLogdbIdxMap
+	AcceptorRecordValue AcceptorRecordKind = 3
+)
+
+// AcceptorRecord is one record in the logdb of an acceptor, it is encoded as
+// the 1 byte kind followed by
+//
+//	AcceptorRecordCheckpoint  the marshaled Summary
+//	AcceptorRecordInst        InstE (8 bytes), AllChosenFlag (1 byte) and the marshaled Inst
+//	AcceptorRecordValue       ValueBs
+type AcceptorRecord struct {
+	Kind          AcceptorRecordKind
+	Summary       *vpb.AcceptorStateSummary
+	InstE         uint64
+	AllChosenFlag bool
+	Inst          *vpb.AcceptorInOnePaxosInstanceState
+	ValueBs       []byte
+}
+
+func (r *AcceptorRecord) Marshal() []byte {
+	switch r.Kind {
+	case AcceptorRecordCheckpoint:
+		bs, err := r.Summary.Marshal()
+		util.AssertNoErr(err)
+		return append([]byte{byte(r.Kind)}, bs...)
+	case AcceptorRecordInst:
+		instBs, err := r.Inst.Marshal()
+		util.AssertNoErr(err)
+		bs := make([]byte, 10, 10+len(instBs))
+		bs[0] = byte(r.Kind)
+		util.U64SetBs(bs[1:], r.InstE)
+		if r.AllChosenFlag {
+			bs[9] = 1
+		}
+		return append(bs, instBs...)
+	case AcceptorRecordValue:
+		return append([]byte{byte(r.Kind)}, r.ValueBs...)
+	}
+	panic("unexpected")
+}
+
+// ParseAcceptorRecord parses bs marshaled by AcceptorRecord.Marshal.
+func ParseAcceptorRecord(bs []byte) (*AcceptorRecord, error) {
+	if len(bs) == 0 {
+		return nil, fmt.Errorf("empty acceptor record")
+	}
+	r := &AcceptorRecord{Kind: AcceptorRecordKind(bs[0])}
+	switch r.Kind {
+	case AcceptorRecordCheckpoint:
+		r.Summary = &vpb.AcceptorStateSummary{}
+		err := r.Summary.Unmarshal(bs[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid AcceptorStateSummary: %v", err)
+		}
+	case AcceptorRecordInst:
+		if len(bs) < 10 || bs[9] > 1 {
+			return nil, fmt.Errorf("invalid inst record")
+		}
+		r.InstE = util.BsReadU64(bs[1:])
+		r.AllChosenFlag = bs[9] == 1
+		r.Inst = &vpb.AcceptorInOnePaxosInstanceState{}
+		err := r.Inst.Unmarshal(bs[10:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid AcceptorInOnePaxosInstanceState: %v", err)
+		}
+	case AcceptorRecordValue:
+		r.ValueBs = bs[1:]
+	default:
+		return nil, fmt.Errorf("unknown acceptor record kind %d", r.Kind)
+	}
+	return r, nil
+}
+
+// nextLogdbIdx is where persist would store its valueBs.
+func (a *Acceptor) nextLogdbIdx() uint64 {
+	_, toAppendIdx := a.db.GetCurrentIdxRange()
+	return toAppendIdx
+}
+
+// persist appends valueBs (if not nil) at nextLogdbIdx and r after it, r is
+// turned into a checkpoint once there are acceptorCheckpointInterval inst
+// records after the last one. The idx are only deleted by a checkpoint.
+func (a *Acceptor) persist(valueBs []byte, r *AcceptorRecord) *acceptorErr {
+	if r.Kind == AcceptorRecordInst && a.instRecordCt+1 >= acceptorCheckpointInterval {
+		r = &AcceptorRecord{Kind: AcceptorRecordCheckpoint, Summary: &a.stateSummary}
+	}
+	toAppendIdx := a.nextLogdbIdx()
+	vArray := make([][]byte, 0, 2)
+	if valueBs != nil {
+		vArray = append(vArray, (&AcceptorRecord{Kind: AcceptorRecordValue, ValueBs: valueBs}).Marshal())
+	}
+	recordIdx := toAppendIdx + uint64(len(vArray))
+	vArray = append(vArray, r.Marshal())
+	minIdx := a.deleteBeforeIdx
+	if r.Kind == AcceptorRecordCheckpoint {
+		// the idx still referenced by the new checkpoint
+		minIdx = recordIdx
+		for _, term := range a.stateSummary.AcceptorTermStates {
+			for _, inst := range term.AcceptorInOnePaxosInstanceStateArray {
+				for _, idx := range inst.AcceptValueLogdbIdxMap {
+					if idx < minIdx {
+						minIdx = idx
+					}
+				}
+			}
+		}
+	}
+	err := a.db.AppendAndSync3(toAppendIdx, vArray, minIdx)
+	if err != nil {
+		vlog.Errorf("acceptor %d failed to persist its state at idx %d: %v", a.id.ToUint64(), toAppendIdx, err)
+		return newAcceptorErr(vpb.StatusCode_RESOURCE_UNAVAILABLE, "persist the acceptor state: %v", err)
+	}
+	a.deleteBeforeIdx = minIdx
+	if r.Kind == AcceptorRecordCheckpoint {
+		a.instRecordCt = 0
+	} else {
+		a.instRecordCt++
+	}
+	return nil
+}
+
+// persistInst persists the changes made to inst and its term, they are rolled
+// back if it fails.
+func (a *Acceptor) persistInst(instE uint64, term *vpb.AcceptorTermState, inst *vpb.AcceptorInOnePaxosInstanceState,
+	backup *vpb.AcceptorInOnePaxosInstanceState, backupAllChosenFlag bool, valueBs []byte) *acceptorErr {
+
+	aerr := a.persist(valueBs, &AcceptorRecord{Kind: AcceptorRecordInst, InstE: instE,
+		AllChosenFlag: term.AllChosenFlag, Inst: inst})
+	if aerr != nil {
+		*inst = *backup
+		term.AllChosenFlag = backupAllChosenFlag
+	}
+	return aerr
+}
+
+// locateInst returns the term holding instE and the state of instE.
+func (a *Acceptor) locateInst(instE uint64) (*vpb.AcceptorTermState, *vpb.AcceptorInOnePaxosInstanceState) {
+	for _, term := range a.stateSummary.AcceptorTermStates {
+		termLen := util.Int32ToUint64Assert(term.ElectionResult.TermLen)
+		if instE >= term.StartFromInstE && instE-term.StartFromInstE < termLen {
+			inst := term.AcceptorInOnePaxosInstanceStateArray[instE-term.StartFromInstE]
+			if inst.AcceptValueLogdbIdxMap == nil {
+				inst.AcceptValueLogdbIdxMap = make(map[uint64]uint64)
+			}
+			return term, inst
+		}
+	}
+	return nil, nil
+}
+
+// load restores the stateSummary from the last checkpoint in the logdb and
+// the inst records after it.
+func (a *Acceptor) load() error {
+	leftIdx, toAppendIdx := a.db.GetCurrentIdxRange()
+	var instRecords []*AcceptorRecord
+	var checkpoint *AcceptorRecord
+	for idx := toAppendIdx - 1; idx >= leftIdx && idx > 0 && checkpoint == nil; idx-- {
+		bs, err := a.db.GetValueByIdx(idx)
+		if err != nil {
+			return err
+		}
+		r, err := ParseAcceptorRecord(bs)
+		if err != nil {
+			return fmt.Errorf("idx %d: %v", idx, err)
+		}
+		switch r.Kind {
+		case AcceptorRecordCheckpoint:
+			checkpoint = r
+		case AcceptorRecordInst:
+			instRecords = append(instRecords, r)
+		}
+	}
+	if checkpoint == nil {
+		return fmt.Errorf("there is no checkpoint in [%d, %d)", leftIdx, toAppendIdx)
+	}
+	a.stateSummary = *checkpoint.Summary
+	err := a.CheckAcceptorStateSummary()
+	if err != nil {
+		return err
+	}
+	for i := len(instRecords) - 1; i >= 0; i-- {
+		r := instRecords[i]
+		term, inst := a.locateInst(r.InstE)
+		if term == nil || r.InstE < a.stateSummary.DeleteInstBeforeEpoch {
+			return fmt.Errorf("the inst record of %d is not in any term of the checkpoint", r.InstE)
+		}
+		*inst = *r.Inst
+		term.AllChosenFlag = r.AllChosenFlag
+	}
+	a.instRecordCt = len(instRecords)
+	a.deleteBeforeIdx = leftIdx
+	return nil
+}
+
+// DeleteInstBefore drops the states of the insts less than instE and the
+// AcceptValues they hold, they could not be served any more. The caller
+// should make sure all of them are chosen and delivered by all the learners
+// which care. The terms wholly dropped are removed except the last one.
+func (a *Acceptor) DeleteInstBefore(instE Epoch) error {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	e := instE.ToUint64()
+	if e <= a.stateSummary.DeleteInstBeforeEpoch {
+		return nil
+	}
+	bs, err := a.stateSummary.Marshal()
+	util.AssertNoErr(err)
+	a.stateSummary.DeleteInstBeforeEpoch = e
+	terms := a.stateSummary.AcceptorTermStates
+	for len(terms) > 1 && terms[1].StartFromInstE <= e {
+		terms = terms[1:]
+	}
+	a.stateSummary.AcceptorTermStates = terms
+	for _, term := range terms {
+		for i, inst := range term.AcceptorInOnePaxosInstanceStateArray {
+			if term.StartFromInstE+uint64(i) < e {
+				inst.AcceptValueLogdbIdxMap = make(map[uint64]uint64)
+			}
+		}
+	}
+	aerr := a.persist(nil, &AcceptorRecord{Kind: AcceptorRecordCheckpoint, Summary: &a.stateSummary})
+	if aerr != nil {
+		var backup vpb.AcceptorStateSummary
+		util.AssertNoErr(backup.Unmarshal(bs))
+		a.stateSummary = backup
+		return fmt.Errorf("%s", aerr.errStr)
+	}
+	return nil
+}
+
+// Prepare promises not to accept any prepareEpoch lower than req.PrepareEpoch
+// for the inst, if it is higher than all the ones promised. Even a retry of
+// the same prepareEpoch is not promised again, so an epoch could never win
+// two quorums, e.g. reused by a restarted proposer, and the AcceptValueID
+// taken from it stays unique. The AcceptValue already accepted is also
+// replied unless req.OnlyRetureAcceptValueIDFlag.
+func (a *Acceptor) Prepare(req *vpb.AcceptorRpcPrepareRequest) *vpb.AcceptorRpcPrepareResponese {
+	var resp vpb.AcceptorRpcPrepareResponese
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	term, inst, aerr := a.findInst(req.GroupName, req.AcceptorID, req.InstE)
+	if aerr == nil && req.PrepareEpoch == 0 {
+		aerr = newAcceptorErr(vpb.StatusCode_UNSPECIFIED, "prepareEpoch should > 0")
+	}
+	if aerr == nil && !req.OnlyRetureAcceptValueIDFlag && inst.AcceptValueID != 0 {
+		resp.AcceptValueIDMapToAcceptValueBs, aerr = a.readAcceptValues(inst, []uint64{inst.AcceptValueID})
+	}
+	if aerr == nil && req.PrepareEpoch > inst.PrepareEpoch {
+		backup := cloneInstState(inst)
+		inst.PrepareEpoch = req.PrepareEpoch
+		aerr = a.persistInst(req.InstE, term, inst, backup, term.AllChosenFlag, nil)
+		resp.PromisedFlag = aerr == nil
+	}
+	if aerr != nil {
+		resp.AcceptValueIDMapToAcceptValueBs = nil
+	}
+	if inst != nil {
+		resp.AcceptorInOnePaxosInstanceState = cloneInstState(inst)
+	}
+	resp.StatusCode, resp.ErrStr = aerr.reply()
+	return &resp
+}
+
+// Accept accepts the AcceptValue req.ToAcceptValueID with req.PreparedEpoch
+// if no higher prepareEpoch has been promised. The AcceptValue must be in
+// req.ToAcceptValueBs unless this acceptor already holds it, otherwise EAGAIN
+// is replied.
+func (a *Acceptor) Accept(req *vpb.AcceptorRpcAcceptRequest) *vpb.AcceptorRpcAcceptResponse {
+	var resp vpb.AcceptorRpcAcceptResponse
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	term, inst, aerr := a.findInst(req.GroupName, req.AcceptorID, req.InstE)
+	if aerr == nil {
+		aerr = a.accept(term, inst, req)
+		resp.AcceptedFlag = aerr == nil && inst.AcceptEpoch == req.PreparedEpoch &&
+			inst.AcceptValueID == req.ToAcceptValueID
+	}
+	if inst != nil {
+		resp.AcceptorInOnePaxosInstanceState = cloneInstState(inst)
+	}
+	resp.StatusCode, resp.ErrStr = aerr.reply()
+	return &resp
+}
+
+func (a *Acceptor) accept(term *vpb.AcceptorTermState, inst *vpb.AcceptorInOnePaxosInstanceState,
+	req *vpb.AcceptorRpcAcceptRequest) *acceptorErr {
+
+	id := req.ToAcceptValueID
+	// the id of an AcceptValue is the epoch of the self-proposed PA which
+	// first proposed it, see goal-zh.md
+	if req.PreparedEpoch == 0 || id == 0 || id > req.PreparedEpoch {
+		return newAcceptorErr(vpb.StatusCode_UNSPECIFIED, "invalid preparedEpoch %d and toAcceptValueID %d",
+			req.PreparedEpoch, id)
+	}
+	if req.PreparedEpoch < inst.PrepareEpoch {
+		return nil
+	}
+	if inst.ChosenFlag && inst.AcceptValueID != id {
+		return newAcceptorErr(vpb.StatusCode_UNSPECIFIED, "inst %d is already chosen with accept value %d but got %d",
+			req.InstE, inst.AcceptValueID, id)
+	}
+	_, holdFlag := inst.AcceptValueLogdbIdxMap[id]
+	if holdFlag && inst.PrepareEpoch == req.PreparedEpoch && inst.AcceptEpoch == req.PreparedEpoch &&
+		inst.AcceptValueID == id {
+		// a retry
+		return nil
+	}
+	var valueBs []byte
+	if !holdFlag {
+		if req.OnlyContainAcceptValueIDFlag || len(req.ToAcceptValueBs) == 0 {
+			return newAcceptorErr(vpb.StatusCode_EAGAIN, "acceptor %d does not hold the accept value %d of inst %d",
+				a.id.ToUint64(), id, req.InstE)
+		}
+		var v AcceptValue
+		err := v.UnMarshal(req.ToAcceptValueBs)
+		if err != nil {
+			return newAcceptorErr(vpb.StatusCode_UNSPECIFIED, "invalid toAcceptValueBs: %v", err)
+		}
+		if v.id.ToUint64() != id {
+			return newAcceptorErr(vpb.StatusCode_UNSPECIFIED, "the id of toAcceptValueBs is %d but toAcceptValueID is %d",
+				v.id.ToUint64(), id)
+		}
+		valueBs = req.ToAcceptValueBs
+	}
+	backup := cloneInstState(inst)
+	if !holdFlag {
+		inst.AcceptValueLogdbIdxMap[id] = a.nextLogdbIdx()
+	}
+	inst.PrepareEpoch = req.PreparedEpoch
+	inst.AcceptEpoch = req.PreparedEpoch
+	inst.AcceptValueID = id
+	return a.persistInst(req.InstE, term, inst, backup, term.AllChosenFlag, valueBs)
+}
+
+// ChosenNotify marks the inst chosen with req.AcceptValueID. The acceptor
+// may not hold the chosen AcceptValue, then it is not in the
+// acceptValueLogdbIdxMap of the inst and the learners should fetch it from
+// the others. req.AcceptValueBs is ignored.
+func (a *Acceptor) ChosenNotify(req *vpb.AcceptorRpcChosenNotifyRequest) *vpb.AcceptorRpcChosenNotifyResponse {
+	var resp vpb.AcceptorRpcChosenNotifyResponse
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	term, inst, aerr := a.findInst(req.GroupName, req.AcceptorID, req.InstE)
+	if aerr == nil && req.AcceptValueID == 0 {
+		aerr = newAcceptorErr(vpb.StatusCode_UNSPECIFIED, "acceptValueID should > 0")
+	}
+	if aerr == nil && inst.ChosenFlag && inst.AcceptValueID != req.AcceptValueID {
+		aerr = newAcceptorErr(vpb.StatusCode_UNSPECIFIED, "inst %d is already chosen with accept value %d but got %d",
+			req.InstE, inst.AcceptValueID, req.AcceptValueID)
+	}
+	if aerr == nil && !inst.ChosenFlag {
+		backup := cloneInstState(inst)
+		backupAllChosenFlag := term.AllChosenFlag
+		inst.ChosenFlag = true
+		inst.AcceptValueID = req.AcceptValueID
+		// the others could never be chosen
+		for id := range inst.AcceptValueLogdbIdxMap {
+			if id != req.AcceptValueID {
+				delete(inst.AcceptValueLogdbIdxMap, id)
+			}
+		}
+		term.AllChosenFlag = true
+		for _, v := range term.AcceptorInOnePaxosInstanceStateArray {
+			if !v.ChosenFlag {
+				term.AllChosenFlag = false
+				break
+			}
+		}
+		aerr = a.persistInst(req.InstE, term, inst, backup, backupAllChosenFlag, nil)
+		if aerr == nil {
+			a.pg.learnerOnChosen(Epoch(req.InstE), req.AcceptValueID, nil)
+		}
+	}
+	resp.ChosenFlag = aerr == nil
+	resp.StatusCode, resp.ErrStr = aerr.reply()
+	return &resp
+}
+
+// GetAcceptValueByID replies the AcceptValues of req.AcceptValueIDs held by
+// this acceptor, the others are absent from the reply.
+func (a *Acceptor) GetAcceptValueByID(req *vpb.AcceptorRpcGetAcceptValueByIDRequest) *vpb.AcceptorRpcGetAcceptValueByIDResponse {
+	var resp vpb.AcceptorRpcGetAcceptValueByIDResponse
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	_, inst, aerr := a.findInst(req.GroupName, req.AcceptorID, req.InstE)
+	if aerr == nil {
+		resp.AcceptValueIDMapToAcceptValueBs, aerr = a.readAcceptValues(inst, req.AcceptValueIDs)
+	}
+	if inst != nil {
+		resp.AcceptorInOnePaxosInstanceState = cloneInstState(inst)
+	}
+	resp.StatusCode, resp.ErrStr = aerr.reply()
+	return &resp
+}
+
+// GetSummary replies the terms which still have unchosen insts, or the whole
+// terms inside [req.GetInstEpochRangeLeftE, req.GetInstEpochRangeRightE].
+// CurrentInstEpochRangeLeftE and CurrentInstEpochRangeRightE of the replied
+// summary are the range of all the insts known by this acceptor, both ends
+// included.
+func (a *Acceptor) GetSummary(req *vpb.AcceptorRpcGetSummaryRequest) *vpb.AcceptorRpcGetSummaryResponse {
+	var resp vpb.AcceptorRpcGetSummaryResponse
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	aerr := a.checkTarget(req.GroupName, req.AcceptorID)
+	if aerr == nil {
+		resp.Summary, aerr = a.getSummary(req)
+	}
+	resp.StatusCode, resp.ErrStr = aerr.reply()
+	return &resp
+}
+
+func (a *Acceptor) getSummary(req *vpb.AcceptorRpcGetSummaryRequest) (*vpb.AcceptorStateSummary, *acceptorErr) {
+	terms := a.stateSummary.AcceptorTermStates
+	lastTerm := terms[len(terms)-1]
+	summary := &vpb.AcceptorStateSummary{
+		DeleteInstBeforeEpoch:      a.stateSummary.DeleteInstBeforeEpoch,
+		CurrentInstEpochRangeLeftE: terms[0].StartFromInstE,
+		CurrentInstEpochRangeRightE: lastTerm.StartFromInstE +
+			util.Int32ToUint64Assert(lastTerm.ElectionResult.TermLen) - 1,
+	}
+	if !req.OnlyGetTermsContainUnchosenInstFlag {
+		leftE, rightE := req.GetInstEpochRangeLeftE, req.GetInstEpochRangeRightE
+		leftFound, rightFound := false, false
+		for _, term := range terms {
+			termRightE := term.StartFromInstE + util.Int32ToUint64Assert(term.ElectionResult.TermLen) - 1
+			leftFound = leftFound || term.StartFromInstE == leftE
+			rightFound = rightFound || termRightE == rightE
+		}
+		if leftE > rightE || !leftFound || !rightFound {
+			return nil, newAcceptorErr(vpb.StatusCode_UNSPECIFIED,
+				"[%d, %d] does not match the whole terms inside [%d, %d]", leftE, rightE,
+				summary.CurrentInstEpochRangeLeftE, summary.CurrentInstEpochRangeRightE)
+		}
+	}
+	for _, term := range terms {
+		if req.OnlyGetTermsContainUnchosenInstFlag {
+			if term.AllChosenFlag {
+				continue
+			}
+		} else if term.StartFromInstE < req.GetInstEpochRangeLeftE || term.StartFromInstE > req.GetInstEpochRangeRightE {
+			continue
+		}
+		bs, err := term.Marshal()
+		util.AssertNoErr(err)
+		var clone vpb.AcceptorTermState
+		util.AssertNoErr(clone.Unmarshal(bs))
+		summary.AcceptorTermStates = append(summary.AcceptorTermStates, &clone)
+	}
+	return summary, nil
+}
@@ -0,0 +1,448 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package veela
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/turingcell/veela/logdb"
+	vpb "github.com/turingcell/veela/proto/veela"
+)
+
+// memBackendName is the logdb backend keeping every logdb in a MemDB by its
+// path, so the tests could crash and reload the acceptors without any disk.
+const memBackendName = "veela-test-mem"
+
+var (
+	memDBsMux sync.Mutex
+	memDBs    = make(map[string]*logdb.MemDB)
+)
+
+func init() {
+	logdb.RegisterBackend(memBackendName, logdb.Backend{
+		Create: func(dirPathStr string, opts *logdb.Options) (logdb.DB, error) {
+			memDBsMux.Lock()
+			defer memDBsMux.Unlock()
+			if _, ok := memDBs[dirPathStr]; ok {
+				return nil, os.ErrExist
+			}
+			db := logdb.NewMemDB()
+			memDBs[dirPathStr] = db
+			return db, nil
+		},
+		// the MemDB is reopened as if the process restarted
+		Open: func(dirPathStr string, opts *logdb.Options) (logdb.DB, error) {
+			db := getMemDB(dirPathStr)
+			if db == nil {
+				return nil, os.ErrNotExist
+			}
+			db.Crash()
+			return db, nil
+		},
+	})
+}
+
+func getMemDB(dirPathStr string) *logdb.MemDB {
+	memDBsMux.Lock()
+	defer memDBsMux.Unlock()
+	return memDBs[dirPathStr]
+}
+
+var errInjected = errors.New("injected fault")
+
+const testGroupName = "g"
+
+// newTestGroup creates the acceptors of ids [1, n] of the term [1, termLen]
+// on MemDBs named after t, the first addCt of them are added to the group.
+func newTestGroup(t *testing.T, n int, addCt int, termLen int32) (*PaxosGroup, []*Acceptor, ElectionResult) {
+	t.Helper()
+	pg, err := NewWithLogDbBackend(testGroupName, memBackendName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		memDBsMux.Lock()
+		defer memDBsMux.Unlock()
+		for i := 1; i <= n; i++ {
+			delete(memDBs, testDBPath(t, i))
+		}
+	})
+	var ids []Epoch
+	var u64IDs []uint64
+	for i := 1; i <= n; i++ {
+		ids = append(ids, Epoch(i))
+		u64IDs = append(u64IDs, uint64(i))
+	}
+	var as []*Acceptor
+	for i := 1; i <= n; i++ {
+		a := newTestAcceptor(t, pg, testDBPath(t, i), Epoch(i),
+			vpb.ElectionResult{TermLen: termLen, AcceptorIDArray: u64IDs})
+		as = append(as, a)
+		if i <= addCt {
+			err = pg.AddAcceptor(a)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	er, err := NewElectionResult(1, uint64(termLen), ids, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pg, as, er
+}
+
+func testDBPath(t *testing.T, acceptorID int) string {
+	return fmt.Sprintf("%s/%d", t.Name(), acceptorID)
+}
+
+func newTestAcceptor(t *testing.T, pg *PaxosGroup, dbPath string, id Epoch, er vpb.ElectionResult) *Acceptor {
+	t.Helper()
+	err := pg.InitAcceptorLogDb(dbPath, 1, er, vpb.AcceptorIDMapToNetworkAddr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := pg.LoadAcceptorFromLogDb(dbPath, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func testAcceptValue(t *testing.T, id uint64, body string) *AcceptValue {
+	t.Helper()
+	v, err := NewAcceptValue(vpb.AcceptValueMemberIdxs{
+		Idxs: []*vpb.AcceptValueMemberIdx{{Offset: 0, Len: int32(len(body))}},
+	}, []byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.id = Epoch(id)
+	return v
+}
+
+// acceptorStep is one rpc to the acceptor 1 of the group and its expected
+// reply.
+type acceptorStep struct {
+	name string
+	call func(a *Acceptor) (code int32, okFlag bool, inst *vpb.AcceptorInOnePaxosInstanceState)
+	code vpb.StatusCode
+	// PromisedFlag, AcceptedFlag or ChosenFlag of the reply
+	okFlag bool
+	// checked if not nil
+	check func(t *testing.T, inst *vpb.AcceptorInOnePaxosInstanceState)
+}
+
+func prepareStep(instE, e uint64) func(a *Acceptor) (int32, bool, *vpb.AcceptorInOnePaxosInstanceState) {
+	return func(a *Acceptor) (int32, bool, *vpb.AcceptorInOnePaxosInstanceState) {
+		r := a.Prepare(&vpb.AcceptorRpcPrepareRequest{GroupName: testGroupName, AcceptorID: a.id.ToUint64(),
+			InstE: instE, PrepareEpoch: e})
+		return r.StatusCode, r.PromisedFlag, r.AcceptorInOnePaxosInstanceState
+	}
+}
+
+func acceptStep(t *testing.T, instE, e, id uint64, body string) func(a *Acceptor) (int32, bool, *vpb.AcceptorInOnePaxosInstanceState) {
+	return func(a *Acceptor) (int32, bool, *vpb.AcceptorInOnePaxosInstanceState) {
+		req := &vpb.AcceptorRpcAcceptRequest{GroupName: testGroupName, AcceptorID: a.id.ToUint64(),
+			InstE: instE, PreparedEpoch: e, ToAcceptValueID: id}
+		if body == "" {
+			req.OnlyContainAcceptValueIDFlag = true
+		} else {
+			req.ToAcceptValueBs = testAcceptValue(t, id, body).Marshal()
+		}
+		r := a.Accept(req)
+		return r.StatusCode, r.AcceptedFlag, r.AcceptorInOnePaxosInstanceState
+	}
+}
+
+func chosenStep(instE, id uint64) func(a *Acceptor) (int32, bool, *vpb.AcceptorInOnePaxosInstanceState) {
+	return func(a *Acceptor) (int32, bool, *vpb.AcceptorInOnePaxosInstanceState) {
+		r := a.ChosenNotify(&vpb.AcceptorRpcChosenNotifyRequest{GroupName: testGroupName, AcceptorID: a.id.ToUint64(),
+			InstE: instE, AcceptValueID: id})
+		return r.StatusCode, r.ChosenFlag, nil
+	}
+}
+
+func expectInst(prepareEpoch, acceptEpoch, acceptValueID uint64) func(t *testing.T, inst *vpb.AcceptorInOnePaxosInstanceState) {
+	return func(t *testing.T, inst *vpb.AcceptorInOnePaxosInstanceState) {
+		t.Helper()
+		if inst.PrepareEpoch != prepareEpoch || inst.AcceptEpoch != acceptEpoch || inst.AcceptValueID != acceptValueID {
+			t.Fatalf("got %+v but expect prepareEpoch %d acceptEpoch %d acceptValueID %d",
+				inst, prepareEpoch, acceptEpoch, acceptValueID)
+		}
+	}
+}
+
+func runAcceptorSteps(t *testing.T, a *Acceptor, steps []acceptorStep) {
+	t.Helper()
+	for i, s := range steps {
+		code, okFlag, inst := s.call(a)
+		if code != int32(s.code) || okFlag != s.okFlag {
+			t.Fatalf("step %d %q: got code %d okFlag %v but expect %d %v", i, s.name, code, okFlag, s.code, s.okFlag)
+		}
+		if s.check != nil {
+			s.check(t, inst)
+		}
+	}
+}
+
+func TestAcceptorPrepareAccept(t *testing.T) {
+	const ok = vpb.StatusCode_OK
+	cases := []struct {
+		name  string
+		steps []acceptorStep
+	}{
+		{"promise only a higher epoch", []acceptorStep{
+			{"first", prepareStep(1, 5), ok, true, expectInst(5, 0, 0)},
+			{"retry", prepareStep(1, 5), ok, false, expectInst(5, 0, 0)},
+			{"lower", prepareStep(1, 4), ok, false, expectInst(5, 0, 0)},
+			{"higher", prepareStep(1, 6), ok, true, expectInst(6, 0, 0)},
+			{"zero", prepareStep(1, 0), vpb.StatusCode_UNSPECIFIED, false, nil},
+			{"out of term", prepareStep(5, 9), vpb.StatusCode_UNSPECIFIED, false, nil},
+			{"insts are independent", prepareStep(2, 1), ok, true, expectInst(1, 0, 0)},
+		}},
+		{"accept with the promised epoch", []acceptorStep{
+			{"prepare", prepareStep(1, 5), ok, true, nil},
+			{"lower epoch", acceptStep(t, 1, 4, 4, "v4"), ok, false, expectInst(5, 0, 0)},
+			{"id above epoch", acceptStep(t, 1, 5, 6, "v6"), vpb.StatusCode_UNSPECIFIED, false, nil},
+			{"only the id not held", acceptStep(t, 1, 5, 5, ""), vpb.StatusCode_EAGAIN, false, expectInst(5, 0, 0)},
+			{"with the value", acceptStep(t, 1, 5, 5, "v5"), ok, true, expectInst(5, 5, 5)},
+			{"retry with the id", acceptStep(t, 1, 5, 5, ""), ok, true, expectInst(5, 5, 5)},
+			{"help-proposed with the id", acceptStep(t, 1, 8, 5, ""), ok, true, expectInst(8, 8, 5)},
+			{"old epoch after that", acceptStep(t, 1, 7, 7, "v7"), ok, false, expectInst(8, 8, 5)},
+		}},
+		{"accept without prepare", []acceptorStep{
+			{"accept", acceptStep(t, 1, 3, 3, "v3"), ok, true, expectInst(3, 3, 3)},
+			{"prepare same epoch", prepareStep(1, 3), ok, false, expectInst(3, 3, 3)},
+		}},
+		{"chosen", []acceptorStep{
+			{"accept", acceptStep(t, 1, 3, 3, "v3"), ok, true, nil},
+			{"notify", chosenStep(1, 3), ok, true, nil},
+			{"notify again", chosenStep(1, 3), ok, true, nil},
+			{"notify another", chosenStep(1, 2), vpb.StatusCode_UNSPECIFIED, false, nil},
+			{"accept another", acceptStep(t, 1, 9, 9, "v9"), vpb.StatusCode_UNSPECIFIED, false, nil},
+			{"accept the chosen", acceptStep(t, 1, 9, 3, ""), ok, true, expectInst(9, 9, 3)},
+			{"notify without the value", chosenStep(2, 7), ok, true, nil},
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, as, _ := newTestGroup(t, 1, 1, 4)
+			runAcceptorSteps(t, as[0], c.steps)
+		})
+	}
+}
+
+func TestAcceptorRejectsOthers(t *testing.T) {
+	_, as, _ := newTestGroup(t, 1, 1, 4)
+	a := as[0]
+	r := a.Prepare(&vpb.AcceptorRpcPrepareRequest{GroupName: "x", AcceptorID: 1, InstE: 1, PrepareEpoch: 1})
+	if r.StatusCode != int32(vpb.StatusCode_GROUP_NAME_DONT_MATCH) {
+		t.Fatal(r)
+	}
+	r = a.Prepare(&vpb.AcceptorRpcPrepareRequest{GroupName: testGroupName, AcceptorID: 2, InstE: 1, PrepareEpoch: 1})
+	if r.StatusCode != int32(vpb.StatusCode_ACCEPTOR_ID_DONT_MATCH) {
+		t.Fatal(r)
+	}
+	v := testAcceptValue(t, 5, "v5").Marshal()
+	ar := a.Accept(&vpb.AcceptorRpcAcceptRequest{GroupName: testGroupName, AcceptorID: 1, InstE: 1,
+		PreparedEpoch: 6, ToAcceptValueID: 6, ToAcceptValueBs: v})
+	if ar.StatusCode != int32(vpb.StatusCode_UNSPECIFIED) || ar.AcceptedFlag {
+		t.Fatal(ar)
+	}
+}
+
+// A failed persist changes nothing in memory, and the acceptor serves again
+// after its logdb recovers.
+func TestAcceptorRollbackOnPersistFailure(t *testing.T) {
+	const ok = vpb.StatusCode_OK
+	const unavailable = vpb.StatusCode_RESOURCE_UNAVAILABLE
+	cases := []struct {
+		name   string
+		before []acceptorStep
+		// fails to persist
+		failed acceptorStep
+		after  []acceptorStep
+	}{
+		{"prepare",
+			[]acceptorStep{{"prepare", prepareStep(1, 5), ok, true, nil}},
+			acceptorStep{"prepare", prepareStep(1, 6), unavailable, false, expectInst(5, 0, 0)},
+			[]acceptorStep{{"still promised", acceptStep(t, 1, 5, 5, "v5"), ok, true, expectInst(5, 5, 5)}}},
+		{"accept a new value",
+			[]acceptorStep{{"prepare", prepareStep(1, 5), ok, true, nil}},
+			acceptorStep{"accept", acceptStep(t, 1, 5, 5, "v5"), unavailable, false, expectInst(5, 0, 0)},
+			[]acceptorStep{{"not held", acceptStep(t, 1, 5, 5, ""), vpb.StatusCode_EAGAIN, false, nil}}},
+		{"accept a held value",
+			[]acceptorStep{{"accept", acceptStep(t, 1, 5, 5, "v5"), ok, true, nil}},
+			acceptorStep{"accept", acceptStep(t, 1, 8, 5, ""), unavailable, false, expectInst(5, 5, 5)},
+			[]acceptorStep{{"lower", acceptStep(t, 1, 7, 5, ""), ok, true, expectInst(7, 7, 5)}}},
+		{"chosen notify",
+			[]acceptorStep{{"accept", acceptStep(t, 1, 5, 5, "v5"), ok, true, nil}},
+			acceptorStep{"notify", chosenStep(1, 5), unavailable, false, nil},
+			[]acceptorStep{{"not chosen", acceptStep(t, 1, 9, 9, "v9"), ok, true, expectInst(9, 9, 9)}}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pg, as, _ := newTestGroup(t, 1, 0, 4)
+			a := as[0]
+			runAcceptorSteps(t, a, c.before)
+			db := getMemDB(testDBPath(t, 1))
+			db.FailNextSyncs(1, errInjected)
+			runAcceptorSteps(t, a, []acceptorStep{c.failed})
+			// the logdb is broken until the restart, which loses the failed write
+			db.PowerLoss()
+			runAcceptorSteps(t, a, c.after)
+
+			// the same after a reload
+			a.Close()
+			a, err := pg.LoadAcceptorFromLogDb(testDBPath(t, 1), 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			code, _, inst := c.after[len(c.after)-1].call(a)
+			if code != int32(c.after[len(c.after)-1].code) {
+				t.Fatalf("got code %d after reload", code)
+			}
+			if check := c.after[len(c.after)-1].check; check != nil {
+				check(t, inst)
+			}
+		})
+	}
+}
+
+// Reload after a power loss sees everything persisted before the replies,
+// and nothing of the write failed to sync.
+func TestAcceptorReloadAfterPowerLoss(t *testing.T) {
+	pg, as, _ := newTestGroup(t, 1, 0, 4)
+	a := as[0]
+	runAcceptorSteps(t, a, []acceptorStep{
+		{"accept 1", acceptStep(t, 1, 5, 5, "v5"), vpb.StatusCode_OK, true, nil},
+		{"chosen 1", chosenStep(1, 5), vpb.StatusCode_OK, true, nil},
+		{"accept 2", acceptStep(t, 2, 5, 5, "w5"), vpb.StatusCode_OK, true, nil},
+		{"prepare 3", prepareStep(3, 7), vpb.StatusCode_OK, true, nil},
+	})
+	db := getMemDB(testDBPath(t, 1))
+	db.FailNextSyncs(1, errInjected)
+	runAcceptorSteps(t, a, []acceptorStep{
+		{"accept 3", acceptStep(t, 3, 7, 7, "x7"), vpb.StatusCode_RESOURCE_UNAVAILABLE, false, nil},
+	})
+	db.PowerLoss()
+	a, err := pg.LoadAcceptorFromLogDb(testDBPath(t, 1), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		instE         uint64
+		expect        func(t *testing.T, inst *vpb.AcceptorInOnePaxosInstanceState)
+		chosenFlag    bool
+		acceptValueBs []byte
+	}{
+		{1, expectInst(5, 5, 5), true, testAcceptValue(t, 5, "v5").Marshal()},
+		{2, expectInst(5, 5, 5), false, testAcceptValue(t, 5, "w5").Marshal()},
+		{3, expectInst(7, 0, 0), false, nil},
+		{4, expectInst(0, 0, 0), false, nil},
+	}
+	for _, c := range cases {
+		r := a.GetAcceptValueByID(&vpb.AcceptorRpcGetAcceptValueByIDRequest{GroupName: testGroupName,
+			AcceptorID: 1, InstE: c.instE, AcceptValueIDs: []uint64{5, 7}})
+		if r.StatusCode != int32(vpb.StatusCode_OK) {
+			t.Fatal(r)
+		}
+		c.expect(t, r.AcceptorInOnePaxosInstanceState)
+		if r.AcceptorInOnePaxosInstanceState.ChosenFlag != c.chosenFlag {
+			t.Fatalf("inst %d got %+v", c.instE, r.AcceptorInOnePaxosInstanceState)
+		}
+		var bs []byte
+		for _, v := range r.AcceptValueIDMapToAcceptValueBs {
+			bs = v
+		}
+		if len(r.AcceptValueIDMapToAcceptValueBs) > 1 || !bytes.Equal(bs, c.acceptValueBs) {
+			t.Fatalf("inst %d got accept values %v", c.instE, r.AcceptValueIDMapToAcceptValueBs)
+		}
+	}
+	// inst 3 is still promised to 7
+	runAcceptorSteps(t, a, []acceptorStep{
+		{"accept 3 lower", acceptStep(t, 3, 6, 6, "x6"), vpb.StatusCode_OK, false, nil},
+		{"accept 3", acceptStep(t, 3, 7, 7, "x7"), vpb.StatusCode_OK, true, nil},
+	})
+}
+
+func getTestAcceptValues(t *testing.T, a *Acceptor, instE uint64, ids ...uint64) (int32, map[uint64][]byte) {
+	t.Helper()
+	r := a.GetAcceptValueByID(&vpb.AcceptorRpcGetAcceptValueByIDRequest{GroupName: testGroupName,
+		AcceptorID: a.id.ToUint64(), InstE: instE, AcceptValueIDs: ids})
+	return r.StatusCode, r.AcceptValueIDMapToAcceptValueBs
+}
+
+// The inst records are checkpointed, and the logdb is deleted up to what
+// the last checkpoint still references.
+func TestAcceptorCheckpoint(t *testing.T) {
+	const n = acceptorCheckpointInterval + 10
+	pg, as, _ := newTestGroup(t, 1, 0, n+10)
+	a := as[0]
+	db := getMemDB(testDBPath(t, 1))
+	for instE := uint64(1); instE <= n; instE++ {
+		runAcceptorSteps(t, a, []acceptorStep{
+			{"accept", acceptStep(t, instE, 5, 5, fmt.Sprint(instE)), vpb.StatusCode_OK, true, nil},
+		})
+	}
+	// still referenced by the checkpoint
+	if leftIdx, _ := db.GetCurrentIdxRange(); leftIdx != 2 {
+		t.Fatalf("leftIdx %d", leftIdx)
+	}
+	// the accept value which is not chosen is dropped
+	runAcceptorSteps(t, a, []acceptorStep{
+		{"accept another", acceptStep(t, n, 9, 9, "x9"), vpb.StatusCode_OK, true, nil},
+		{"chosen", chosenStep(n, 9), vpb.StatusCode_OK, true, nil},
+	})
+	if _, vs := getTestAcceptValues(t, a, n, 5, 9); len(vs) != 1 || vs[9] == nil {
+		t.Fatalf("got %v", vs)
+	}
+
+	err := a.DeleteInstBefore(n - 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// from the accept value of inst n-1 to the checkpoint
+	leftIdx, toAppendIdx := db.GetCurrentIdxRange()
+	if toAppendIdx-leftIdx != 8 {
+		t.Fatalf("[%d, %d) is left", leftIdx, toAppendIdx)
+	}
+	runAcceptorSteps(t, a, []acceptorStep{
+		{"prepare", prepareStep(n+1, 3), vpb.StatusCode_OK, true, nil},
+	})
+
+	a.Close()
+	a, err = pg.LoadAcceptorFromLogDb(testDBPath(t, 1), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	if code, _ := getTestAcceptValues(t, a, n-2, 5); code != int32(vpb.StatusCode_UNSPECIFIED) {
+		t.Fatalf("got code %d of a deleted inst", code)
+	}
+	if _, vs := getTestAcceptValues(t, a, n-1, 5); !bytes.Equal(vs[5], testAcceptValue(t, 5, fmt.Sprint(n-1)).Marshal()) {
+		t.Fatalf("got %v", vs)
+	}
+	runAcceptorSteps(t, a, []acceptorStep{
+		{"chosen", chosenStep(n, 9), vpb.StatusCode_OK, true, nil},
+		{"promised", prepareStep(n+1, 3), vpb.StatusCode_OK, false, expectInst(3, 0, 0)},
+	})
+}
@@ -0,0 +1,109 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/turingcell/veela/logdb"
+)
+
+// LatencyStats is in microseconds.
+type LatencyStats struct {
+	Count int     `json:"count"`
+	P50   float64 `json:"p50_us"`
+	P99   float64 `json:"p99_us"`
+	P999  float64 `json:"p999_us"`
+	Max   float64 `json:"max_us"`
+}
+
+func newLatencyStats(lats []time.Duration) LatencyStats {
+	sorted := append([]time.Duration(nil), lats...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	// the nearest-rank percentile
+	percentile := func(p float64) float64 {
+		if len(sorted) == 0 {
+			return 0
+		}
+		rank := int(math.Ceil(p * float64(len(sorted))))
+		if rank < 1 {
+			rank = 1
+		}
+		return float64(sorted[rank-1]) / float64(time.Microsecond)
+	}
+	return LatencyStats{
+		Count: len(sorted),
+		P50:   percentile(0.50),
+		P99:   percentile(0.99),
+		P999:  percentile(0.999),
+		Max:   percentile(1),
+	}
+}
+
+type Result struct {
+	Backend   string `json:"backend"`
+	Workload  string `json:"workload"`
+	ValueSize int    `json:"value_size"`
+	Batch     int    `json:"batch"`
+	// count of AppendAndSync3 calls
+	Appends       int           `json:"appends"`
+	ElapsedSec    float64       `json:"elapsed_sec"`
+	AppendLatency LatencyStats  `json:"append_latency"`
+	ReadLatency   *LatencyStats `json:"read_latency,omitempty"`
+
+	AppendsPerSec  float64 `json:"appends_per_sec"`
+	AppendMBPerSec float64 `json:"append_mb_per_sec"`
+	ReadsPerSec    float64 `json:"reads_per_sec,omitempty"`
+
+	// bytes of the appended values
+	LogicalWriteBytes int64 `json:"logical_write_bytes"`
+	// write_bytes of /proc/self/io, nil if it is unavailable
+	PhysicalWriteBytes *int64   `json:"physical_write_bytes"`
+	WriteAmplification *float64 `json:"write_amplification"`
+	// the counters inside the logdb, the KV backends only see the bytes
+	// handed to the engine
+	LogDBStats logdb.Stats `json:"logdb_stats"`
+}
+
+func (r *Result) printText(w io.Writer) {
+	printLat := func(name string, s LatencyStats) {
+		fmt.Fprintf(w, "\t%s latency (%d ops): p50 %.1fus, p99 %.1fus, p999 %.1fus, max %.1fus\n",
+			name, s.Count, s.P50, s.P99, s.P999, s.Max)
+	}
+	fmt.Fprintf(w, "%s/%s: value size %dB, batch %d, %d appends in %.3fs\n",
+		r.Backend, r.Workload, r.ValueSize, r.Batch, r.Appends, r.ElapsedSec)
+	printLat("append", r.AppendLatency)
+	if r.ReadLatency != nil {
+		printLat("read", *r.ReadLatency)
+	}
+	fmt.Fprintf(w, "\tthroughput: %.1f appends/s, %.3fMB/s", r.AppendsPerSec, r.AppendMBPerSec)
+	if r.ReadLatency != nil {
+		fmt.Fprintf(w, ", %.1f reads/s", r.ReadsPerSec)
+	}
+	fmt.Fprintln(w)
+	if r.WriteAmplification != nil {
+		fmt.Fprintf(w, "\twrite amplification: %.3f (%d / %d bytes)\n",
+			*r.WriteAmplification, *r.PhysicalWriteBytes, r.LogicalWriteBytes)
+	} else {
+		fmt.Fprintf(w, "\twrite amplification: unavailable\n")
+	}
+	s := r.LogDBStats
+	fmt.Fprintf(w, "\tlogdb stats: write amplification %.3f, data %d, directory %d, meta %d bytes, %d syncs, %d bytes reclaimed\n",
+		s.WriteAmplification(), s.DataBytes, s.DirectoryBytes, s.MetaBytes, s.SyncCt, s.ReclaimedBytes)
+}
@@ -0,0 +1,269 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/turingcell/veela/logdb"
+)
+
+type workloadConfig struct {
+	// count of appends
+	count     int
+	valueSize int
+	// count of values in one append
+	batch int
+	// append-delete keeps the last keep idx
+	keep int
+	// mixed: ratio of reads in all the operations
+	readRatio float64
+	// concurrent-read: count of reader goroutines
+	readers int
+	// options of the file backend, ignored by the others
+	opts logdb.Options
+}
+
+type workloadFunc func(w *workloadRun) error
+
+var workloadOrder = []string{"append", "append-delete", "mixed", "concurrent-read"}
+
+var workloads = map[string]workloadFunc{
+	"append":          runAppend,
+	"append-delete":   runAppendDelete,
+	"mixed":           runMixed,
+	"concurrent-read": runConcurrentRead,
+}
+
+func workloadNames() []string {
+	return workloadOrder
+}
+
+// how many different offsets the values are sliced from the random pool, so
+// that the values are not all the same
+const valuePoolSlack = 4096
+
+type workloadRun struct {
+	db  logdb.DB
+	cfg workloadConfig
+	rnd *rand.Rand
+	// random bytes, every value is a slice of it
+	pool []byte
+
+	appendLat    []time.Duration
+	readLat      []time.Duration
+	logicalBytes int64
+}
+
+func runWorkload(backend, workload, dirPath string, cfg workloadConfig) (*Result, error) {
+	fn, ok := workloads[workload]
+	if !ok {
+		return nil, fmt.Errorf("unknown workload %q", workload)
+	}
+	w := &workloadRun{
+		cfg:  cfg,
+		rnd:  rand.New(rand.NewSource(1)),
+		pool: make([]byte, cfg.valueSize+valuePoolSlack),
+	}
+	w.rnd.Read(w.pool)
+	opts := cfg.opts
+	if backend != logdb.FileBackendName {
+		// the flags of the file format are only for the file backend, the
+		// others reject them
+		opts.DirectIO = false
+		opts.PreallocateSize = 0
+	}
+	db, err := logdb.CreateDBWithBackend(backend, dirPath, &opts)
+	if err != nil {
+		return nil, err
+	}
+	w.db = db
+
+	ioBefore, ioErr := readProcWriteBytes()
+	start := time.Now()
+	err = fn(w)
+	elapsed := time.Since(start)
+	// the bytes written by Close, e.g. a memtable flush, are counted too
+	closeErr := db.Close()
+	if err != nil {
+		return nil, err
+	}
+	if closeErr != nil {
+		return nil, closeErr
+	}
+	ioAfter, err := readProcWriteBytes()
+	if ioErr == nil {
+		ioErr = err
+	}
+
+	r := &Result{
+		Backend:           backend,
+		Workload:          workload,
+		ValueSize:         cfg.valueSize,
+		Batch:             cfg.batch,
+		Appends:           len(w.appendLat),
+		ElapsedSec:        elapsed.Seconds(),
+		AppendLatency:     newLatencyStats(w.appendLat),
+		AppendsPerSec:     float64(len(w.appendLat)) / elapsed.Seconds(),
+		AppendMBPerSec:    float64(w.logicalBytes) / (1 << 20) / elapsed.Seconds(),
+		LogicalWriteBytes: w.logicalBytes,
+		LogDBStats:        db.Stats(),
+	}
+	if len(w.readLat) > 0 {
+		stats := newLatencyStats(w.readLat)
+		r.ReadLatency = &stats
+		r.ReadsPerSec = float64(len(w.readLat)) / elapsed.Seconds()
+	}
+	if ioErr == nil {
+		physical := ioAfter - ioBefore
+		r.PhysicalWriteBytes = &physical
+		if w.logicalBytes > 0 {
+			wa := float64(physical) / float64(w.logicalBytes)
+			r.WriteAmplification = &wa
+		}
+	}
+	return r, nil
+}
+
+func (w *workloadRun) value() []byte {
+	off := w.rnd.Intn(valuePoolSlack)
+	return w.pool[off : off+w.cfg.valueSize]
+}
+
+// appendOnce appends one batch at toAppendIdx and returns toAppendIdx after
+// it, the idx less than deleteAllIdxLessThan are deleted at the same time.
+func (w *workloadRun) appendOnce(toAppendIdx uint64, deleteAllIdxLessThan uint64) (uint64, error) {
+	vArray := make([][]byte, w.cfg.batch)
+	for i := range vArray {
+		vArray[i] = w.value()
+	}
+	start := time.Now()
+	err := w.db.AppendAndSync3(toAppendIdx, vArray, deleteAllIdxLessThan)
+	if err != nil {
+		return 0, err
+	}
+	w.appendLat = append(w.appendLat, time.Since(start))
+	w.logicalBytes += int64(w.cfg.batch * w.cfg.valueSize)
+	return toAppendIdx + uint64(w.cfg.batch), nil
+}
+
+// readRandom reads a random live idx and returns its latency, it is safe to
+// be called concurrently.
+func readRandom(db logdb.DB, rnd *rand.Rand) (time.Duration, bool, error) {
+	leftIdx, toAppendIdx := db.GetCurrentIdxRange()
+	if leftIdx == toAppendIdx {
+		return 0, false, nil
+	}
+	idx := leftIdx + uint64(rnd.Int63n(int64(toAppendIdx-leftIdx)))
+	start := time.Now()
+	_, err := db.GetValueByIdx(idx)
+	if err != nil {
+		return 0, false, err
+	}
+	return time.Since(start), true, nil
+}
+
+func runAppend(w *workloadRun) error {
+	idx := uint64(1)
+	var err error
+	for i := 0; i < w.cfg.count; i++ {
+		idx, err = w.appendOnce(idx, 0)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runAppendDelete(w *workloadRun) error {
+	idx := uint64(1)
+	var err error
+	for i := 0; i < w.cfg.count; i++ {
+		var deleteAllIdxLessThan uint64
+		if next := idx + uint64(w.cfg.batch); next > uint64(w.cfg.keep) {
+			deleteAllIdxLessThan = next - uint64(w.cfg.keep)
+		}
+		idx, err = w.appendOnce(idx, deleteAllIdxLessThan)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runMixed(w *workloadRun) error {
+	idx := uint64(1)
+	var err error
+	for len(w.appendLat) < w.cfg.count {
+		if w.rnd.Float64() < w.cfg.readRatio {
+			d, ok, err := readRandom(w.db, w.rnd)
+			if err != nil {
+				return err
+			}
+			if ok {
+				w.readLat = append(w.readLat, d)
+			}
+			continue
+		}
+		idx, err = w.appendOnce(idx, 0)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The readers keep reading random live idx while the single writer appends.
+func runConcurrentRead(w *workloadRun) error {
+	stopCh := make(chan struct{})
+	var wg sync.WaitGroup
+	readLats := make([][]time.Duration, w.cfg.readers)
+	readErrs := make([]error, w.cfg.readers)
+	for i := 0; i < w.cfg.readers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(i) + 2))
+			for {
+				select {
+				case <-stopCh:
+					return
+				default:
+				}
+				d, ok, err := readRandom(w.db, rnd)
+				if err != nil {
+					readErrs[i] = err
+					return
+				}
+				if ok {
+					readLats[i] = append(readLats[i], d)
+				}
+			}
+		}(i)
+	}
+	err := runAppend(w)
+	close(stopCh)
+	wg.Wait()
+	for i := range readLats {
+		w.readLat = append(w.readLat, readLats[i]...)
+		if err == nil {
+			err = readErrs[i]
+		}
+	}
+	return err
+}
@@ -0,0 +1,418 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// veela-logdb inspects a logdb offline, e.g. the one an acceptor refuses to
+// load:
+//
+//	veela-logdb stat DIR
+//	veela-logdb verify DIR
+//	veela-logdb dump -from 10 -to 20 DIR
+//	veela-logdb decode -as auto DIR
+//
+// The logdb of the file backend is read without any modification. The other
+// backends are opened as usual, which may clean the garbage left by a crash.
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/turingcell/veela"
+	"github.com/turingcell/veela/logdb"
+	_ "github.com/turingcell/veela/logdb/backends/bitcaskbackend"
+	_ "github.com/turingcell/veela/logdb/backends/boltbackend"
+	_ "github.com/turingcell/veela/logdb/backends/pebblebackend"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands = []command{
+	{"stat", "idx range, deleted idx and sizes of the segments", runStat},
+	{"verify", "check the checksums of all the records and the directory consistency", runVerify},
+	{"dump", "print the raw records of an idx range", runDump},
+	{"decode", "print the records of an idx range as the acceptor state or accept values", runDecode},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s <command> [flags] DIR\n\ncommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", c.name, c.usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nrun '%s <command> -h' for the flags of a command\n", os.Args[0])
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	for _, c := range commands {
+		if c.name != os.Args[1] {
+			continue
+		}
+		err := c.run(os.Args[2:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", c.name, err)
+			os.Exit(1)
+		}
+		return
+	}
+	usage()
+	os.Exit(2)
+}
+
+// source is where the records are read from.
+type source interface {
+	idxRange() (leftIdx, toAppendIdx uint64)
+	// only Idx and Value are set for the backends other than file
+	read(idx uint64) (logdb.RecordInfo, error)
+	close() error
+}
+
+type inspectorSource struct {
+	in *logdb.Inspector
+}
+
+func (s inspectorSource) idxRange() (uint64, uint64) {
+	r := s.in.Result()
+	return r.LeftIdx, r.ToAppendIdx
+}
+
+func (s inspectorSource) read(idx uint64) (logdb.RecordInfo, error) {
+	return s.in.ReadRecord(idx)
+}
+
+func (s inspectorSource) close() error {
+	return s.in.Close()
+}
+
+type dbSource struct {
+	db logdb.DB
+}
+
+func (s dbSource) idxRange() (uint64, uint64) {
+	return s.db.GetCurrentIdxRange()
+}
+
+func (s dbSource) read(idx uint64) (logdb.RecordInfo, error) {
+	v, err := s.db.GetValueByIdx(idx)
+	return logdb.RecordInfo{Idx: idx, Value: v}, err
+}
+
+func (s dbSource) close() error {
+	return s.db.Close()
+}
+
+type commonFlags struct {
+	fs      *flag.FlagSet
+	backend *string
+	dir     string
+}
+
+func newCommonFlags(name string) *commonFlags {
+	cf := &commonFlags{fs: flag.NewFlagSet(name, flag.ExitOnError)}
+	cf.backend = cf.fs.String("backend", logdb.FileBackendName,
+		"logdb backend, one of "+strings.Join(logdb.BackendNames(), ", "))
+	return cf
+}
+
+func (cf *commonFlags) parse(args []string) error {
+	cf.fs.Parse(args)
+	if cf.fs.NArg() != 1 {
+		return fmt.Errorf("expect exactly one DIR but got %d arguments", cf.fs.NArg())
+	}
+	cf.dir = cf.fs.Arg(0)
+	return nil
+}
+
+func (cf *commonFlags) open() (source, error) {
+	if *cf.backend == logdb.FileBackendName {
+		in, err := logdb.OpenInspector(cf.dir, nil)
+		if err != nil {
+			return nil, err
+		}
+		return inspectorSource{in}, nil
+	}
+	db, err := logdb.OpenDBIfExistWithBackend(*cf.backend, cf.dir, nil)
+	if err != nil {
+		return nil, err
+	}
+	return dbSource{db}, nil
+}
+
+type rangeFlags struct {
+	from *uint64
+	to   *uint64
+}
+
+func newRangeFlags(fs *flag.FlagSet) rangeFlags {
+	return rangeFlags{
+		from: fs.Uint64("from", 0, "the first idx, the left of the logdb by default"),
+		to:   fs.Uint64("to", 0, "the idx after the last one, the toAppendIdx of the logdb by default"),
+	}
+}
+
+func (rf rangeFlags) resolve(src source) (leftIdx, rightIdx uint64, e error) {
+	leftIdx, rightIdx = src.idxRange()
+	curLeftIdx, curToAppendIdx := leftIdx, rightIdx
+	if *rf.from > 0 {
+		leftIdx = *rf.from
+	}
+	if *rf.to > 0 {
+		rightIdx = *rf.to
+	}
+	if leftIdx > rightIdx || (leftIdx < rightIdx && (leftIdx < curLeftIdx || rightIdx > curToAppendIdx)) {
+		return 0, 0, fmt.Errorf("idx range [%d, %d) is out of range [%d, %d)", leftIdx, rightIdx, curLeftIdx, curToAppendIdx)
+	}
+	return leftIdx, rightIdx, nil
+}
+
+func runStat(args []string) error {
+	cf := newCommonFlags("stat")
+	err := cf.parse(args)
+	if err != nil {
+		return err
+	}
+	if *cf.backend != logdb.FileBackendName {
+		src, err := cf.open()
+		if err != nil {
+			return err
+		}
+		defer src.close()
+		leftIdx, toAppendIdx := src.idxRange()
+		fmt.Printf("idx range: [%d, %d), %d records\n", leftIdx, toAppendIdx, toAppendIdx-leftIdx)
+		return nil
+	}
+	in, err := logdb.OpenInspector(cf.dir, nil)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	r := in.Result()
+	fmt.Printf("idx range: [%d, %d), %d records\n", r.LeftIdx, r.ToAppendIdx, r.ToAppendIdx-r.LeftIdx)
+	fmt.Printf("deleted idx: %d\n", r.DeletedIdx)
+	var fileSize int64
+	var dataBytes, directoryBytes uint64
+	fmt.Printf("segments: %d\n", len(r.Segments))
+	for _, s := range r.Segments {
+		fmt.Printf("  %s: idx [%d, %d), deleted idx %d, file %dB, directory %dB, data %dB",
+			s.Path, s.FirstIdx, s.ToAppendIdx, s.DeletedIdx, s.FileSize, s.DirectoryBytes, s.DataBytes)
+		if s.EncryptedFlag {
+			fmt.Print(", encrypted")
+		}
+		fmt.Println()
+		fileSize += s.FileSize
+		dataBytes += s.DataBytes
+		directoryBytes += s.DirectoryBytes
+	}
+	fmt.Printf("total: file %dB, directory %dB, data %dB\n", fileSize, directoryBytes, dataBytes)
+	if r.StaleSegmentCt > 0 {
+		fmt.Printf("stale segments left by an interrupted TruncateFrom: %d\n", r.StaleSegmentCt)
+	}
+	return nil
+}
+
+func runVerify(args []string) error {
+	cf := newCommonFlags("verify")
+	err := cf.parse(args)
+	if err != nil {
+		return err
+	}
+	if *cf.backend == logdb.FileBackendName {
+		r, err := logdb.Verify(cf.dir)
+		fmt.Printf("idx range: [%d, %d), %d segments, %d records checked\n",
+			r.LeftIdx, r.ToAppendIdx, r.SegmentCt, r.CheckedCt)
+		if r.UndecryptedCt > 0 {
+			fmt.Printf("%d encrypted records only checked by checksum without the key\n", r.UndecryptedCt)
+		}
+		if len(r.CorruptIdxs) > 0 {
+			fmt.Printf("corrupt idx: %v\n", r.CorruptIdxs)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Println("OK")
+		return nil
+	}
+	// the engine checks its own checksums on read
+	src, err := cf.open()
+	if err != nil {
+		return err
+	}
+	defer src.close()
+	leftIdx, toAppendIdx := src.idxRange()
+	var corruptIdxs []uint64
+	for idx := leftIdx; idx < toAppendIdx; idx++ {
+		_, err = src.read(idx)
+		if err != nil {
+			fmt.Printf("idx %d: %v\n", idx, err)
+			corruptIdxs = append(corruptIdxs, idx)
+		}
+	}
+	fmt.Printf("idx range: [%d, %d), %d records read\n", leftIdx, toAppendIdx, toAppendIdx-leftIdx)
+	if len(corruptIdxs) > 0 {
+		return fmt.Errorf("%d records could not be read", len(corruptIdxs))
+	}
+	fmt.Println("OK")
+	return nil
+}
+
+func runDump(args []string) error {
+	cf := newCommonFlags("dump")
+	rf := newRangeFlags(cf.fs)
+	phex := cf.fs.Bool("hex", false, "print the values by hex dump")
+	plimit := cf.fs.Int("limit", 256, "max bytes of each value to print, 0 means no limit")
+	err := cf.parse(args)
+	if err != nil {
+		return err
+	}
+	src, err := cf.open()
+	if err != nil {
+		return err
+	}
+	defer src.close()
+	leftIdx, rightIdx, err := rf.resolve(src)
+	if err != nil {
+		return err
+	}
+	failedCt := 0
+	for idx := leftIdx; idx < rightIdx; idx++ {
+		info, err := src.read(idx)
+		fmt.Printf("idx %d:", idx)
+		if info.Length > 0 {
+			fmt.Printf(" pos %d, length %d, flags %#04x, codec %v, encrypted %v,",
+				info.Pos, info.Length, info.Flags, info.Codec, info.EncryptedFlag)
+		}
+		if err != nil {
+			fmt.Printf(" error: %v\n", err)
+			failedCt++
+			continue
+		}
+		v := info.Value
+		fmt.Printf(" value %dB\n", len(v))
+		if *plimit > 0 && len(v) > *plimit {
+			v = v[:*plimit]
+		}
+		if *phex {
+			fmt.Print(hex.Dump(v))
+		} else {
+			fmt.Printf("  %q\n", v)
+		}
+	}
+	if failedCt > 0 {
+		return fmt.Errorf("%d records could not be read", failedCt)
+	}
+	return nil
+}
+
+const (
+	kindAuto  = "auto"
+	kindValue = "value"
+)
+
+func runDecode(args []string) error {
+	cf := newCommonFlags("decode")
+	rf := newRangeFlags(cf.fs)
+	pas := cf.fs.String("as", kindAuto, "decode the records as auto (veela.AcceptorRecord of an acceptor) "+
+		"or value (bare AcceptValue)")
+	plimit := cf.fs.Int("limit", 256, "max bytes of the body of each AcceptValue to print, 0 means no limit")
+	err := cf.parse(args)
+	if err != nil {
+		return err
+	}
+	switch *pas {
+	case kindAuto, kindValue:
+	default:
+		return fmt.Errorf("invalid -as: %q", *pas)
+	}
+	src, err := cf.open()
+	if err != nil {
+		return err
+	}
+	defer src.close()
+	leftIdx, rightIdx, err := rf.resolve(src)
+	if err != nil {
+		return err
+	}
+	failedCt := 0
+	for idx := leftIdx; idx < rightIdx; idx++ {
+		info, err := src.read(idx)
+		if err != nil {
+			fmt.Printf("idx %d: error: %v\n", idx, err)
+			failedCt++
+			continue
+		}
+		if *pas == kindValue {
+			err = printAcceptValue(idx, info.Value, *plimit)
+		} else {
+			err = printRecord(idx, info.Value, *plimit)
+		}
+		if err != nil {
+			fmt.Printf("idx %d: %v\n", idx, err)
+			failedCt++
+		}
+	}
+	if failedCt > 0 {
+		return fmt.Errorf("%d records could not be decoded", failedCt)
+	}
+	return nil
+}
+
+// printRecord prints v as a veela.AcceptorRecord.
+func printRecord(idx uint64, v []byte, limit int) error {
+	r, err := veela.ParseAcceptorRecord(v)
+	if err != nil {
+		return err
+	}
+	switch r.Kind {
+	case veela.AcceptorRecordCheckpoint:
+		fmt.Printf("idx %d: checkpoint AcceptorStateSummary\n%s", idx, indent(proto.MarshalTextString(r.Summary)))
+	case veela.AcceptorRecordInst:
+		fmt.Printf("idx %d: inst %d, allChosenFlag %v\n%s", idx, r.InstE, r.AllChosenFlag,
+			indent(proto.MarshalTextString(r.Inst)))
+	case veela.AcceptorRecordValue:
+		return printAcceptValue(idx, r.ValueBs, limit)
+	}
+	return nil
+}
+
+func printAcceptValue(idx uint64, v []byte, limit int) error {
+	var av veela.AcceptValue
+	err := av.UnMarshal(v)
+	if err != nil {
+		return fmt.Errorf("invalid AcceptValue: %v", err)
+	}
+	memberIdxs := av.GetMemberIdxs()
+	body := av.GetBody()
+	fmt.Printf("idx %d: AcceptValue\n  id: %d\n  memberIdxs: %s\n  body: %dB\n",
+		idx, av.GetID(), memberIdxs.String(), len(body))
+	if limit > 0 && len(body) > limit {
+		body = body[:limit]
+	}
+	fmt.Printf("  %q\n", body)
+	return nil
+}
+
+func indent(s string) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	return "  " + strings.Join(lines, "\n  ") + "\n"
+}
@@ -6,5 +6,8 @@ require (
 	github.com/boltdb/bolt v1.3.1
 	github.com/cockroachdb/pebble v0.0.0-20210226180910-7ea0bd9842fa
 	github.com/gogo/protobuf v1.3.2
+	github.com/golang/snappy v0.0.2-0.20190904063534-ff6b7dc882cf
+	github.com/klauspost/compress v1.11.7
 	github.com/prologic/bitcask v0.3.10
+	golang.org/x/sys v0.0.0-20200930185726-fdedc70b468f
 )
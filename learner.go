@@ -0,0 +1,334 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package veela
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	vpb "github.com/turingcell/veela/proto/veela"
+)
+
+const DefaultLearnerPollInterval = 100 * time.Millisecond
+
+// ChosenValueHandler receives the chosen AcceptValues one by one in the order
+// of instE.
+type ChosenValueHandler func(instE Epoch, v *AcceptValue)
+
+// StartLearner starts the learner of the group, which delivers the chosen
+// AcceptValues from startFromInstE to handler one by one in the order of
+// instE in a delivery goroutine of its own. A slow handler holds back the
+// delivery but not the learning, the AcceptValues learned meanwhile wait in
+// memory.
+//
+// The learner knows the insts chosen by the proposers and notified to the
+// acceptors of this process at once. It also polls the summaries of the
+// acceptors of the term of the next inst to deliver every pollInterval, an
+// inst is chosen if any acceptor is notified or a quorum accepted the same
+// acceptEpoch, so the gaps left by the lost ChosenNotify are filled. The
+// AcceptValues not known yet are fetched by id from the acceptors holding
+// them. A pollInterval of 0 means DefaultLearnerPollInterval.
+func (pg *PaxosGroup) StartLearner(startFromInstE Epoch, pollInterval time.Duration,
+	handler ChosenValueHandler) (*Learner, error) {
+
+	if startFromInstE == 0 {
+		return nil, fmt.Errorf("startFromInstE should > 0")
+	}
+	if handler == nil {
+		return nil, fmt.Errorf("handler should not be nil")
+	}
+	if pollInterval <= 0 {
+		pollInterval = DefaultLearnerPollInterval
+	}
+	l := &Learner{
+		pg:           pg,
+		pollInterval: pollInterval,
+		handler:      handler,
+		kickCh:       make(chan struct{}, 1),
+		deliverKick:  make(chan struct{}, 1),
+		doneCh:       make(chan struct{}),
+		deliverDone:  make(chan struct{}),
+		nextInstE:    startFromInstE,
+		chosenIDs:    make(map[Epoch]uint64),
+		chosenValues: make(map[Epoch]*AcceptValue),
+	}
+	l.ctx, l.cancel = context.WithCancel(context.Background())
+	pg.mux.Lock()
+	defer pg.mux.Unlock()
+	if pg.learner != nil {
+		return nil, fmt.Errorf("the learner of paxos group %q is already started", pg.groupName)
+	}
+	pg.learner = l
+	go l.loop()
+	go l.deliverLoop()
+	return l, nil
+}
+
+// AddElectionResult adds the term the learner learns from, the terms should
+// not overlap.
+func (l *Learner) AddElectionResult(er ElectionResult) error {
+	l.mux.Lock()
+	err := l.terms.add(er)
+	l.mux.Unlock()
+	if err == nil {
+		l.pg.acceptorProxy.addElectionResultHints(&er)
+		l.kick()
+	}
+	return err
+}
+
+// GetNextInstE returns the next inst to deliver, all the ones before it are
+// delivered or being delivered.
+func (l *Learner) GetNextInstE() Epoch {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.nextInstE
+}
+
+// Stop stops the learner and waits the handler to return, it should not be
+// called by the handler.
+func (l *Learner) Stop() {
+	l.cancel()
+	<-l.doneCh
+	<-l.deliverDone
+	l.pg.mux.Lock()
+	defer l.pg.mux.Unlock()
+	if l.pg.learner == l {
+		l.pg.learner = nil
+	}
+}
+
+func (l *Learner) kick() {
+	select {
+	case l.kickCh <- struct{}{}:
+	default:
+	}
+}
+
+func (l *Learner) kickDeliver() {
+	select {
+	case l.deliverKick <- struct{}{}:
+	default:
+	}
+}
+
+// learnerOnChosen tells the learner of the group that instE is chosen with
+// the AcceptValue id, v is nil if it is not known.
+func (pg *PaxosGroup) learnerOnChosen(instE Epoch, id uint64, v *AcceptValue) {
+	pg.mux.Lock()
+	l := pg.learner
+	pg.mux.Unlock()
+	if l != nil {
+		l.onChosen(instE, id, v)
+	}
+}
+
+func (l *Learner) onChosen(instE Epoch, id uint64, v *AcceptValue) {
+	l.mux.Lock()
+	if instE < l.nextInstE || l.chosenValues[instE] != nil {
+		l.mux.Unlock()
+		return
+	}
+	if v != nil {
+		l.chosenValues[instE] = v
+		delete(l.chosenIDs, instE)
+		l.mux.Unlock()
+		l.kickDeliver()
+		return
+	}
+	l.chosenIDs[instE] = id
+	l.mux.Unlock()
+	l.kick()
+}
+
+func (l *Learner) loop() {
+	defer close(l.doneCh)
+	ticker := time.NewTicker(l.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.ctx.Done():
+			return
+		case <-l.kickCh:
+			l.fetchChosen(nil)
+		case <-ticker.C:
+			l.poll()
+		}
+	}
+}
+
+func (l *Learner) deliverLoop() {
+	defer close(l.deliverDone)
+	for {
+		l.deliver()
+		select {
+		case <-l.ctx.Done():
+			return
+		case <-l.deliverKick:
+		}
+	}
+}
+
+// deliver hands the chosen AcceptValues from nextInstE to the handler until a
+// gap.
+func (l *Learner) deliver() {
+	for l.ctx.Err() == nil {
+		l.mux.Lock()
+		instE := l.nextInstE
+		v := l.chosenValues[instE]
+		if v == nil {
+			l.mux.Unlock()
+			return
+		}
+		delete(l.chosenValues, instE)
+		l.nextInstE++
+		l.mux.Unlock()
+		l.handler(instE, v)
+	}
+}
+
+// fetchChosen fetches the AcceptValues of chosenIDs, from the acceptors in
+// holders at first if any.
+func (l *Learner) fetchChosen(holders map[Epoch][]Epoch) {
+	type chosenID struct {
+		instE Epoch
+		id    uint64
+		er    ElectionResult
+	}
+	l.mux.Lock()
+	toFetch := make([]chosenID, 0, len(l.chosenIDs))
+	for instE, id := range l.chosenIDs {
+		if er, ok := l.terms.find(instE); ok {
+			toFetch = append(toFetch, chosenID{instE: instE, id: id, er: er})
+		}
+	}
+	l.mux.Unlock()
+	for _, c := range toFetch {
+		ids := append([]Epoch(nil), holders[c.instE]...)
+		for _, acceptorID := range c.er.acceptorIDs {
+			if !containEpoch(holders[c.instE], acceptorID) {
+				ids = append(ids, acceptorID)
+			}
+		}
+		bs, _, err := l.pg.acceptorProxy.getAcceptValue(l.ctx, 0, c.instE, c.id, ids)
+		if err != nil {
+			vlog.Debugf("learner: %v", err)
+			continue
+		}
+		var v AcceptValue
+		err = v.UnMarshal(bs)
+		if err != nil {
+			vlog.Errorf("learner: the accept value %d of inst %d is invalid: %v", c.id, c.instE.ToUint64(), err)
+			continue
+		}
+		l.onChosen(c.instE, c.id, &v)
+	}
+}
+
+func containEpoch(es []Epoch, e Epoch) bool {
+	for _, v := range es {
+		if v == e {
+			return true
+		}
+	}
+	return false
+}
+
+// poll finds the chosen insts from the first one not learned yet to the end of
+// its term by the summaries of the acceptors of the term, and fetches their
+// AcceptValues.
+func (l *Learner) poll() {
+	l.mux.Lock()
+	nextInstE := l.nextInstE
+	for l.chosenValues[nextInstE] != nil {
+		nextInstE++
+	}
+	er, ok := l.terms.find(nextInstE)
+	l.mux.Unlock()
+	if !ok {
+		return
+	}
+	ids := er.acceptorIDs
+	rightE := er.startFromInstE + Epoch(er.termLen) - 1
+	summaries := l.pg.acceptorProxy.getSummaries(l.ctx, ids, func(i int) *vpb.AcceptorRpcGetSummaryRequest {
+		return &vpb.AcceptorRpcGetSummaryRequest{
+			GroupName:               l.pg.groupName,
+			AcceptorID:              ids[i].ToUint64(),
+			GetInstEpochRangeLeftE:  er.startFromInstE.ToUint64(),
+			GetInstEpochRangeRightE: rightE.ToUint64(),
+		}
+	})
+	terms := make([]*vpb.AcceptorTermState, len(ids))
+	for i, summary := range summaries {
+		if summary == nil {
+			continue
+		}
+		for _, term := range summary.AcceptorTermStates {
+			if term.StartFromInstE == er.startFromInstE.ToUint64() &&
+				uint64(len(term.AcceptorInOnePaxosInstanceStateArray)) == er.termLen {
+				terms[i] = term
+			}
+		}
+	}
+	holders := make(map[Epoch][]Epoch)
+	for instE := nextInstE; instE <= rightE; instE++ {
+		id, ok := chosenIDFromTerms(&er, terms, instE)
+		if !ok {
+			continue
+		}
+		for i, term := range terms {
+			if term == nil {
+				continue
+			}
+			inst := term.AcceptorInOnePaxosInstanceStateArray[instE-er.startFromInstE]
+			if inst == nil {
+				continue
+			}
+			if _, ok := inst.AcceptValueLogdbIdxMap[id]; ok {
+				holders[instE] = append(holders[instE], ids[i])
+			}
+		}
+		l.onChosen(instE, id, nil)
+	}
+	l.fetchChosen(holders)
+}
+
+// chosenIDFromTerms returns the chosen AcceptValueID of instE if any acceptor
+// is notified, or a quorum of them accepted the same acceptEpoch, which is
+// proposed with only one AcceptValue.
+func chosenIDFromTerms(er *ElectionResult, terms []*vpb.AcceptorTermState, instE Epoch) (uint64, bool) {
+	acceptedCt := make(map[uint64]int)
+	for _, term := range terms {
+		if term == nil {
+			continue
+		}
+		inst := term.AcceptorInOnePaxosInstanceStateArray[instE-er.startFromInstE]
+		if inst == nil {
+			continue
+		}
+		if inst.ChosenFlag && inst.AcceptValueID != 0 {
+			return inst.AcceptValueID, true
+		}
+		if inst.AcceptEpoch == 0 || inst.AcceptValueID == 0 {
+			continue
+		}
+		acceptedCt[inst.AcceptEpoch]++
+		if acceptedCt[inst.AcceptEpoch] >= er.quorum() {
+			return inst.AcceptValueID, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,143 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package veela
+
+import (
+	"testing"
+	"time"
+
+	vpb "github.com/turingcell/veela/proto/veela"
+)
+
+type deliveredValue struct {
+	instE Epoch
+	body  string
+}
+
+func startTestLearner(t *testing.T, pg *PaxosGroup, er ElectionResult) (*Learner, chan deliveredValue) {
+	t.Helper()
+	ch := make(chan deliveredValue, 16)
+	l, err := pg.StartLearner(1, 10*time.Millisecond, func(instE Epoch, v *AcceptValue) {
+		ch <- deliveredValue{instE, string(v.GetBody())}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.AddElectionResult(er)
+	if err != nil {
+		l.Stop()
+		t.Fatal(err)
+	}
+	return l, ch
+}
+
+func expectDelivered(t *testing.T, ch chan deliveredValue, expect ...deliveredValue) {
+	t.Helper()
+	for _, e := range expect {
+		select {
+		case d := <-ch:
+			if d != e {
+				t.Fatalf("got %+v but expect %+v", d, e)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for %+v", e)
+		}
+	}
+}
+
+// The learner delivers the chosen values in order, what is chosen is told
+// by the in-process acceptors and the proposer.
+func TestLearnerDeliver(t *testing.T) {
+	pg, as, er := newTestGroup(t, 3, 2, 4)
+	defer func() {
+		for _, a := range as {
+			a.Close()
+		}
+	}()
+	l, ch := startTestLearner(t, pg, er)
+	defer l.Stop()
+	p := newTestProposer(t, pg, 1, er)
+	propose(t, p, 2, "b")
+	propose(t, p, 1, "a")
+	expectDelivered(t, ch, deliveredValue{1, "a"}, deliveredValue{2, "b"})
+	if l.GetNextInstE() != 3 {
+		t.Fatalf("next inst %d", l.GetNextInstE())
+	}
+}
+
+// The learner started late polls the acceptors for what was chosen before.
+func TestLearnerCatchUp(t *testing.T) {
+	pg, _, er := newTestGroup(t, 3, 3, 4)
+	p := newTestProposer(t, pg, 1, er)
+	for i, body := range []string{"a", "b", "c"} {
+		propose(t, p, Epoch(i+1), body)
+	}
+	l, ch := startTestLearner(t, pg, er)
+	defer l.Stop()
+	expectDelivered(t, ch, deliveredValue{1, "a"}, deliveredValue{2, "b"}, deliveredValue{3, "c"})
+}
+
+// A handler blocked in delivering inst 1 does not stop the learner from
+// polling that inst 2 is accepted by a quorum.
+func TestLearnerSlowHandler(t *testing.T) {
+	pg, as, er := newTestGroup(t, 3, 3, 4)
+	defer func() {
+		for _, a := range as {
+			a.Close()
+		}
+	}()
+	release := make(chan struct{})
+	ch := make(chan deliveredValue, 16)
+	l, err := pg.StartLearner(1, 10*time.Millisecond, func(instE Epoch, v *AcceptValue) {
+		ch <- deliveredValue{instE, string(v.GetBody())}
+		if instE == 1 {
+			<-release
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+	defer close(release)
+	err = l.AddElectionResult(er)
+	if err != nil {
+		t.Fatal(err)
+	}
+	propose(t, newTestProposer(t, pg, 1, er), 1, "a")
+	expectDelivered(t, ch, deliveredValue{1, "a"})
+
+	const ok = vpb.StatusCode_OK
+	for _, a := range as[:2] {
+		runAcceptorSteps(t, a, []acceptorStep{
+			{"prepare", prepareStep(2, 5), ok, true, nil},
+			{"accept", acceptStep(t, 2, 5, 5, "b"), ok, true, nil},
+		})
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		l.mux.Lock()
+		learnedFlag := l.chosenValues[2] != nil
+		l.mux.Unlock()
+		if learnedFlag {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("inst 2 is not learned while the handler is blocked")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	release <- struct{}{}
+	expectDelivered(t, ch, deliveredValue{2, "b"})
+}
@@ -14,7 +14,12 @@
 
 package log
 
-import "sync"
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
 
 var (
 	globalSharedLoggerMux      sync.Mutex
@@ -22,8 +27,9 @@ var (
 	globalSharedLoggerInitFlag bool
 )
 
+// New returns a Logger writing to stderr through the standard log package.
 func New() Logger {
-	panic("NIY")
+	return &stdLogger{l: log.New(os.Stderr, "", log.LstdFlags|log.Lmicroseconds)}
 }
 
 func GetGlobalSharedLogger() Logger {
@@ -51,3 +57,94 @@ type Logger interface {
 	Panicf(format string, v ...interface{})
 	Panicln(v ...interface{})
 }
+
+type stdLogger struct {
+	l *log.Logger
+}
+
+func (sl *stdLogger) Debugf(format string, v ...interface{}) {
+	sl.l.Output(2, "DEBUG "+fmt.Sprintf(format, v...))
+}
+
+func (sl *stdLogger) Debugln(v ...interface{}) {
+	sl.l.Output(2, "DEBUG "+fmt.Sprintln(v...))
+}
+
+func (sl *stdLogger) Infof(format string, v ...interface{}) {
+	sl.l.Output(2, "INFO "+fmt.Sprintf(format, v...))
+}
+
+func (sl *stdLogger) Infoln(v ...interface{}) {
+	sl.l.Output(2, "INFO "+fmt.Sprintln(v...))
+}
+
+func (sl *stdLogger) Warnf(format string, v ...interface{}) {
+	sl.l.Output(2, "WARN "+fmt.Sprintf(format, v...))
+}
+
+func (sl *stdLogger) Warnln(v ...interface{}) {
+	sl.l.Output(2, "WARN "+fmt.Sprintln(v...))
+}
+
+func (sl *stdLogger) Errorf(format string, v ...interface{}) {
+	sl.l.Output(2, "ERROR "+fmt.Sprintf(format, v...))
+}
+
+func (sl *stdLogger) Errorln(v ...interface{}) {
+	sl.l.Output(2, "ERROR "+fmt.Sprintln(v...))
+}
+
+func (sl *stdLogger) Fatalf(format string, v ...interface{}) {
+	sl.l.Output(2, "FATAL "+fmt.Sprintf(format, v...))
+	os.Exit(1)
+}
+
+func (sl *stdLogger) Fatalln(v ...interface{}) {
+	sl.l.Output(2, "FATAL "+fmt.Sprintln(v...))
+	os.Exit(1)
+}
+
+func (sl *stdLogger) Panicf(format string, v ...interface{}) {
+	s := fmt.Sprintf(format, v...)
+	sl.l.Output(2, "PANIC "+s)
+	panic(s)
+}
+
+func (sl *stdLogger) Panicln(v ...interface{}) {
+	s := fmt.Sprintln(v...)
+	sl.l.Output(2, "PANIC "+s)
+	panic(s)
+}
+
+// NewDiscard returns a Logger dropping everything, but Fatal still exits and
+// Panic still panics.
+func NewDiscard() Logger {
+	return discardLogger{}
+}
+
+type discardLogger struct{}
+
+func (discardLogger) Debugf(format string, v ...interface{}) {}
+func (discardLogger) Debugln(v ...interface{})               {}
+func (discardLogger) Infof(format string, v ...interface{})  {}
+func (discardLogger) Infoln(v ...interface{})                {}
+func (discardLogger) Warnf(format string, v ...interface{})  {}
+func (discardLogger) Warnln(v ...interface{})                {}
+func (discardLogger) Errorf(format string, v ...interface{}) {}
+func (discardLogger) Errorln(v ...interface{})               {}
+
+func (discardLogger) Fatalf(format string, v ...interface{}) {
+	os.Exit(1)
+}
+
+func (discardLogger) Fatalln(v ...interface{}) {
+	os.Exit(1)
+}
+
+func (discardLogger) Panicf(format string, v ...interface{}) {
+	panic(fmt.Sprintf(format, v...))
+}
+
+func (discardLogger) Panicln(v ...interface{}) {
+	panic(fmt.Sprintln(v...))
+}
@@ -0,0 +1,197 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"fmt"
+	"sync"
+)
+
+// AppendFuture reports the result of an AppendAsync.
+type AppendFuture struct {
+	done chan struct{}
+	err  error
+}
+
+func newAppendFuture() *AppendFuture {
+	return &AppendFuture{done: make(chan struct{})}
+}
+
+func newFailedAppendFuture(err error) *AppendFuture {
+	f := newAppendFuture()
+	f.complete(err)
+	return f
+}
+
+func (f *AppendFuture) complete(err error) {
+	f.err = err
+	close(f.done)
+}
+
+// Done is closed when the values are durable or failed.
+func (f *AppendFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait blocks until Done and returns nil if the values are durable.
+func (f *AppendFuture) Wait() error {
+	<-f.done
+	return f.err
+}
+
+// asyncAppender implements AppendAsync and Flush on top of the synchronous
+// appendAndSync3 of a DB. The batches queued while the previous
+// appendAndSync3 is in flight are merged into the next one, as long as they
+// are not larger than maxMergeBytes in total.
+type asyncAppender struct {
+	// read only
+	appendAndSync3     func(appendAtIdx uint64, vArray [][]byte, deleteAllIdxLessThan uint64) error
+	getCurrentIdxRange func() (leftIdx, toAppendIdx uint64)
+	maxMergeBytes      uint64
+
+	mux   sync.Mutex
+	queue []*asyncBatch
+	// a worker goroutine is running
+	busyFlag bool
+	// toAppendIdx after all the queued batches, only valid when busyFlag
+	nextIdx uint64
+	// the future of the last queued batch, nil once the queue drains
+	last *AppendFuture
+	// count of the batches ever queued, the seq of a batch is the count
+	// after it is queued
+	seq uint64
+	// the failures not reported by flush yet, ascending by seq
+	failures []asyncFailure
+}
+
+type asyncBatch struct {
+	seq         uint64
+	appendAtIdx uint64
+	vArray      [][]byte
+	f           *AppendFuture
+}
+
+type asyncFailure struct {
+	// seq of the first batch failed
+	seq uint64
+	err error
+}
+
+func (a *asyncAppender) appendAsync(appendAtIdx uint64, vArray [][]byte) *AppendFuture {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	nextIdx := a.nextIdx
+	if !a.busyFlag {
+		_, nextIdx = a.getCurrentIdxRange()
+	}
+	if appendAtIdx != nextIdx {
+		return newFailedAppendFuture(fmt.Errorf("appendAtIdx %d != toAppendIdx %d", appendAtIdx, nextIdx))
+	}
+	f := newAppendFuture()
+	if len(vArray) == 0 && !a.busyFlag {
+		f.complete(nil)
+		return f
+	}
+	a.seq++
+	a.queue = append(a.queue, &asyncBatch{
+		seq:         a.seq,
+		appendAtIdx: appendAtIdx,
+		vArray:      vArray,
+		f:           f,
+	})
+	a.nextIdx = nextIdx + uint64(len(vArray))
+	a.last = f
+	if !a.busyFlag {
+		a.busyFlag = true
+		go a.run()
+	}
+	return f
+}
+
+func (a *asyncAppender) run() {
+	for {
+		a.mux.Lock()
+		if len(a.queue) == 0 {
+			a.busyFlag = false
+			a.last = nil
+			a.mux.Unlock()
+			return
+		}
+		n := 1
+		mergedBytes := recordsLen(a.queue[0].vArray)
+		for n < len(a.queue) {
+			mergedBytes += recordsLen(a.queue[n].vArray)
+			if mergedBytes > a.maxMergeBytes {
+				break
+			}
+			n++
+		}
+		batches := a.queue[:n]
+		a.queue = a.queue[n:]
+		a.mux.Unlock()
+
+		var merged [][]byte
+		for _, b := range batches {
+			merged = append(merged, b.vArray...)
+		}
+		err := a.appendAndSync3(batches[0].appendAtIdx, merged, 0)
+		if err != nil {
+			// All the queued batches after it fail too since they are not
+			// continuous anymore. Completing them under a.mux keeps the
+			// completions in order with the batches queued later.
+			a.mux.Lock()
+			for _, b := range batches {
+				b.f.complete(err)
+			}
+			for _, b := range a.queue {
+				b.f.complete(fmt.Errorf("a previous AppendAsync failed: %w", err))
+			}
+			a.failures = append(a.failures, asyncFailure{seq: batches[0].seq, err: err})
+			a.queue = nil
+			a.busyFlag = false
+			a.last = nil
+			a.mux.Unlock()
+			return
+		}
+		for _, b := range batches {
+			b.f.complete(nil)
+		}
+	}
+}
+
+// flush blocks until all the queued batches are completed. It returns the
+// first failure of the batches queued since the previous flush, each failure
+// is returned by only one flush.
+func (a *asyncAppender) flush() error {
+	a.mux.Lock()
+	f := a.last
+	seq := a.seq
+	a.mux.Unlock()
+	if f != nil {
+		f.Wait()
+	}
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	n := 0
+	for n < len(a.failures) && a.failures[n].seq <= seq {
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+	err := a.failures[0].err
+	a.failures = append([]asyncFailure(nil), a.failures[n:]...)
+	return fmt.Errorf("a previous AppendAsync failed: %w", err)
+}
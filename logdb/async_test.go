@@ -0,0 +1,89 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"errors"
+	"testing"
+)
+
+var errInjected = errors.New("injected fault")
+
+func TestFlushReportsEachFailureOnce(t *testing.T) {
+	cases := []struct {
+		name    string
+		barrier func(db DB) error
+	}{
+		{"Flush", func(db DB) error { return db.Flush() }},
+		{"AppendAndSync3", func(db DB) error { return db.AppendAndSync3(1, [][]byte{testValue(1)}, 0) }},
+		{"TruncateFrom", func(db DB) error { return db.TruncateFrom(1) }},
+		{"Close", func(db DB) error { return db.Close() }},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			db := NewMemDB()
+			db.FailNextSyncs(1, errInjected)
+			f := db.AppendAsync(1, [][]byte{testValue(1)})
+			if err := f.Wait(); !errors.Is(err, errInjected) {
+				t.Fatalf("expect %v but got %v", errInjected, err)
+			}
+			if err := c.barrier(db); !errors.Is(err, errInjected) {
+				t.Fatalf("expect %v but got %v", errInjected, err)
+			}
+			// reported already
+			if err := db.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestFlushAfterRecovery(t *testing.T) {
+	db := NewMemDB()
+	for i := 1; i <= 3; i++ {
+		db.AppendAsync(uint64(i), [][]byte{testValue(i)})
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	db.FailNextSyncs(1, errInjected)
+	f4 := db.AppendAsync(4, [][]byte{testValue(4)})
+	f5 := db.AppendAsync(5, [][]byte{testValue(5)})
+	if err := f5.Wait(); err == nil {
+		t.Fatal("a batch after a failed one should fail")
+	}
+	if err := f4.Wait(); !errors.Is(err, errInjected) {
+		t.Fatalf("expect %v but got %v", errInjected, err)
+	}
+	// the failure is not reported by a successful append since then
+	if err := db.Flush(); !errors.Is(err, errInjected) {
+		t.Fatalf("expect %v but got %v", errInjected, err)
+	}
+	// the failed append broke the MemDB, a reopen drops the failures like a
+	// restarted process
+	if err := db.AppendAsync(4, [][]byte{testValue(4)}).Wait(); err == nil {
+		t.Fatal("the MemDB should be broken")
+	}
+	db.PowerLoss()
+	if err := db.AppendAsync(4, [][]byte{testValue(4)}).Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, toAppendIdx := db.GetCurrentIdxRange(); toAppendIdx != 5 {
+		t.Fatalf("toAppendIdx %d", toAppendIdx)
+	}
+}
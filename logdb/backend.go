@@ -0,0 +1,108 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// the name of the backend implemented by this package
+const FileBackendName = "file"
+
+// Backend creates and opens a kind of DB, the semantics of Create and Open
+// are the same with CreateDBWithOptions and OpenDBIfExistWithOptions. A
+// backend should honour the members of Options or reject the ones it does not
+// support, Options.KeyProvider is rejected before Create and Open unless
+// EncryptionFlag is set and Options.ReadOnly unless ReadOnlyFlag is set.
+type Backend struct {
+	Create func(dirPathStr string, opts *Options) (DB, error)
+	Open   func(dirPathStr string, opts *Options) (DB, error)
+	// set if the backend encrypts with Options.KeyProvider
+	EncryptionFlag bool
+	// set if the backend supports Options.ReadOnly
+	ReadOnlyFlag bool
+}
+
+var (
+	backendsMux sync.RWMutex
+	backends    = map[string]Backend{
+		FileBackendName: {
+			Create:         CreateDBWithOptions,
+			Open:           OpenDBIfExistWithOptions,
+			EncryptionFlag: true,
+			ReadOnlyFlag:   true,
+		},
+	}
+)
+
+// RegisterBackend is usually called by the init of the package implementing
+// the backend, it panics if name is already registered.
+func RegisterBackend(name string, b Backend) {
+	backendsMux.Lock()
+	defer backendsMux.Unlock()
+	if b.Create == nil || b.Open == nil {
+		panic("logdb: RegisterBackend with a nil func")
+	}
+	if _, ok := backends[name]; ok {
+		panic("logdb: RegisterBackend called twice for backend " + name)
+	}
+	backends[name] = b
+}
+
+// Return the names of all the registered backends in ascending order.
+func BackendNames() []string {
+	backendsMux.RLock()
+	defer backendsMux.RUnlock()
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func getBackend(name string, opts *Options) (Backend, error) {
+	backendsMux.RLock()
+	defer backendsMux.RUnlock()
+	b, ok := backends[name]
+	if !ok {
+		return Backend{}, fmt.Errorf("unknown logdb backend %q (forgotten import?)", name)
+	}
+	if opts != nil && opts.KeyProvider != nil && !b.EncryptionFlag {
+		return Backend{}, fmt.Errorf("logdb backend %q does not support encryption", name)
+	}
+	if opts != nil && opts.ReadOnly && !b.ReadOnlyFlag {
+		return Backend{}, fmt.Errorf("logdb backend %q does not support the read only mode", name)
+	}
+	return b, nil
+}
+
+func CreateDBWithBackend(backendName string, dirPathStr string, opts *Options) (DB, error) {
+	b, err := getBackend(backendName, opts)
+	if err != nil {
+		return nil, err
+	}
+	return b.Create(dirPathStr, opts)
+}
+
+func OpenDBIfExistWithBackend(backendName string, dirPathStr string, opts *Options) (DB, error) {
+	b, err := getBackend(backendName, opts)
+	if err != nil {
+		return nil, err
+	}
+	return b.Open(dirPathStr, opts)
+}
@@ -0,0 +1,104 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bitcaskbackend registers the logdb backend "bitcask", which keeps
+// a logdb.DB inside a bitcask instance. Import it for the side effect:
+//
+//	import _ "github.com/turingcell/veela/logdb/backends/bitcaskbackend"
+package bitcaskbackend
+
+import (
+	"fmt"
+
+	"github.com/prologic/bitcask"
+	"github.com/turingcell/veela/logdb"
+)
+
+const BackendName = "bitcask"
+
+const maxDatafileSize = 64 << 20
+
+func init() {
+	logdb.RegisterBackend(BackendName, logdb.Backend{
+		Create: func(dirPathStr string, opts *logdb.Options) (logdb.DB, error) {
+			return logdb.CreateKVDBWithOptions(dirPathStr, openStore, opts)
+		},
+		Open: func(dirPathStr string, opts *logdb.Options) (logdb.DB, error) {
+			return logdb.OpenKVDBIfExistWithOptions(dirPathStr, openStore, opts)
+		},
+	})
+}
+
+// bitcask treats an empty value as a tombstone when it reloads the datafiles,
+// so every value is stored with a one-byte prefix.
+// One Write is not atomic since bitcask has no batch.
+type store struct {
+	db *bitcask.Bitcask
+}
+
+const valuePrefix = 1
+
+func openStore(dirPathStr string) (logdb.KVStore, error) {
+	db, err := bitcask.Open(dirPathStr,
+		bitcask.WithMaxDatafileSize(maxDatafileSize),
+		bitcask.WithMaxValueSize(logdb.MaxSegmentSize))
+	if err != nil {
+		return nil, err
+	}
+	return &store{db: db}, nil
+}
+
+func (s *store) Get(key []byte) ([]byte, error) {
+	v, err := s.db.Get(key)
+	if err == bitcask.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(v) == 0 || v[0] != valuePrefix {
+		return nil, fmt.Errorf("bitcask value of key %x got an invalid prefix", key)
+	}
+	return append([]byte{}, v[1:]...), nil
+}
+
+func (s *store) Write(sets []logdb.KVPair, deletes [][]byte, syncFlag bool) error {
+	for _, kv := range sets {
+		bs := make([]byte, 1+len(kv.Value))
+		bs[0] = valuePrefix
+		copy(bs[1:], kv.Value)
+		err := s.db.Put(kv.Key, bs)
+		if err != nil {
+			return err
+		}
+	}
+	for _, key := range deletes {
+		err := s.db.Delete(key)
+		if err != nil {
+			return err
+		}
+	}
+	if syncFlag {
+		return s.db.Sync()
+	}
+	return nil
+}
+
+func (s *store) AtomicFlag() bool {
+	return false
+}
+
+func (s *store) Close() error {
+	return s.db.Close()
+}
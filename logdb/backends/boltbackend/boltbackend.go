@@ -0,0 +1,104 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package boltbackend registers the logdb backend "bolt", which keeps a
+// logdb.DB inside a bolt file. Import it for the side effect:
+//
+//	import _ "github.com/turingcell/veela/logdb/backends/boltbackend"
+package boltbackend
+
+import (
+	"path/filepath"
+
+	"github.com/boltdb/bolt"
+	"github.com/turingcell/veela/logdb"
+)
+
+const BackendName = "bolt"
+
+const fileName = "logdb.bolt"
+
+var bucketName = []byte("logdb")
+
+func init() {
+	logdb.RegisterBackend(BackendName, logdb.Backend{
+		Create: func(dirPathStr string, opts *logdb.Options) (logdb.DB, error) {
+			return logdb.CreateKVDBWithOptions(dirPathStr, openStore, opts)
+		},
+		Open: func(dirPathStr string, opts *logdb.Options) (logdb.DB, error) {
+			return logdb.OpenKVDBIfExistWithOptions(dirPathStr, openStore, opts)
+		},
+	})
+}
+
+// bolt syncs every transaction unless NoSync is set, which is switched by
+// syncFlag of each Write since the Writes are never concurrent.
+type store struct {
+	db *bolt.DB
+}
+
+func openStore(dirPathStr string) (logdb.KVStore, error) {
+	db, err := bolt.Open(filepath.Join(dirPathStr, fileName), 0644, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketName)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &store{db: db}, nil
+}
+
+func (s *store) Get(key []byte) (v []byte, e error) {
+	e = s.db.View(func(tx *bolt.Tx) error {
+		// the value is only valid inside the transaction
+		if bs := tx.Bucket(bucketName).Get(key); bs != nil {
+			v = append([]byte{}, bs...)
+		}
+		return nil
+	})
+	return
+}
+
+func (s *store) Write(sets []logdb.KVPair, deletes [][]byte, syncFlag bool) error {
+	s.db.NoSync = !syncFlag
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketName)
+		for _, kv := range sets {
+			err := b.Put(kv.Key, kv.Value)
+			if err != nil {
+				return err
+			}
+		}
+		for _, key := range deletes {
+			err := b.Delete(key)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *store) AtomicFlag() bool {
+	return true
+}
+
+func (s *store) Close() error {
+	return s.db.Close()
+}
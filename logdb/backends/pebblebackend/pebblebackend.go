@@ -0,0 +1,95 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pebblebackend registers the logdb backend "pebble", which keeps a
+// logdb.DB inside a pebble instance. Import it for the side effect:
+//
+//	import _ "github.com/turingcell/veela/logdb/backends/pebblebackend"
+package pebblebackend
+
+import (
+	"github.com/cockroachdb/pebble"
+	"github.com/turingcell/veela/logdb"
+)
+
+const BackendName = "pebble"
+
+func init() {
+	logdb.RegisterBackend(BackendName, logdb.Backend{
+		Create: func(dirPathStr string, opts *logdb.Options) (logdb.DB, error) {
+			return logdb.CreateKVDBWithOptions(dirPathStr, openStore, opts)
+		},
+		Open: func(dirPathStr string, opts *logdb.Options) (logdb.DB, error) {
+			return logdb.OpenKVDBIfExistWithOptions(dirPathStr, openStore, opts)
+		},
+	})
+}
+
+type store struct {
+	db *pebble.DB
+}
+
+func openStore(dirPathStr string) (logdb.KVStore, error) {
+	db, err := pebble.Open(dirPathStr, &pebble.Options{})
+	if err != nil {
+		return nil, err
+	}
+	return &store{db: db}, nil
+}
+
+func (s *store) Get(key []byte) ([]byte, error) {
+	v, closer, err := s.db.Get(key)
+	if err == pebble.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ret := append([]byte{}, v...)
+	err = closer.Close()
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (s *store) Write(sets []logdb.KVPair, deletes [][]byte, syncFlag bool) error {
+	b := s.db.NewBatch()
+	defer b.Close()
+	for _, kv := range sets {
+		err := b.Set(kv.Key, kv.Value, nil)
+		if err != nil {
+			return err
+		}
+	}
+	for _, key := range deletes {
+		err := b.Delete(key, nil)
+		if err != nil {
+			return err
+		}
+	}
+	opts := pebble.NoSync
+	if syncFlag {
+		opts = pebble.Sync
+	}
+	return b.Commit(opts)
+}
+
+func (s *store) AtomicFlag() bool {
+	return true
+}
+
+func (s *store) Close() error {
+	return s.db.Close()
+}
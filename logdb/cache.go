@@ -0,0 +1,123 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"container/list"
+	"sync"
+)
+
+// valueCache is the LRU cache of values by idx for Options.CacheSize, a nil
+// *valueCache caches nothing.
+//
+// A value read before a TruncateFrom must not be cached after it, since the
+// idx may be appended again with another value. So every put carries the
+// generation got together with the directory entry, i.e. fileDB.truncatedCt,
+// and is dropped if it is stale.
+type valueCache struct {
+	capBytes uint64
+
+	mux   sync.Mutex
+	gen   uint64
+	bytes uint64
+	// front is the most recently used
+	lru *list.List
+	m   map[uint64]*list.Element
+}
+
+type cacheItem struct {
+	idx uint64
+	v   []byte
+}
+
+// the bytes charged for an item besides its value
+const cacheItemOverhead = 64
+
+func newValueCache(capBytes uint64) *valueCache {
+	if capBytes == 0 {
+		return nil
+	}
+	return &valueCache{
+		capBytes: capBytes,
+		lru:      list.New(),
+		m:        make(map[uint64]*list.Element),
+	}
+}
+
+// get returns a copy of the cached value of idx.
+func (c *valueCache) get(idx uint64) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	e, ok := c.m[idx]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	v := e.Value.(*cacheItem).v
+	return append(make([]byte, 0, len(v)), v...), true
+}
+
+// put caches a copy of vArray as the values from idx.
+func (c *valueCache) put(gen uint64, idx uint64, vArray [][]byte) {
+	if c == nil {
+		return
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if gen != c.gen {
+		return
+	}
+	for i, v := range vArray {
+		if uint64(len(v)+cacheItemOverhead) > c.capBytes {
+			continue
+		}
+		c.remove(idx + uint64(i))
+		item := &cacheItem{idx: idx + uint64(i), v: append([]byte(nil), v...)}
+		c.m[item.idx] = c.lru.PushFront(item)
+		c.bytes += uint64(len(v) + cacheItemOverhead)
+	}
+	for c.bytes > c.capBytes {
+		c.remove(c.lru.Back().Value.(*cacheItem).idx)
+	}
+}
+
+// truncateFrom drops the values of idx >= idx and moves to generation gen.
+func (c *valueCache) truncateFrom(gen uint64, idx uint64) {
+	if c == nil {
+		return
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.gen = gen
+	for k := range c.m {
+		if k >= idx {
+			c.remove(k)
+		}
+	}
+}
+
+// caller should hold c.mux
+func (c *valueCache) remove(idx uint64) {
+	e, ok := c.m[idx]
+	if !ok {
+		return
+	}
+	c.lru.Remove(e)
+	delete(c.m, idx)
+	c.bytes -= uint64(len(e.Value.(*cacheItem).v) + cacheItemOverhead)
+}
@@ -0,0 +1,119 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+func TestValueCacheGeneration(t *testing.T) {
+	c := newValueCache(1 << 20)
+	c.put(0, 1, [][]byte{testValue(1), testValue(2), testValue(3)})
+	c.truncateFrom(1, 2)
+	if v, ok := c.get(1); !ok || !bytes.Equal(v, testValue(1)) {
+		t.Fatalf("idx 1 got %q %v", v, ok)
+	}
+	if _, ok := c.get(2); ok {
+		t.Fatal("the truncated idx 2 is still cached")
+	}
+	// put by a reader which read before the truncation
+	c.put(0, 2, [][]byte{testValue(2)})
+	if _, ok := c.get(2); ok {
+		t.Fatal("a stale put is cached")
+	}
+	c.put(1, 2, [][]byte{againValue(2)})
+	if v, ok := c.get(2); !ok || !bytes.Equal(v, againValue(2)) {
+		t.Fatalf("idx 2 got %q %v", v, ok)
+	}
+	// the got value is a copy
+	v, _ := c.get(2)
+	v[0] = 'x'
+	if v, _ := c.get(2); !bytes.Equal(v, againValue(2)) {
+		t.Fatalf("idx 2 got %q after the copy is modified", v)
+	}
+}
+
+func TestValueCacheEviction(t *testing.T) {
+	itemBytes := uint64(len(testValue(1)) + cacheItemOverhead)
+	c := newValueCache(2 * itemBytes)
+	c.put(0, 1, [][]byte{testValue(1), testValue(2)})
+	// idx 1 is the most recently used
+	c.get(1)
+	c.put(0, 3, [][]byte{testValue(3)})
+	if _, ok := c.get(2); ok {
+		t.Fatal("the least recently used idx 2 is not evicted")
+	}
+	for _, idx := range []int{1, 3} {
+		if v, ok := c.get(uint64(idx)); !ok || !bytes.Equal(v, testValue(idx)) {
+			t.Fatalf("idx %d got %q %v", idx, v, ok)
+		}
+	}
+	if c.bytes != 2*itemBytes {
+		t.Fatalf("got %d bytes cached", c.bytes)
+	}
+	// larger than the whole cache
+	c.put(0, 4, [][]byte{make([]byte, 2*itemBytes)})
+	if _, ok := c.get(4); ok {
+		t.Fatal("a value larger than the cache is cached")
+	}
+	var nilCache *valueCache
+	nilCache.put(0, 1, [][]byte{testValue(1)})
+	if _, ok := nilCache.get(1); ok {
+		t.Fatal("a nil cache caches something")
+	}
+}
+
+// A reader which got the entry before a TruncateFrom never caches its value
+// for the idx appended again.
+func TestCacheInflightReadAcrossTruncate(t *testing.T) {
+	const n, idx = 6, 3
+	db, err := createFileDB(filepath.Join(t.TempDir(), "db"), NewOptions(WithCacheSize(1<<20)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 1; i <= n; i++ {
+		err = db.AppendAndSync(uint64(i), [][]byte{testValue(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, entry, gen, err := db.acquireEntry(idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := s.readRecord(entry)
+	s.readers.Done()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.TruncateFrom(idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AppendAndSync(idx, [][]byte{againValue(idx)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the in-flight reader puts the value it read at last
+	db.cache.put(gen, idx, [][]byte{v})
+	got, err := db.GetValueByIdx(idx)
+	if err != nil || !bytes.Equal(got, againValue(idx)) {
+		t.Fatalf("idx %d got %q %v", idx, got, err)
+	}
+}
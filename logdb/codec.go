@@ -0,0 +1,137 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec compresses the data of one record. The id is kept in the low bits of
+// the record Flags, so records of different codecs coexist in one logdb and
+// each one is decoded by its own codec whatever Options.Compression is.
+type Codec uint16
+
+const (
+	CodecNone   Codec = 0
+	CodecSnappy Codec = 1
+	CodecZstd   Codec = 2
+
+	recordFlagsCodecMask = 0x000f
+
+	DefaultCompressionMinSize = 64
+)
+
+func (c Codec) String() string {
+	switch c {
+	case CodecNone:
+		return "none"
+	case CodecSnappy:
+		return "snappy"
+	case CodecZstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("codec(%d)", uint16(c))
+}
+
+func (c Codec) supportedFlag() bool {
+	return c == CodecNone || c == CodecSnappy || c == CodecZstd
+}
+
+// The zstd encoder and decoder are safe for concurrent EncodeAll and
+// DecodeAll, they are created on first use since both own goroutines.
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+func initZstd() {
+	zstdOnce.Do(func() {
+		var err error
+		zstdEncoder, err = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+		if err != nil {
+			panic(err)
+		}
+		zstdDecoder, err = zstd.NewReader(nil)
+		if err != nil {
+			panic(err)
+		}
+	})
+}
+
+// encodeValues returns the data and flags of the records of vArray. A value
+// shorter than minSize, or which does not shrink, is kept as is. flags is
+// nil if none is compressed.
+func encodeValues(vArray [][]byte, codec Codec, minSize int) (dataArray [][]byte, flags []uint16, e error) {
+	if codec == CodecNone {
+		return vArray, nil, nil
+	}
+	for i, v := range vArray {
+		if len(v) < minSize {
+			continue
+		}
+		var data []byte
+		switch codec {
+		case CodecSnappy:
+			data = snappy.Encode(nil, v)
+		case CodecZstd:
+			initZstd()
+			data = zstdEncoder.EncodeAll(v, make([]byte, 0, len(v)))
+		default:
+			return nil, nil, fmt.Errorf("unsupported %v", codec)
+		}
+		if len(data) >= len(v) {
+			continue
+		}
+		if flags == nil {
+			dataArray = append([][]byte(nil), vArray...)
+			flags = make([]uint16, len(vArray))
+		}
+		dataArray[i] = data
+		flags[i] = uint16(codec)
+	}
+	if flags == nil {
+		return vArray, nil, nil
+	}
+	return dataArray, flags, nil
+}
+
+// decodeValue returns the value of the record data. sharedFlag is true if v
+// is data itself, otherwise v is newly allocated.
+func decodeValue(flags uint16, data []byte, idx uint64) (v []byte, sharedFlag bool, e error) {
+	if flags&^recordFlagsCodecMask != 0 {
+		return nil, false, corruptionf(ErrCorruptDirectory, "record of idx %d has unknown flags: %#x", idx, flags)
+	}
+	var err error
+	switch codec := Codec(flags & recordFlagsCodecMask); codec {
+	case CodecNone:
+		return data, true, nil
+	case CodecSnappy:
+		v, err = snappy.Decode(nil, data)
+	case CodecZstd:
+		initZstd()
+		v, err = zstdDecoder.DecodeAll(data, nil)
+	default:
+		return nil, false, corruptionf(ErrCorruptDirectory, "record of idx %d has unknown %v", idx, codec)
+	}
+	if err != nil {
+		return nil, false, corruptionf(ErrCorruptDirectory, "record of idx %d could not be decoded: %v", idx, err)
+	}
+	return v, false, nil
+}
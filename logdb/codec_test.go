@@ -0,0 +1,103 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Every value comes back whatever codec it is stored with, the ones shorter
+// than the CompressionMinSize or not shrinking are stored as is.
+func TestCompressionRoundTrip(t *testing.T) {
+	values := [][]byte{
+		[]byte("short"),
+		bytes.Repeat([]byte("compressible "), 100),
+		[]byte(strings.Repeat("x", DefaultCompressionMinSize-1)),
+		testValue(4),
+	}
+	expectCodecs := func(codec Codec) []Codec {
+		return []Codec{CodecNone, codec, CodecNone, CodecNone}
+	}
+	for _, codec := range []Codec{CodecSnappy, CodecZstd} {
+		t.Run(codec.String(), func(t *testing.T) {
+			dirPath := filepath.Join(t.TempDir(), "db")
+			opts := NewOptions(WithCompression(codec, 0))
+			db, err := CreateDBWithOptions(dirPath, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = db.AppendAndSync(1, values)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = db.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			in, err := OpenInspector(dirPath, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, expect := range expectCodecs(codec) {
+				r, err := in.ReadRecord(uint64(i + 1))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if r.Codec != expect || !bytes.Equal(r.Value, values[i]) {
+					t.Fatalf("idx %d got codec %v and %q", i+1, r.Codec, r.Value)
+				}
+			}
+			in.Close()
+
+			// read back without the compression too
+			for _, opts := range []*Options{opts, nil} {
+				db, err = OpenDBIfExistWithOptions(dirPath, opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for i, v := range values {
+					got, err := db.GetValueByIdx(uint64(i + 1))
+					if err != nil || !bytes.Equal(got, v) {
+						t.Fatalf("idx %d got %q %v", i+1, got, err)
+					}
+				}
+				db.Close()
+			}
+		})
+	}
+}
+
+func TestUnsupportedCompression(t *testing.T) {
+	dirPath := filepath.Join(t.TempDir(), "db")
+	opts := NewOptions(WithCompression(Codec(3), 0))
+	if _, err := CreateDBWithOptions(dirPath, opts); err == nil {
+		t.Fatal("expect an error of the unsupported codec")
+	}
+	db, err := CreateDB(dirPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if _, err = OpenDBIfExistWithOptions(dirPath, opts); err == nil {
+		t.Fatal("expect an error of the unsupported codec")
+	}
+	if _, _, err = encodeValues([][]byte{bytes.Repeat([]byte("v"), 100)}, Codec(3), 0); err == nil {
+		t.Fatal("expect an error of the unsupported codec")
+	}
+}
@@ -0,0 +1,304 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/turingcell/veela/util"
+)
+
+// Compactor is implemented by the DB of the file backend and SharedLog.
+//
+// Only the head segment could hold deleted records, the other segments are
+// unlinked once they are wholly deleted. With a large SegmentSize, e.g. a
+// single-file logdb, the head segment is also the active one and its deleted
+// space is never reused without Compact.
+type Compactor interface {
+	// Return the bytes of the deleted records and their directory entries in
+	// the head segment, which would be reclaimed by Compact.
+	DeadBytes() uint64
+	// Copy the live records of the head segment into a new segment file and
+	// switch to it, the old file is unlinked once its readers are gone.
+	// The appends go on while copying and are only blocked by the last short
+	// catch-up, reads are never blocked. It returns nil without doing
+	// anything if there is no deleted record in the head segment.
+	Compact() error
+}
+
+const (
+	// the catch-up rounds of Compact before blocking the appends
+	compactMaxRounds = 8
+	// Compact blocks the appends once the records left to copy are less
+	// than it
+	compactSwitchoverBytes = 1 << 20
+	// the name of the segment being built by Compact is
+	// segmentFileName + compactFileSuffix + tmpFileSuffix
+	compactFileSuffix = ".compact"
+)
+
+func (db *fileDB) DeadBytes() uint64 {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	s := db.segments[0]
+	leftIdx, _ := db.currentIdxRange()
+	if leftIdx <= s.firstIdx {
+		return 0
+	}
+	dataPos := s.meta.dataNextPos
+	if leftIdx < s.toAppendIdx() {
+		dataPos = s.directory[leftIdx-s.firstIdx].pos
+	} else {
+		leftIdx = s.toAppendIdx()
+	}
+	return uint64(dataPos-dataAreaPos) + (leftIdx-s.firstIdx)*directoryEntryLen
+}
+
+// The new segment is named after the leftIdx when Compact begins, it
+// overlaps the head segment it replaces. The rename of the new segment is
+// the commit point, if the head segment is not removed after that, the next
+// openSegments finds the overlap and drops it.
+func (db *fileDB) Compact() error {
+	if db.opts.ReadOnly {
+		return fmt.Errorf("logdb is opened read only")
+	}
+	db.compactMux.Lock()
+	defer db.compactMux.Unlock()
+
+	db.mux.RLock()
+	if db.closedFlag {
+		db.mux.RUnlock()
+		return fmt.Errorf("logdb is already closed")
+	}
+	s := db.segments[0]
+	leftIdx, _ := db.currentIdxRange()
+	headFlag := len(db.segments) == 1
+	truncatedCt := db.truncatedCt
+	deletedIdx := db.deletedIdx
+	if leftIdx <= s.firstIdx || (leftIdx >= s.toAppendIdx() && !headFlag) {
+		// nothing is deleted, or s would be unlinked as a whole
+		db.mux.RUnlock()
+		return nil
+	}
+	// Keep s open while copying without holding any lock.
+	s.readers.Add(1)
+	db.mux.RUnlock()
+
+	newS, copiedIdx, err := db.buildCompactedSegment(s, leftIdx, deletedIdx, truncatedCt)
+	s.readers.Done()
+	if err != nil {
+		if newS != nil {
+			newS.f.Close()
+			os.Remove(newS.path + compactFileSuffix + tmpFileSuffix)
+		}
+		return err
+	}
+	return db.switchToCompactedSegment(s, newS, copiedIdx, truncatedCt)
+}
+
+// buildCompactedSegment copies the records of s from leftIdx into a new
+// temporary segment round by round until the left ones are few enough.
+func (db *fileDB) buildCompactedSegment(s *segment, leftIdx uint64, deletedIdx uint64, truncatedCt uint64) (newS *segment, copiedIdx uint64, e error) {
+	path := filepath.Join(db.dirPath, segmentFileName(leftIdx))
+	f, err := os.OpenFile(path+compactFileSuffix+tmpFileSuffix, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+	newS = &segment{
+		path:     path,
+		f:        f,
+		firstIdx: leftIdx,
+		enc:      db.enc,
+		meta: fileMeta{
+			dataNextPos:      dataAreaPos,
+			directoryNextPos: directoryAreaPos,
+			deletedIdx:       deletedIdx,
+		},
+		stats: db.stats,
+	}
+	if db.enc != nil {
+		newS.fileFlags = fileFlagEncrypted
+	}
+	err = newS.initFile()
+	if err != nil {
+		return newS, 0, err
+	}
+	copiedIdx = leftIdx
+	for round := 0; round < compactMaxRounds; round++ {
+		db.mux.RLock()
+		if db.truncatedCt != truncatedCt {
+			db.mux.RUnlock()
+			return newS, 0, fmt.Errorf("compaction is interrupted by TruncateFrom")
+		}
+		// The entries are never modified in place, TruncateFrom replaces the
+		// whole array.
+		entries := s.directory[copiedIdx-s.firstIdx:]
+		db.mux.RUnlock()
+		if len(entries) == 0 || entriesSpan(entries) < compactSwitchoverBytes {
+			break
+		}
+		err = newS.appendRawRecords(s, entries)
+		if err != nil {
+			return newS, 0, err
+		}
+		copiedIdx += uint64(len(entries))
+	}
+	return newS, copiedIdx, nil
+}
+
+// switchToCompactedSegment copies the rest of s with the appends blocked,
+// then commits newS and replaces s with it.
+func (db *fileDB) switchToCompactedSegment(s *segment, newS *segment, copiedIdx uint64, truncatedCt uint64) error {
+	tmpPath := newS.path + compactFileSuffix + tmpFileSuffix
+	abort := func(err error) error {
+		newS.close()
+		os.Remove(tmpPath)
+		return err
+	}
+	db.writeMux.Lock()
+	defer db.writeMux.Unlock()
+	if db.brokenErr != nil {
+		return abort(fmt.Errorf("logdb is broken by a previous error: %v", db.brokenErr))
+	}
+	// No one else modifies s.directory and db.segments while holding
+	// writeMux, and s could not be closed unless it is replaced.
+	db.mux.RLock()
+	closedFlag := db.closedFlag
+	replacedFlag := db.segments[0] != s
+	truncatedFlag := db.truncatedCt != truncatedCt
+	entries := s.directory[copiedIdx-s.firstIdx:]
+	activeFlag := len(db.segments) == 1
+	deletedIdx := db.deletedIdx
+	db.mux.RUnlock()
+	if closedFlag {
+		return abort(fmt.Errorf("logdb is already closed"))
+	}
+	if truncatedFlag {
+		return abort(fmt.Errorf("compaction is interrupted by TruncateFrom"))
+	}
+	if replacedFlag || (newS.firstIdx >= s.toAppendIdx() && !activeFlag) {
+		// s is unlinked as a whole meanwhile
+		return abort(nil)
+	}
+	err := newS.appendRawRecords(s, entries)
+	if err != nil {
+		return abort(err)
+	}
+	newS.meta.deletedIdx = deletedIdx
+	err = newS.writeMeta(newS.meta)
+	if err == nil {
+		err = newS.sync()
+	}
+	path := newS.path
+	if err == nil {
+		// the file is opened again by its path for Options.DirectIO
+		newS.path = tmpPath
+		err = db.setupSegments([]*segment{newS})
+		newS.path = path
+	}
+	if err != nil {
+		return abort(err)
+	}
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return abort(err)
+	}
+	// committed once the rename is durable, the head segment is dropped by
+	// the next open even if it is not removed below
+	err = syncDir(db.dirPath, db.stats)
+	if err != nil {
+		newS.close()
+		db.setBroken(err)
+		return err
+	}
+
+	db.mux.Lock()
+	segments := append([]*segment(nil), db.segments...)
+	segments[0] = newS
+	db.segments = segments
+	db.mux.Unlock()
+	stalePath := s.path + staleFileSuffix + tmpFileSuffix
+	err = os.Rename(s.path, stalePath)
+	if err == nil {
+		s.path = stalePath
+		err = syncDir(db.dirPath, db.stats)
+	}
+	db.reclaimCh <- []*segment{s}
+	if err != nil {
+		db.setBroken(err)
+		return err
+	}
+	db.opts.Logger.Infof("logdb %s: compacted the head segment of idx [%d, %d) into %s",
+		db.dirPath, s.firstIdx, newS.firstIdx, newS.path)
+	return nil
+}
+
+// entriesSpan is the bytes of the data area covered by the continuous
+// entries.
+func entriesSpan(entries []directoryEntry) uint64 {
+	last := entries[len(entries)-1]
+	return uint64(last.pos) + uint64(last.length) - uint64(entries[0].pos)
+}
+
+// appendRawRecords copies the records of entries from src to the end of s
+// without decoding them, and commits them in memory but not by the Meta in
+// the file. s should not be visible to the others yet.
+func (s *segment) appendRawRecords(src *segment, entries []directoryEntry) error {
+	for len(entries) > 0 {
+		n := 1
+		for n < len(entries) && entriesSpan(entries[:n+1]) <= readAheadBytes {
+			n++
+		}
+		beginPos := uint64(entries[0].pos)
+		var bs []byte
+		if src.mapped != nil {
+			bs = src.mapped[beginPos : beginPos+entriesSpan(entries[:n])]
+		} else {
+			bs = make([]byte, entriesSpan(entries[:n]))
+			_, err := src.f.ReadAt(bs, int64(beginPos))
+			if err != nil {
+				return err
+			}
+		}
+		// the records may not be contiguous after a TruncateFrom
+		var dataBs []byte
+		dirBs := make([]byte, n*directoryEntryLen)
+		newEntries := make([]directoryEntry, n)
+		pos := s.meta.dataNextPos
+		for i, entry := range entries[:n] {
+			off := uint64(entry.pos) - beginPos
+			dataBs = append(dataBs, bs[off:off+uint64(entry.length)]...)
+			newEntries[i] = directoryEntry{idx: entry.idx, pos: pos, length: entry.length}
+			newEntries[i].encodeTo(dirBs[i*directoryEntryLen:])
+			pos += entry.length
+		}
+		written, err := s.writeAt(dataBs, int64(s.meta.dataNextPos))
+		if err == nil {
+			s.stats.addData(written)
+			written, err = s.writeAt(dirBs, int64(s.meta.directoryNextPos))
+		}
+		if err != nil {
+			return err
+		}
+		s.stats.addDirectory(written)
+		s.meta.dataNextPos = pos
+		s.meta.directoryNextPos += util.IntToUint32Assert(len(dirBs))
+		s.directory = append(s.directory, newEntries...)
+		entries = entries[n:]
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"sync"
+
+	"github.com/turingcell/veela/util"
+)
+
+// KeyProvider supplies the 32-byte keys of the AES-256-GCM encryption.
+//
+// Every sealed record and Meta carries the id of its key, so the keys could
+// be rotated at any time by returning another id from CurrentKey. An old key
+// should still be returned by Key until all the idx appended with it are
+// deleted and their segments are reclaimed, see Stats.ReclaimedBytes.
+// The nonces are random, thus a key should be rotated long before it has
+// encrypted 2^32 records.
+type KeyProvider interface {
+	// Return the key to encrypt the new records and Metas.
+	CurrentKey() (keyID uint32, key []byte, e error)
+	// Return the key of keyID, which was returned by CurrentKey before.
+	Key(keyID uint32) (key []byte, e error)
+}
+
+// KeyID(4) Nonce(12) Ciphertext Tag(16)
+const (
+	sealKeyIDLen = 4
+	sealNonceLen = 12
+	sealOverhead = sealKeyIDLen + sealNonceLen + 16
+)
+
+// encryptor seals and opens with the keys of a KeyProvider, a nil
+// *encryptor means no encryption.
+type encryptor struct {
+	keys KeyProvider
+
+	mux   sync.Mutex
+	aeads map[uint32]cipher.AEAD
+}
+
+func newEncryptor(keys KeyProvider) *encryptor {
+	if keys == nil {
+		return nil
+	}
+	return &encryptor{
+		keys:  keys,
+		aeads: make(map[uint32]cipher.AEAD),
+	}
+}
+
+// aead returns the cached AEAD of keyID, key is fetched from the KeyProvider
+// if it is nil.
+func (c *encryptor) aead(keyID uint32, key []byte) (cipher.AEAD, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if a, ok := c.aeads[keyID]; ok {
+		return a, nil
+	}
+	if key == nil {
+		var err error
+		key, err = c.keys.Key(keyID)
+		if err != nil {
+			return nil, fmt.Errorf("%w: key %d: %v", ErrDecrypt, keyID, err)
+		}
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key %d should have 32 bytes but got %d", keyID, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	a, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	c.aeads[keyID] = a
+	return a, nil
+}
+
+// current returns the AEAD of the current key, it is looked up for every
+// batch so that a rotation takes effect at once.
+func (c *encryptor) current() (uint32, cipher.AEAD, error) {
+	keyID, key, err := c.keys.CurrentKey()
+	if err != nil {
+		return 0, nil, err
+	}
+	a, err := c.aead(keyID, key)
+	return keyID, a, err
+}
+
+// sealWith appends the sealed plaintext to dst.
+func sealWith(dst []byte, keyID uint32, a cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	var prefix [sealKeyIDLen + sealNonceLen]byte
+	util.U32SetBs(prefix[:], keyID)
+	_, err := rand.Read(prefix[sealKeyIDLen:])
+	if err != nil {
+		return nil, err
+	}
+	dst = append(dst, prefix[:]...)
+	return a.Seal(dst, prefix[sealKeyIDLen:], plaintext, additionalData), nil
+}
+
+func (c *encryptor) seal(plaintext, additionalData []byte) ([]byte, error) {
+	keyID, a, err := c.current()
+	if err != nil {
+		return nil, err
+	}
+	return sealWith(make([]byte, 0, sealOverhead+len(plaintext)), keyID, a, plaintext, additionalData)
+}
+
+// open returns the newly allocated plaintext, or an error wrapping ErrDecrypt.
+func (c *encryptor) open(sealed, additionalData []byte) ([]byte, error) {
+	if len(sealed) < sealOverhead {
+		return nil, fmt.Errorf("%w: sealed data is too short: %d", ErrDecrypt, len(sealed))
+	}
+	keyID := util.BsReadU32(sealed)
+	a, err := c.aead(keyID, nil)
+	if err != nil {
+		return nil, err
+	}
+	nonce := sealed[sealKeyIDLen : sealKeyIDLen+sealNonceLen]
+	plaintext, err := a.Open(nil, nonce, sealed[sealKeyIDLen+sealNonceLen:], additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("%w: key %d: %v", ErrDecrypt, keyID, err)
+	}
+	return plaintext, nil
+}
+
+// sealRecords encrypts the data of the records to be appended at appendAtIdx,
+// the returned flags always have recordFlagEncrypted.
+func (c *encryptor) sealRecords(appendAtIdx uint64, dataArray [][]byte, flags []uint16) ([][]byte, []uint16, error) {
+	keyID, a, err := c.current()
+	if err != nil {
+		return nil, nil, err
+	}
+	sealedArray := make([][]byte, len(dataArray))
+	sealedFlags := make([]uint16, len(dataArray))
+	for i, data := range dataArray {
+		if flags != nil {
+			sealedFlags[i] = flags[i]
+		}
+		sealedFlags[i] |= recordFlagEncrypted
+		sealedArray[i], err = sealWith(make([]byte, 0, sealOverhead+len(data)), keyID, a, data,
+			recordAdditionalData(sealedFlags[i], appendAtIdx+uint64(i)))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return sealedArray, sealedFlags, nil
+}
+
+// The additional data of a sealed record is its Flags and Idx, so a record
+// could not be moved to another idx without being detected.
+func recordAdditionalData(flags uint16, idx uint64) []byte {
+	bs := make([]byte, 2+8)
+	util.U16SetBs(bs, flags)
+	util.U64SetBs(bs[2:], idx)
+	return bs
+}
+
+// The Meta seals nothing but authenticates the FirstIdx of its segment and
+// its fields as the additional data.
+func metaAdditionalData(firstIdx uint64, fields []byte) []byte {
+	bs := make([]byte, 8, 8+len(fields))
+	util.U64SetBs(bs, firstIdx)
+	return append(bs, fields...)
+}
@@ -0,0 +1,128 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"io"
+	"os"
+	"unsafe"
+)
+
+// the offset, length and memory address of an O_DIRECT write are aligned to it
+const directIOAlign = 4096
+
+// directWriter writes a segment file with O_DIRECT. Every write is widened to
+// the aligned blocks it touches, the bytes around it in the first and the
+// last blocks are filled from the blocks it wrote before, or read from the
+// buffered file. Thus the bytes beyond the end of a write are kept, which
+// matters for the uncommitted directory entries, see cutUncommittedTail.
+//
+// It is only used by the writer of the segment.
+type directWriter struct {
+	f *os.File
+	// the buffered file of the segment
+	src *os.File
+	buf []byte
+	// the last partial blocks written, by their offsets
+	blocks map[int64][]byte
+}
+
+func newDirectWriter(path string, src *os.File) (*directWriter, error) {
+	f, err := openDirectFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &directWriter{
+		f:      f,
+		src:    src,
+		blocks: make(map[int64][]byte),
+	}, nil
+}
+
+// alignedBuf returns a buffer of n bytes at an aligned address.
+func (w *directWriter) alignedBuf(n int) []byte {
+	if cap(w.buf) < n {
+		bs := make([]byte, n+directIOAlign)
+		off := 0
+		if rem := int(uintptr(unsafe.Pointer(&bs[0])) & (directIOAlign - 1)); rem != 0 {
+			off = directIOAlign - rem
+		}
+		w.buf = bs[off : off+n : off+n]
+	}
+	return w.buf[:n]
+}
+
+// readBlock fills dst with the block at off, the bytes beyond the end of
+// file are zero.
+func (w *directWriter) readBlock(dst []byte, off int64) error {
+	if bs, ok := w.blocks[off]; ok {
+		copy(dst, bs)
+		return nil
+	}
+	n, err := w.src.ReadAt(dst, off)
+	if err == io.EOF {
+		err = nil
+	}
+	for i := n; i < len(dst); i++ {
+		dst[i] = 0
+	}
+	return err
+}
+
+// writeAt returns the bytes of the aligned blocks written.
+func (w *directWriter) writeAt(bs []byte, pos int64) (int, error) {
+	start := pos &^ (directIOAlign - 1)
+	end := pos + int64(len(bs))
+	alignedEnd := (end + directIOAlign - 1) &^ (directIOAlign - 1)
+	buf := w.alignedBuf(int(alignedEnd - start))
+	lastOff := alignedEnd - directIOAlign
+	if pos > start {
+		err := w.readBlock(buf[:directIOAlign], start)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if end < alignedEnd && (lastOff > start || pos == start) {
+		err := w.readBlock(buf[lastOff-start:], lastOff)
+		if err != nil {
+			return 0, err
+		}
+	}
+	copy(buf[pos-start:], bs)
+	_, err := w.f.WriteAt(buf, start)
+	if err != nil {
+		// the content of the blocks is unknown now
+		w.blocks = make(map[int64][]byte)
+		return 0, err
+	}
+	for off := range w.blocks {
+		if off >= start && off < alignedEnd {
+			delete(w.blocks, off)
+		}
+	}
+	if end < alignedEnd {
+		// the data, the directory and the Meta each has one partial block
+		// at most in use
+		if len(w.blocks) >= 4 {
+			w.blocks = make(map[int64][]byte)
+		}
+		w.blocks[lastOff] = append([]byte(nil), buf[lastOff-start:]...)
+	}
+	return len(buf), nil
+}
+
+func (w *directWriter) close() error {
+	return w.f.Close()
+}
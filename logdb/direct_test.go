@@ -0,0 +1,63 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestDirectIO(t *testing.T) {
+	dirPath := filepath.Join(t.TempDir(), "db")
+	db, err := CreateDBWithOptions(dirPath, NewOptions(WithDirectIO()))
+	if err != nil {
+		t.Skipf("DirectIO is not supported here: %v", err)
+	}
+	// a torn block write of the Meta never tears the FileHeader
+	if metaPos/directIOAlign == headerPos/directIOAlign {
+		t.Fatal("the Meta shares the block with the FileHeader")
+	}
+	before := db.Stats()
+	if err := appendTestValues(db, 1, 3, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := appendTestValues(db, 3, 4, 2); err != nil {
+		t.Fatal(err)
+	}
+	stats := db.Stats()
+	// one block for each of the data, the directory and the Meta per append
+	for _, c := range []struct {
+		name          string
+		before, after uint64
+	}{
+		{"DataBytes", before.DataBytes, stats.DataBytes},
+		{"DirectoryBytes", before.DirectoryBytes, stats.DirectoryBytes},
+		{"MetaBytes", before.MetaBytes, stats.MetaBytes},
+	} {
+		if c.after-c.before != 2*directIOAlign {
+			t.Fatalf("%s grows from %d to %d", c.name, c.before, c.after)
+		}
+	}
+	checkMemDB(t, db, 2, 4)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenDBIfExist(dirPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkMemDB(t, db, 2, 4)
+}
@@ -0,0 +1,42 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The errors returned by OpenDBIfExist when the logdb is invalid. They are
+// always wrapped with more details, use `errors.Is` to check them.
+var (
+	// bad FileMagic, FileVersion or FileHeader checksum
+	ErrBadFileHeader = errors.New("logdb: bad file header")
+	// Meta checksum mismatch or the positions inside Meta are out of bound
+	ErrCorruptMeta = errors.New("logdb: corrupt meta")
+	// the file ends before the directory area or the data area committed by Meta
+	ErrTruncatedDirectory = errors.New("logdb: truncated directory")
+	// a committed directory entry is not continuous or points outside of the data area
+	ErrCorruptDirectory = errors.New("logdb: corrupt directory")
+	// Returned by GetValueByIdx and Verify if the content of a record is corrupted.
+	ErrChecksumMismatch = errors.New("logdb: checksum mismatch")
+	// The checksum matches but the sealed Meta or record could not be opened,
+	// the key is unavailable or wrong, or Options.KeyProvider is not set.
+	ErrDecrypt = errors.New("logdb: decryption failed")
+)
+
+func corruptionf(kind error, format string, v ...interface{}) error {
+	return fmt.Errorf("%w: %s", kind, fmt.Sprintf(format, v...))
+}
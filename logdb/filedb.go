@@ -0,0 +1,736 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/turingcell/veela/util"
+)
+
+type fileDB struct {
+	// read only
+	dirPath string
+	opts    Options
+	stats   *statCounters
+	enc     *encryptor
+	cache   *valueCache
+
+	// only one Compact at the same time
+	compactMux sync.Mutex
+
+	// only one writer at the same time
+	writeMux sync.Mutex
+	// set if a write or sync failed, the on-disk state is unknown since then
+	brokenErr error
+
+	// protects all the members below and the meta and directory of segments
+	mux        sync.RWMutex
+	closedFlag bool
+	// all the idx in (0, deletedIdx] are marked deleted
+	deletedIdx uint64
+	// ascending by firstIdx and continuous, the last one is the active
+	// segment which accepts appends
+	segments []*segment
+	// count of the TruncateFrom calls which truncated something
+	truncatedCt uint64
+
+	// segments wholly deleted are sent here to be unlinked in background
+	reclaimCh   chan []*segment
+	reclaimDone chan struct{}
+
+	async asyncAppender
+}
+
+func createFileDB(dirPathStr string, opts *Options) (*fileDB, error) {
+	if opts != nil && opts.ReadOnly {
+		return nil, fmt.Errorf("could not create a logdb with Options.ReadOnly")
+	}
+	err := opts.check()
+	if err != nil {
+		return nil, err
+	}
+	err = os.Mkdir(dirPathStr, 0755)
+	if err != nil {
+		return nil, err
+	}
+	db := newFileDB(dirPathStr, opts)
+	s, err := createSegment(dirPathStr, 1, 0, db.stats, db.enc)
+	if err != nil {
+		return nil, err
+	}
+	db.segments = []*segment{s}
+	err = db.setupSegments(db.segments)
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	go db.reclaimLoop()
+	return db, nil
+}
+
+func newFileDB(dirPathStr string, opts *Options) *fileDB {
+	db := &fileDB{
+		dirPath:     dirPathStr,
+		opts:        opts.withDefaults(),
+		stats:       new(statCounters),
+		reclaimCh:   make(chan []*segment, 16),
+		reclaimDone: make(chan struct{}),
+	}
+	db.enc = newEncryptor(db.opts.KeyProvider)
+	db.cache = newValueCache(db.opts.CacheSize)
+	db.async = asyncAppender{
+		appendAndSync3:     db.appendAndSync3,
+		getCurrentIdxRange: db.GetCurrentIdxRange,
+		maxMergeBytes:      db.opts.SegmentSize,
+	}
+	return db
+}
+
+// openSegments opens and validates all the segments under dirPathStr.
+// A segment starting after the toAppendIdx of its previous one is left by an
+// interrupted TruncateFrom, it and all the segments after it are returned by
+// staleFirstIdxs without being opened. A segment overlapped by or after a gap
+// from the next one is left by an interrupted Compact if the next one records
+// all the idx before it as deleted, see compactedFlag, it and all the
+// segments before it are returned by staleFirstIdxs too.
+// See openSegment for keylessFlag.
+func openSegments(dirPathStr string, readOnlyFlag bool, keylessFlag bool, stats *statCounters, enc *encryptor) (segments []*segment, deletedIdx uint64, staleFirstIdxs []uint64, e error) {
+	firstIdxs, err := listSegments(dirPathStr)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if len(firstIdxs) == 0 {
+		return nil, 0, nil, fmt.Errorf("%w: there is no logdb segment under %s", os.ErrNotExist, dirPathStr)
+	}
+	closeAll := func() {
+		for _, s := range segments {
+			s.close()
+		}
+	}
+	for i, firstIdx := range firstIdxs {
+		if len(segments) > 0 && firstIdx > segments[len(segments)-1].toAppendIdx() {
+			// probed without modifying it, since it may be a stale one
+			s, err := openSegment(dirPathStr, firstIdx, true, true, nil, nil)
+			compacted := err == nil && compactedFlag(segments[len(segments)-1], s)
+			if err == nil {
+				s.close()
+			}
+			if !compacted {
+				staleFirstIdxs = append(staleFirstIdxs, firstIdxs[i:]...)
+				break
+			}
+		}
+		s, err := openSegment(dirPathStr, firstIdx, readOnlyFlag, keylessFlag, stats, enc)
+		if err != nil {
+			closeAll()
+			return nil, 0, nil, err
+		}
+		if len(segments) > 0 && compactedFlag(segments[len(segments)-1], s) {
+			// The segments before s are wholly deleted, the last one is
+			// replaced by s in Compact and the others are not unlinked yet.
+			for _, stale := range segments {
+				stale.close()
+				staleFirstIdxs = append(staleFirstIdxs, stale.firstIdx)
+			}
+			segments = segments[:0]
+		}
+		if len(segments) > 0 {
+			prev := segments[len(segments)-1]
+			if prev.toAppendIdx() != s.firstIdx {
+				s.close()
+				closeAll()
+				return nil, 0, nil, corruptionf(ErrCorruptDirectory, "segment %s should start from idx %d",
+					s.path, prev.toAppendIdx())
+			}
+		}
+		if s.meta.deletedIdx > deletedIdx {
+			deletedIdx = s.meta.deletedIdx
+		}
+		segments = append(segments, s)
+	}
+	if segments[0].firstIdx > deletedIdx+1 {
+		closeAll()
+		return nil, 0, nil, corruptionf(ErrCorruptDirectory, "segments of idx [%d, %d) are missing",
+			deletedIdx+1, segments[0].firstIdx)
+	}
+	return segments, deletedIdx, staleFirstIdxs, nil
+}
+
+// compactedFlag reports whether s is made by Compact from prev, which is
+// the head segment with all the idx before s deleted when Compact begins.
+// The Meta of s always records all the idx before it as deleted, while a
+// segment left by TruncateFrom never does since TruncateFrom could not go
+// below the deleted idx.
+func compactedFlag(prev *segment, s *segment) bool {
+	return s.firstIdx > prev.firstIdx && s.firstIdx != prev.toAppendIdx() &&
+		s.toAppendIdx() >= prev.toAppendIdx() && s.meta.deletedIdx+1 >= s.firstIdx
+}
+
+func openFileDB(dirPathStr string, opts *Options) (*fileDB, error) {
+	err := opts.check()
+	if err != nil {
+		return nil, err
+	}
+	db := newFileDB(dirPathStr, opts)
+	segments, deletedIdx, staleFirstIdxs, err := openSegments(dirPathStr, db.opts.ReadOnly, false, db.stats, db.enc)
+	if err != nil {
+		return nil, err
+	}
+	db.deletedIdx = deletedIdx
+	db.segments = segments
+	if db.opts.ReadOnly {
+		err = db.setupSegments(db.segments)
+		if err != nil {
+			for _, s := range db.segments {
+				s.close()
+			}
+			return nil, err
+		}
+		go db.reclaimLoop()
+		return db, nil
+	}
+	// Finish the unlinking interrupted by the last close or crash.
+	reclaimed := db.popReclaimableSegments()
+	for _, s := range reclaimed {
+		s.close()
+		err = os.Remove(s.path)
+		if err != nil {
+			break
+		}
+		db.stats.addReclaimed(s.footprint())
+	}
+	for i := 0; i < len(staleFirstIdxs) && err == nil; i++ {
+		err = os.Remove(filepath.Join(dirPathStr, segmentFileName(staleFirstIdxs[i])))
+	}
+	if err == nil {
+		err = removeTmpFiles(dirPathStr)
+	}
+	if err == nil && len(reclaimed)+len(staleFirstIdxs) > 0 {
+		db.opts.Logger.Infof("logdb %s: removed %d wholly deleted and %d stale segments left by the last run",
+			dirPathStr, len(reclaimed), len(staleFirstIdxs))
+		err = syncDir(dirPathStr, db.stats)
+	}
+	if err == nil {
+		err = db.setupSegments(db.segments)
+	}
+	if err != nil {
+		for _, s := range db.segments {
+			s.close()
+		}
+		return nil, err
+	}
+	go db.reclaimLoop()
+	return db, nil
+}
+
+// setupSegments applies the Options about the file I/O to the segments.
+func (db *fileDB) setupSegments(segments []*segment) error {
+	for _, s := range segments {
+		s.preallocateSize = db.opts.PreallocateSize
+		s.syncMode = db.opts.SyncMode
+		s.skipChecksumFlag = db.opts.SkipReadChecksum
+		s.metrics = db.opts.Metrics
+		if db.opts.MmapRead {
+			err := s.mmap()
+			if err != nil {
+				return err
+			}
+		}
+		if db.opts.DirectIO && !db.opts.ReadOnly {
+			var err error
+			s.direct, err = newDirectWriter(s.path, s.f)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func removeTmpFiles(dirPath string) error {
+	d, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if strings.HasSuffix(name, segmentFileSuffix+tmpFileSuffix) ||
+			strings.HasSuffix(name, segmentFileSuffix+staleFileSuffix+tmpFileSuffix) {
+			err = os.Remove(filepath.Join(dirPath, name))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// popReclaimableSegments removes the segments which only hold deleted idx
+// from db.segments, the active segment is always kept.
+// Caller should hold db.mux.
+func (db *fileDB) popReclaimableSegments() []*segment {
+	i := 0
+	for i < len(db.segments)-1 && db.segments[i].toAppendIdx() <= db.deletedIdx+1 {
+		i++
+	}
+	if i == 0 {
+		return nil
+	}
+	ret := append([]*segment(nil), db.segments[:i]...)
+	db.segments = append([]*segment(nil), db.segments[i:]...)
+	return ret
+}
+
+// Unlink the segments after the readers on them are gone. If the unlinking
+// is interrupted, they would be unlinked again by the next openFileDB.
+func (db *fileDB) reclaimLoop() {
+	defer close(db.reclaimDone)
+	for segments := range db.reclaimCh {
+		for _, s := range segments {
+			s.readers.Wait()
+			s.close()
+			err := os.Remove(s.path)
+			if err != nil {
+				db.opts.Logger.Warnf("logdb %s: failed to remove segment %s: %v", db.dirPath, s.path, err)
+				continue
+			}
+			db.stats.addReclaimed(s.footprint())
+			db.opts.Metrics.AddCounter(MetricSegmentRemoveCt, 1)
+			db.opts.Logger.Debugf("logdb %s: removed segment %s", db.dirPath, s.path)
+		}
+		syncDir(db.dirPath, db.stats)
+	}
+}
+
+// setBroken makes all the later writes fail, the caller should hold
+// db.writeMux.
+func (db *fileDB) setBroken(err error) {
+	db.brokenErr = err
+	db.opts.Logger.Errorf("logdb %s: broken by error: %v", db.dirPath, err)
+}
+
+// caller should hold db.mux
+func (db *fileDB) currentIdxRange() (leftIdx, toAppendIdx uint64) {
+	toAppendIdx = db.segments[len(db.segments)-1].toAppendIdx()
+	leftIdx = db.segments[0].firstIdx
+	if db.deletedIdx+1 > leftIdx {
+		leftIdx = db.deletedIdx + 1
+	}
+	if leftIdx > toAppendIdx {
+		leftIdx = toAppendIdx
+	}
+	return
+}
+
+// caller should hold db.mux and make sure idx is inside currentIdxRange
+func (db *fileDB) findSegment(idx uint64) *segment {
+	return db.segments[db.findSegmentIndex(idx)]
+}
+
+func (db *fileDB) findSegmentIndex(idx uint64) int {
+	i := sort.Search(len(db.segments), func(i int) bool {
+		return db.segments[i].firstIdx > idx
+	})
+	return i - 1
+}
+
+func (db *fileDB) GetCurrentIdxRange() (leftIdx, toAppendIdx uint64) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	return db.currentIdxRange()
+}
+
+// acquireEntry finds the directory entry of idx and registers a reader on
+// its segment, the caller should call s.readers.Done() after reading. gen is
+// the generation of the entry for valueCache.put.
+func (db *fileDB) acquireEntry(idx uint64) (s *segment, entry directoryEntry, gen uint64, e error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	if db.closedFlag {
+		return nil, directoryEntry{}, 0, fmt.Errorf("logdb is already closed")
+	}
+	leftIdx, toAppendIdx := db.currentIdxRange()
+	if idx < leftIdx || idx >= toAppendIdx {
+		return nil, directoryEntry{}, 0, fmt.Errorf("idx %d is out of range [%d, %d)", idx, leftIdx, toAppendIdx)
+	}
+	s = db.findSegment(idx)
+	s.readers.Add(1)
+	return s, s.directory[idx-s.firstIdx], db.truncatedCt, nil
+}
+
+func (db *fileDB) GetValueByIdx(idx uint64) (v []byte, e error) {
+	s, entry, gen, err := db.acquireEntry(idx)
+	if err != nil {
+		return nil, err
+	}
+	db.opts.Metrics.AddCounter(MetricReadCt, 1)
+	if v, ok := db.cache.get(idx); ok {
+		s.readers.Done()
+		db.opts.Metrics.AddCounter(MetricCacheHitCt, 1)
+		return v, nil
+	}
+	v, e = s.readRecord(entry)
+	s.readers.Done()
+	if e == nil {
+		db.cache.put(gen, idx, [][]byte{v})
+	}
+	return
+}
+
+func (db *fileDB) GetValueLeaseByIdx(idx uint64) (l *ValueLease, e error) {
+	s, entry, _, err := db.acquireEntry(idx)
+	if err != nil {
+		return nil, err
+	}
+	if s.mapped == nil {
+		v, err := s.readRecord(entry)
+		s.readers.Done()
+		if err != nil {
+			return nil, err
+		}
+		return newValueLease(v, nil), nil
+	}
+	v, sharedFlag, err := s.readRecordMapped(entry)
+	if err != nil || !sharedFlag {
+		s.readers.Done()
+		if err != nil {
+			return nil, err
+		}
+		return newValueLease(v, nil), nil
+	}
+	// The reader is kept until Release, thus the mapping stays valid.
+	return newValueLease(v, s.readers.Done), nil
+}
+
+// the max size of one sequential read of GetValuesByIdxRange
+const readAheadBytes = 1 << 20
+
+func (db *fileDB) GetValuesByIdxRange(leftIdx, rightIdx uint64) (vArray [][]byte, e error) {
+	type span struct {
+		s       *segment
+		entries []directoryEntry
+	}
+	var spans []span
+	db.mux.RLock()
+	if db.closedFlag {
+		db.mux.RUnlock()
+		return nil, fmt.Errorf("logdb is already closed")
+	}
+	curLeftIdx, curToAppendIdx := db.currentIdxRange()
+	if leftIdx > rightIdx || (leftIdx < rightIdx && (leftIdx < curLeftIdx || rightIdx > curToAppendIdx)) {
+		db.mux.RUnlock()
+		return nil, fmt.Errorf("idx range [%d, %d) is out of range [%d, %d)", leftIdx, rightIdx, curLeftIdx, curToAppendIdx)
+	}
+	for idx := leftIdx; idx < rightIdx; {
+		s := db.findSegment(idx)
+		end := s.toAppendIdx()
+		if end > rightIdx {
+			end = rightIdx
+		}
+		s.readers.Add(1)
+		spans = append(spans, span{s, s.directory[idx-s.firstIdx : end-s.firstIdx]})
+		idx = end
+	}
+	db.mux.RUnlock()
+
+	vArray = make([][]byte, 0, rightIdx-leftIdx)
+	for _, sp := range spans {
+		if e == nil {
+			var segVArray [][]byte
+			segVArray, e = sp.s.readRecords(sp.entries, readAheadBytes)
+			vArray = append(vArray, segVArray...)
+		}
+		sp.s.readers.Done()
+	}
+	if e != nil {
+		return nil, e
+	}
+	return vArray, nil
+}
+
+func (db *fileDB) NewIterator(fromIdx uint64, backwardFlag bool) (Iterator, error) {
+	return newRangeIterator(db, fromIdx, backwardFlag)
+}
+
+func (db *fileDB) AppendAndSync(appendAtIdx uint64, vArray [][]byte) (e error) {
+	return db.AppendAndSync3(appendAtIdx, vArray, 0)
+}
+
+func (db *fileDB) AppendAndSync3(appendAtIdx uint64, vArray [][]byte, deleteAllIdxLessThan uint64) (e error) {
+	if err := db.async.flush(); err != nil {
+		return err
+	}
+	return db.appendAndSync3(appendAtIdx, vArray, deleteAllIdxLessThan)
+}
+
+func (db *fileDB) AppendAsync(appendAtIdx uint64, vArray [][]byte) *AppendFuture {
+	return db.async.appendAsync(appendAtIdx, vArray)
+}
+
+func (db *fileDB) Flush() error {
+	return db.async.flush()
+}
+
+func (db *fileDB) appendAndSync3(appendAtIdx uint64, vArray [][]byte, deleteAllIdxLessThan uint64) (e error) {
+	if db.opts.ReadOnly {
+		return fmt.Errorf("logdb is opened read only")
+	}
+	start := time.Now()
+	db.writeMux.Lock()
+	defer db.writeMux.Unlock()
+	if db.brokenErr != nil {
+		return fmt.Errorf("logdb is broken by a previous error: %v", db.brokenErr)
+	}
+
+	db.mux.RLock()
+	closedFlag := db.closedFlag
+	deletedIdx := db.deletedIdx
+	s := db.segments[len(db.segments)-1]
+	meta := s.meta
+	_, toAppendIdx := db.currentIdxRange()
+	db.mux.RUnlock()
+	if closedFlag {
+		return fmt.Errorf("logdb is already closed")
+	}
+	if appendAtIdx != toAppendIdx {
+		return fmt.Errorf("appendAtIdx %d != toAppendIdx %d", appendAtIdx, toAppendIdx)
+	}
+	newToAppendIdx := toAppendIdx + uint64(len(vArray))
+	if deleteAllIdxLessThan > newToAppendIdx {
+		return fmt.Errorf("deleteAllIdxLessThan %d > toAppendIdx %d after this append", deleteAllIdxLessThan, newToAppendIdx)
+	}
+	newDeletedIdx := deletedIdx
+	if deleteAllIdxLessThan > 0 && deleteAllIdxLessThan-1 > deletedIdx {
+		newDeletedIdx = deleteAllIdxLessThan - 1
+	}
+	if len(vArray) == 0 && newDeletedIdx == deletedIdx {
+		return nil
+	}
+
+	dataArray, flags, err := encodeValues(vArray, db.opts.Compression, db.opts.CompressionMinSize)
+	if err != nil {
+		return err
+	}
+	if db.enc != nil && len(dataArray) > 0 {
+		dataArray, flags, err = db.enc.sealRecords(appendAtIdx, dataArray, flags)
+		if err != nil {
+			return err
+		}
+	}
+	if len(dataArray) > 0 && !s.canHold(meta, dataArray, db.opts.SegmentSize) {
+		if len(s.directory) == 0 {
+			return fmt.Errorf("logdb is full: the batch is too large to fit into one segment")
+		}
+		err := s.trimPreallocated(meta)
+		if err != nil {
+			return err
+		}
+		newS, err := createSegment(db.dirPath, toAppendIdx, deletedIdx, db.stats, db.enc)
+		if err != nil {
+			return err
+		}
+		err = db.setupSegments([]*segment{newS})
+		if err != nil {
+			newS.close()
+			os.Remove(newS.path)
+			return err
+		}
+		db.mux.Lock()
+		db.segments = append(db.segments, newS)
+		db.mux.Unlock()
+		db.opts.Metrics.AddCounter(MetricSegmentCreateCt, 1)
+		db.opts.Logger.Infof("logdb %s: rolled out segment %s", db.dirPath, newS.path)
+		s, meta = newS, newS.meta
+	}
+	err = db.appendToSegment(s, meta, appendAtIdx, dataArray, flags, newDeletedIdx)
+	if err != nil {
+		return err
+	}
+	// truncatedCt is only modified with writeMux held
+	db.cache.put(db.truncatedCt, appendAtIdx, vArray)
+	userBytes := valuesLen(vArray)
+	db.stats.addUser(userBytes)
+	db.opts.Metrics.AddCounter(MetricAppendCt, 1)
+	db.opts.Metrics.AddCounter(MetricAppendBytes, uint64(userBytes))
+	db.opts.Metrics.ObserveLatency(MetricAppendLatency, time.Since(start))
+	return nil
+}
+
+// caller should hold db.writeMux
+func (db *fileDB) appendToSegment(s *segment, meta fileMeta, appendAtIdx uint64, dataArray [][]byte, flags []uint16, newDeletedIdx uint64) error {
+	var entries []directoryEntry
+	newMeta := meta
+	var err error
+	if len(dataArray) > 0 {
+		// 1. data  2. directory
+		entries, newMeta, err = s.writeRecords(meta, appendAtIdx, dataArray, flags)
+		if err != nil {
+			db.setBroken(err)
+			return err
+		}
+	}
+	newMeta.deletedIdx = newDeletedIdx
+	// 3. fsync  4. meta  5. fsync
+	if db.opts.GroupCommitter != nil {
+		err = db.opts.GroupCommitter.commit(s, newMeta, len(dataArray) > 0)
+	} else {
+		err = commitSegment(s, newMeta, len(dataArray) > 0)
+	}
+	if err != nil {
+		db.setBroken(err)
+		return err
+	}
+
+	db.mux.Lock()
+	s.meta = newMeta
+	s.directory = append(s.directory, entries...)
+	db.deletedIdx = newDeletedIdx
+	reclaimed := db.popReclaimableSegments()
+	db.mux.Unlock()
+	if len(reclaimed) > 0 {
+		db.reclaimCh <- reclaimed
+	}
+	return nil
+}
+
+func (db *fileDB) TruncateFrom(idx uint64) error {
+	if db.opts.ReadOnly {
+		return fmt.Errorf("logdb is opened read only")
+	}
+	if err := db.async.flush(); err != nil {
+		return err
+	}
+	db.writeMux.Lock()
+	defer db.writeMux.Unlock()
+	if db.brokenErr != nil {
+		return fmt.Errorf("logdb is broken by a previous error: %v", db.brokenErr)
+	}
+
+	db.mux.RLock()
+	closedFlag := db.closedFlag
+	deletedIdx := db.deletedIdx
+	leftIdx, toAppendIdx := db.currentIdxRange()
+	k := -1
+	if idx >= leftIdx && idx < toAppendIdx {
+		k = db.findSegmentIndex(idx)
+	}
+	db.mux.RUnlock()
+	if closedFlag {
+		return fmt.Errorf("logdb is already closed")
+	}
+	if idx == toAppendIdx {
+		return nil
+	}
+	if k < 0 {
+		return fmt.Errorf("idx %d is out of range [%d, %d]", idx, leftIdx, toAppendIdx)
+	}
+
+	// Only the directory is rewound, DataNextPos is kept so that the truncated
+	// records are never overwritten while the in-flight readers may read them.
+	// Once the meta is committed, the segments after s become stale and would
+	// be dropped by the next openFileDB even if they are not removed here.
+	s := db.segments[k]
+	n := idx - s.firstIdx
+	newMeta := s.meta
+	newMeta.directoryNextPos = directoryAreaPos + util.IntToUint32Assert(int(n)*directoryEntryLen)
+	newMeta.deletedIdx = deletedIdx
+	var err error
+	if db.opts.GroupCommitter != nil {
+		err = db.opts.GroupCommitter.commit(s, newMeta, false)
+	} else {
+		err = commitSegment(s, newMeta, false)
+	}
+	if err != nil {
+		db.setBroken(err)
+		return err
+	}
+
+	db.mux.Lock()
+	s.meta = newMeta
+	// a new array, the old one may still be read by GetValuesByIdxRange
+	s.directory = append([]directoryEntry(nil), s.directory[:n]...)
+	db.truncatedCt++
+	db.cache.truncateFrom(db.truncatedCt, idx)
+	stale := append([]*segment(nil), db.segments[k+1:]...)
+	db.segments = append([]*segment(nil), db.segments[:k+1]...)
+	db.mux.Unlock()
+	if len(stale) == 0 {
+		return nil
+	}
+
+	// The stale files are renamed at once, since the next segment rolled
+	// out may get the same name with one of them.
+	for _, staleS := range stale {
+		stalePath := staleS.path + staleFileSuffix + tmpFileSuffix
+		err = os.Rename(staleS.path, stalePath)
+		if err != nil {
+			break
+		}
+		staleS.path = stalePath
+	}
+	if err == nil {
+		err = syncDir(db.dirPath, db.stats)
+	}
+	db.reclaimCh <- stale
+	if err != nil {
+		db.setBroken(err)
+		return err
+	}
+	return nil
+}
+
+func (db *fileDB) Stats() Stats {
+	return db.stats.snapshot()
+}
+
+func (db *fileDB) Close() error {
+	flushErr := db.async.flush()
+	db.writeMux.Lock()
+	defer db.writeMux.Unlock()
+	db.mux.Lock()
+	if db.closedFlag {
+		db.mux.Unlock()
+		return fmt.Errorf("logdb is already closed")
+	}
+	db.closedFlag = true
+	segments := db.segments
+	db.mux.Unlock()
+
+	close(db.reclaimCh)
+	<-db.reclaimDone
+	var firstErr error
+	for _, s := range segments {
+		s.readers.Wait()
+		err := s.close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr == nil {
+		firstErr = flushErr
+	}
+	return firstErr
+}
@@ -0,0 +1,55 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// fallocate allocates the blocks of [off, off+length) and extends the file
+// size if needed.
+func fallocate(f *os.File, off int64, length int64) error {
+	return syscall.Fallocate(int(f.Fd()), 0, off, length)
+}
+
+func fdatasync(f *os.File) error {
+	return syscall.Fdatasync(int(f.Fd()))
+}
+
+// fileSystemID returns the id of the file system holding f.
+func fileSystemID(f *os.File) (uint64, bool) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, false
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(st.Dev), true
+}
+
+// syncfs syncs all the files of the file system holding f. It reports the
+// writeback errors of them since Linux 5.8.
+func syncfs(f *os.File) error {
+	return unix.Syncfs(int(f.Fd()))
+}
+
+func openDirectFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|syscall.O_DIRECT, 0)
+}
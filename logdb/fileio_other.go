@@ -0,0 +1,52 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+// +build !linux
+
+package logdb
+
+import (
+	"fmt"
+	"os"
+)
+
+// fallocate only extends the file size, the blocks are not allocated.
+func fallocate(f *os.File, off int64, length int64) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() >= off+length {
+		return nil
+	}
+	return f.Truncate(off + length)
+}
+
+func fdatasync(f *os.File) error {
+	return f.Sync()
+}
+
+// fileSystemID is unknown, so the syncs are never shared.
+func fileSystemID(f *os.File) (uint64, bool) {
+	return 0, false
+}
+
+func syncfs(f *os.File) error {
+	return fmt.Errorf("syncfs is only supported on linux")
+}
+
+func openDirectFile(path string) (*os.File, error) {
+	return nil, fmt.Errorf("direct I/O is only supported on linux")
+}
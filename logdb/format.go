@@ -0,0 +1,212 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"hash/crc32"
+
+	"github.com/turingcell/veela/util"
+)
+
+// A logdb is a directory of segment files, each one is named after the first
+// idx it holds. Layout of one segment file (see doc/logdb-design-zh.md):
+//
+//	[0, 4096)          FileHeader at 0
+//	[4096, 8192)       Meta at metaPos
+//	[8192, dataPos)    Directory Area, fixed capacity of directoryAreaCap entries
+//	[dataPos, ...)     Data Area
+//
+// All integers are big endian.
+const (
+	segmentFileSuffix = ".seg"
+	tmpFileSuffix     = ".tmp"
+	// the name of a stale segment being removed is
+	// segmentFileName + staleFileSuffix + tmpFileSuffix
+	staleFileSuffix = ".stale"
+
+	fileMagic   = "vldb"
+	fileVersion = 1
+
+	// FileMagic(4) FileVersion(2) FirstIdx(8) FileFlags(2) Checksum(4)
+	headerPos = 0
+	headerLen = 4 + 2 + 8 + 2 + 4
+
+	// the Meta of the file is sealed
+	fileFlagEncrypted = 0x0001
+
+	// DataNextPos(4) DirectoryNextPos(4) DeletedIdx(8) Checksum(4)
+	// It is placed at the beginning of a 512-byte sector, so the 20 bytes
+	// could always be written into disk atomically. The sector is in a
+	// 4096-byte block of its own, so the block written by Options.DirectIO
+	// for the Meta never covers the FileHeader.
+	metaPos       = 4096
+	metaLen       = metaFieldsLen + 4
+	metaFieldsLen = 4 + 4 + 8
+	// With fileFlagEncrypted the Meta is DataNextPos(4) DirectoryNextPos(4)
+	// DeletedIdx(8) KeyID(4) Nonce(12) Tag(16) Checksum(4). The fields stay in
+	// plaintext like the directory entries, the Tag authenticates FirstIdx
+	// and them, and the checksum is the CRC32C of all the bytes before it, so
+	// Verify could walk the segment without the key. Still within the sector.
+	encryptedMetaLen = metaFieldsLen + sealOverhead + 4
+
+	// Idx(8) Pos(4) Length(4)
+	directoryEntryLen = 8 + 4 + 4
+	directoryAreaPos  = 8192
+	directoryAreaCap  = 1 << 20
+	dataAreaPos       = directoryAreaPos + directoryAreaCap*directoryEntryLen
+
+	// Flags(2) Idx(8) Checksum(4) Data
+	// The checksum is the CRC32C of Flags, Idx and Data. The low 4 bits of
+	// Flags are the Codec of Data, the other bits are reserved as zero except
+	// recordFlagEncrypted.
+	recordHeaderLen = 2 + 8 + 4
+	// Data is Sealed(KeyID Nonce Ciphertext Tag) of the compressed data, with
+	// Flags and Idx as the additional data. The checksum is still on Data, so
+	// the corruption is detected before the decryption.
+	recordFlagEncrypted = 0x0010
+
+	// Pos is uint32
+	maxFileSize = 1<<32 - 1
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+func checksum(bs []byte) uint32 {
+	return crc32.Checksum(bs, crc32cTable)
+}
+
+type fileMeta struct {
+	dataNextPos      uint32
+	directoryNextPos uint32
+	// all the idx in (0, deletedIdx] are marked deleted
+	deletedIdx uint64
+}
+
+type directoryEntry struct {
+	idx uint64
+	pos uint32
+	// length of the whole record including the record header
+	length uint32
+}
+
+func encodeHeader(firstIdx uint64, fileFlags uint16) []byte {
+	bs := make([]byte, headerLen)
+	copy(bs, fileMagic)
+	util.U16SetBs(bs[4:], fileVersion)
+	util.U64SetBs(bs[6:], firstIdx)
+	util.U16SetBs(bs[14:], fileFlags)
+	util.U32SetBs(bs[16:], checksum(bs[:16]))
+	return bs
+}
+
+func decodeHeader(bs []byte) (firstIdx uint64, fileFlags uint16, e error) {
+	util.AssertTrue(len(bs) == headerLen)
+	if string(bs[:4]) != fileMagic {
+		return 0, 0, corruptionf(ErrBadFileHeader, "bad file magic: %q", bs[:4])
+	}
+	if util.BsReadU32(bs[16:]) != checksum(bs[:16]) {
+		return 0, 0, corruptionf(ErrBadFileHeader, "%v", ErrChecksumMismatch)
+	}
+	if ver := util.BsReadU16(bs[4:]); ver != fileVersion {
+		return 0, 0, corruptionf(ErrBadFileHeader, "only support file version %d but got %d", fileVersion, ver)
+	}
+	fileFlags = util.BsReadU16(bs[14:])
+	if fileFlags&^fileFlagEncrypted != 0 {
+		return 0, 0, corruptionf(ErrBadFileHeader, "unknown FileFlags: %#x", fileFlags)
+	}
+	return util.BsReadU64(bs[6:]), fileFlags, nil
+}
+
+func (m *fileMeta) encodeFields() []byte {
+	bs := make([]byte, metaFieldsLen)
+	util.U32SetBs(bs, m.dataNextPos)
+	util.U32SetBs(bs[4:], m.directoryNextPos)
+	util.U64SetBs(bs[8:], m.deletedIdx)
+	return bs
+}
+
+func (m *fileMeta) encode() []byte {
+	return appendChecksum(m.encodeFields())
+}
+
+// appendChecksum appends the CRC32C of bs to bs.
+func appendChecksum(bs []byte) []byte {
+	var crc [4]byte
+	util.U32SetBs(crc[:], checksum(bs))
+	return append(bs, crc[:]...)
+}
+
+func (m *fileMeta) decode(bs []byte) error {
+	util.AssertTrue(len(bs) == metaLen)
+	if util.BsReadU32(bs[metaFieldsLen:]) != checksum(bs[:metaFieldsLen]) {
+		return corruptionf(ErrCorruptMeta, "%v", ErrChecksumMismatch)
+	}
+	return m.decodeFields(bs[:metaFieldsLen])
+}
+
+func (m *fileMeta) decodeFields(bs []byte) error {
+	util.AssertTrue(len(bs) == metaFieldsLen)
+	m.dataNextPos = util.BsReadU32(bs)
+	m.directoryNextPos = util.BsReadU32(bs[4:])
+	m.deletedIdx = util.BsReadU64(bs[8:])
+	if m.directoryNextPos < directoryAreaPos || m.directoryNextPos > dataAreaPos ||
+		(m.directoryNextPos-directoryAreaPos)%directoryEntryLen != 0 {
+		return corruptionf(ErrCorruptMeta, "invalid DirectoryNextPos: %d", m.directoryNextPos)
+	}
+	if m.dataNextPos < dataAreaPos {
+		return corruptionf(ErrCorruptMeta, "invalid DataNextPos: %d", m.dataNextPos)
+	}
+	return nil
+}
+
+func (e *directoryEntry) encodeTo(bs []byte) {
+	util.U64SetBs(bs, e.idx)
+	util.U32SetBs(bs[8:], e.pos)
+	util.U32SetBs(bs[12:], e.length)
+}
+
+func (e *directoryEntry) decode(bs []byte) {
+	e.idx = util.BsReadU64(bs)
+	e.pos = util.BsReadU32(bs[8:])
+	e.length = util.BsReadU32(bs[12:])
+}
+
+// encodeRecordTo writes the record of v into bs which should have exactly
+// recordHeaderLen+len(v) bytes.
+func encodeRecordTo(bs []byte, flags uint16, idx uint64, v []byte) {
+	util.AssertTrue(len(bs) == recordHeaderLen+len(v))
+	util.U16SetBs(bs, flags)
+	util.U64SetBs(bs[2:], idx)
+	copy(bs[recordHeaderLen:], v)
+	crc := crc32.Update(checksum(bs[:10]), crc32cTable, v)
+	util.U32SetBs(bs[10:], crc)
+}
+
+// decodeRecord returns the data inside the record, which shares the
+// underlying array with bs. The checksum is skipped if checksumFlag is false.
+func decodeRecord(bs []byte, idx uint64, checksumFlag bool) (flags uint16, v []byte, e error) {
+	if len(bs) < recordHeaderLen {
+		return 0, nil, corruptionf(ErrCorruptDirectory, "record of idx %d is too short: %d", idx, len(bs))
+	}
+	flags = util.BsReadU16(bs)
+	v = bs[recordHeaderLen:]
+	if checksumFlag && util.BsReadU32(bs[10:]) != crc32.Update(checksum(bs[:10]), crc32cTable, v) {
+		return 0, nil, corruptionf(ErrChecksumMismatch, "record of idx %d", idx)
+	}
+	if gotIdx := util.BsReadU64(bs[2:]); gotIdx != idx {
+		return 0, nil, corruptionf(ErrCorruptDirectory, "directory entry of idx %d points to the record of idx %d", idx, gotIdx)
+	}
+	return flags, v, nil
+}
@@ -0,0 +1,204 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// GroupCommitter joins the commits of concurrent AppendAndSync3 calls from
+// several logdb instances (set by Options.GroupCommitter) into sync rounds.
+//
+// One round takes all the commits pending at that moment and:
+//  1. syncs the data and directory of all of them
+//  2. writes the Meta of the ones whose data is synced
+//  3. syncs all the Metas
+//
+// then wakes every caller up with its own result. Commits arrived during a
+// round would be taken by the next round.
+//
+// The segments on the same file system share one syncfs(2) in each of the
+// syncs, which syncs the other files of the file system too, so the logdb
+// instances are better on a file system of their own. If the syncfs fails,
+// or it is not supported, each segment is synced by itself in parallel, so an
+// error is only reported to the commit it belongs to.
+//
+// The ordering inside one logdb is still guaranteed since a logdb never has
+// more than one commit in flight.
+type GroupCommitter struct {
+	mux        sync.Mutex
+	closedFlag bool
+	pending    []*groupCommitReq
+	kickCh     chan struct{}
+	loopDone   chan struct{}
+}
+
+type groupCommitReq struct {
+	s            *segment
+	meta         fileMeta
+	dataSyncFlag bool
+	errCh        chan error
+}
+
+func NewGroupCommitter() *GroupCommitter {
+	g := &GroupCommitter{
+		kickCh:   make(chan struct{}, 1),
+		loopDone: make(chan struct{}),
+	}
+	go g.loop()
+	return g
+}
+
+// Close should be called after all the logdb instances using it are closed.
+func (g *GroupCommitter) Close() error {
+	g.mux.Lock()
+	if g.closedFlag {
+		g.mux.Unlock()
+		return fmt.Errorf("group committer is already closed")
+	}
+	g.closedFlag = true
+	close(g.kickCh)
+	g.mux.Unlock()
+	<-g.loopDone
+	return nil
+}
+
+// commit syncs the data and directory already written into s if dataSyncFlag
+// is true, and then writes and syncs meta.
+func (g *GroupCommitter) commit(s *segment, meta fileMeta, dataSyncFlag bool) error {
+	req := &groupCommitReq{
+		s:            s,
+		meta:         meta,
+		dataSyncFlag: dataSyncFlag,
+		errCh:        make(chan error, 1),
+	}
+	g.mux.Lock()
+	if g.closedFlag {
+		g.mux.Unlock()
+		return fmt.Errorf("group committer is already closed")
+	}
+	g.pending = append(g.pending, req)
+	select {
+	case g.kickCh <- struct{}{}:
+	default:
+	}
+	g.mux.Unlock()
+	return <-req.errCh
+}
+
+func (g *GroupCommitter) loop() {
+	defer close(g.loopDone)
+	for range g.kickCh {
+		g.mux.Lock()
+		reqs := g.pending
+		g.pending = nil
+		g.mux.Unlock()
+		if len(reqs) > 0 {
+			runCommitRound(reqs)
+		}
+	}
+}
+
+func runCommitRound(reqs []*groupCommitReq) {
+	errs := make([]error, len(reqs))
+	syncRound(reqs, errs, func(req *groupCommitReq) bool { return req.dataSyncFlag })
+	for i, req := range reqs {
+		if errs[i] == nil {
+			errs[i] = req.s.writeMeta(req.meta)
+		}
+	}
+	syncRound(reqs, errs, func(req *groupCommitReq) bool { return true })
+	for i, req := range reqs {
+		req.errCh <- errs[i]
+	}
+}
+
+// syncRound syncs the segments of the reqs selected by needFn and not failed
+// yet, the errors are set into errs.
+func syncRound(reqs []*groupCommitReq, errs []error, needFn func(req *groupCommitReq) bool) {
+	var alone []int
+	shared := make(map[uint64][]int)
+	for i, req := range reqs {
+		if errs[i] != nil || !needFn(req) || req.s.syncMode == SyncNone {
+			continue
+		}
+		fsID, ok := fileSystemID(req.s.f)
+		if !ok {
+			alone = append(alone, i)
+			continue
+		}
+		shared[fsID] = append(shared[fsID], i)
+	}
+	for _, is := range shared {
+		if len(is) == 1 || !syncShared(reqs, is) {
+			alone = append(alone, is...)
+		}
+	}
+	forEachInParallel(len(alone), func(j int) {
+		errs[alone[j]] = reqs[alone[j]].s.syncData()
+	})
+}
+
+// syncShared syncs the segments of reqs[is] on the same file system by one
+// syncfs, it returns false if the syncfs fails.
+func syncShared(reqs []*groupCommitReq, is []int) bool {
+	start := time.Now()
+	err := syncfs(reqs[is[0]].s.f)
+	if err != nil {
+		return false
+	}
+	d := time.Since(start)
+	for _, i := range is {
+		reqs[i].s.stats.addSync()
+		reqs[i].s.metrics.ObserveLatency(MetricSyncLatency, d)
+	}
+	return true
+}
+
+func forEachInParallel(n int, fn func(i int)) {
+	if n == 0 {
+		return
+	}
+	if n == 1 {
+		fn(0)
+		return
+	}
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// commitSegment is the commit without a GroupCommitter.
+func commitSegment(s *segment, meta fileMeta, dataSyncFlag bool) error {
+	if dataSyncFlag {
+		err := s.syncData()
+		if err != nil {
+			return err
+		}
+	}
+	err := s.writeMeta(meta)
+	if err != nil {
+		return err
+	}
+	return s.syncData()
+}
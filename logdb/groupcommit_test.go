@@ -0,0 +1,106 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestGroupCommitConcurrentDBs(t *testing.T) {
+	const dbCt, appendCt = 4, 50
+	g := NewGroupCommitter()
+	dir := t.TempDir()
+	var dirPaths []string
+	var dbs []DB
+	for i := 0; i < dbCt; i++ {
+		dirPath := filepath.Join(dir, fmt.Sprintf("db%d", i))
+		db, err := CreateDB(dirPath, WithGroupCommitter(g))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dirPaths = append(dirPaths, dirPath)
+		dbs = append(dbs, db)
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, dbCt)
+	for i, db := range dbs {
+		wg.Add(1)
+		go func(i int, db DB) {
+			defer wg.Done()
+			for j := 1; j <= appendCt; j++ {
+				err := db.AppendAndSync(uint64(j), [][]byte{testValue(j)})
+				if err != nil {
+					errs[i] = err
+					return
+				}
+			}
+		}(i, db)
+	}
+	wg.Wait()
+	for i, db := range dbs {
+		if errs[i] != nil {
+			t.Fatalf("db%d: %v", i, errs[i])
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, dirPath := range dirPaths {
+		checkTestDB(t, dirPath, appendCt)
+	}
+}
+
+// A failed member of a round fails only its own commit.
+func TestGroupCommitMemberError(t *testing.T) {
+	const dbCt, badI = 3, 1
+	dir := t.TempDir()
+	var dbs []*fileDB
+	var reqs []*groupCommitReq
+	for i := 0; i < dbCt; i++ {
+		db, err := createFileDB(filepath.Join(dir, fmt.Sprintf("db%d", i)), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dbs = append(dbs, db)
+		s := db.segments[len(db.segments)-1]
+		reqs = append(reqs, &groupCommitReq{
+			s:            s,
+			meta:         s.meta,
+			dataSyncFlag: true,
+			errCh:        make(chan error, 1),
+		})
+	}
+	reqs[badI].s.f.Close()
+	runCommitRound(reqs)
+	for i, req := range reqs {
+		err := <-req.errCh
+		if (i == badI) != (err != nil) {
+			t.Fatalf("member %d got %v", i, err)
+		}
+	}
+	for i, db := range dbs {
+		if i != badI {
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"fmt"
+)
+
+type SegmentInfo struct {
+	Path          string
+	FirstIdx      uint64
+	ToAppendIdx   uint64
+	DeletedIdx    uint64
+	EncryptedFlag bool
+	FileSize      int64
+	// bytes of the used directory area and data area
+	DirectoryBytes uint64
+	DataBytes      uint64
+}
+
+type InspectResult struct {
+	LeftIdx     uint64
+	ToAppendIdx uint64
+	DeletedIdx  uint64
+	// ascending by FirstIdx
+	Segments []SegmentInfo
+	// count of the segments left by an interrupted TruncateFrom or Compact,
+	// they are ignored and would be removed by the next open
+	StaleSegmentCt int
+}
+
+type RecordInfo struct {
+	Idx uint64
+	// position and length of the whole record in its segment file
+	Pos    uint32
+	Length uint32
+	// Flags of the record header
+	Flags         uint16
+	Codec         Codec
+	EncryptedFlag bool
+	// the value decrypted and decompressed
+	Value []byte
+}
+
+// Inspector reads a logdb of the file backend offline and never modifies
+// it, the logdb should not be opened by others at the same time. Unlike
+// OpenDBIfExist, the uncommitted tail left by a crash is ignored but kept.
+type Inspector struct {
+	db     *fileDB
+	result InspectResult
+}
+
+// The KeyProvider of opts is needed to authenticate the Metas and read the
+// values of an encrypted logdb. Without it the encrypted Metas are used as
+// long as their checksums match, and ReadRecord of an encrypted record fails
+// with ErrDecrypt after its checksum is verified. The other members of opts
+// are ignored.
+func OpenInspector(dirPathStr string, opts *Options) (*Inspector, error) {
+	var enc *encryptor
+	if opts != nil {
+		enc = newEncryptor(opts.KeyProvider)
+	}
+	segments, deletedIdx, staleFirstIdxs, err := openSegments(dirPathStr, true, true, nil, enc)
+	if err != nil {
+		return nil, err
+	}
+	in := &Inspector{
+		db: &fileDB{
+			dirPath:    dirPathStr,
+			deletedIdx: deletedIdx,
+			segments:   segments,
+			enc:        enc,
+		},
+	}
+	r := &in.result
+	r.LeftIdx, r.ToAppendIdx = in.db.currentIdxRange()
+	r.DeletedIdx = deletedIdx
+	r.StaleSegmentCt = len(staleFirstIdxs)
+	for _, s := range segments {
+		fi, err := s.f.Stat()
+		if err != nil {
+			in.Close()
+			return nil, err
+		}
+		r.Segments = append(r.Segments, SegmentInfo{
+			Path:           s.path,
+			FirstIdx:       s.firstIdx,
+			ToAppendIdx:    s.toAppendIdx(),
+			DeletedIdx:     s.meta.deletedIdx,
+			EncryptedFlag:  s.fileFlags&fileFlagEncrypted != 0,
+			FileSize:       fi.Size(),
+			DirectoryBytes: uint64(s.meta.directoryNextPos - directoryAreaPos),
+			DataBytes:      uint64(s.meta.dataNextPos - dataAreaPos),
+		})
+	}
+	return in, nil
+}
+
+func (in *Inspector) Result() InspectResult {
+	return in.result
+}
+
+// ReadRecord reads the record of idx inside [LeftIdx, ToAppendIdx). If the
+// record is corrupted or could not be decoded, the error is returned with
+// whatever of the RecordInfo is known.
+func (in *Inspector) ReadRecord(idx uint64) (RecordInfo, error) {
+	info := RecordInfo{Idx: idx}
+	if idx < in.result.LeftIdx || idx >= in.result.ToAppendIdx {
+		return info, fmt.Errorf("idx %d is out of range [%d, %d)", idx, in.result.LeftIdx, in.result.ToAppendIdx)
+	}
+	s := in.db.findSegment(idx)
+	entry := s.directory[idx-s.firstIdx]
+	info.Pos, info.Length = entry.pos, entry.length
+	bs := make([]byte, entry.length)
+	_, err := s.f.ReadAt(bs, int64(entry.pos))
+	if err != nil {
+		return info, err
+	}
+	flags, _, err := decodeRecord(bs, idx, true)
+	if err != nil {
+		return info, err
+	}
+	info.Flags = flags
+	info.Codec = Codec(flags & recordFlagsCodecMask)
+	info.EncryptedFlag = flags&recordFlagEncrypted != 0
+	info.Value, _, err = s.decodeRecordValue(bs, idx)
+	return info, err
+}
+
+func (in *Inspector) Close() error {
+	var firstErr error
+	for _, s := range in.db.segments {
+		err := s.close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,148 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"fmt"
+)
+
+// Iterator walks through the values of a DB one idx at a time:
+//
+//	it, err := db.NewIterator(fromIdx, false)
+//	...
+//	for it.Next() {
+//		use(it.Idx(), it.Value())
+//	}
+//	err = it.Err()
+//
+// A forward iterator stops at the toAppendIdx seen when it reads ahead, so
+// the values appended during the iteration may be visited too. A backward
+// iterator stops at the leftIdx seen when it is created. If the idx to visit
+// next is deleted during the iteration, Next returns false and Err reports it.
+// fromIdx of a forward iterator may be toAppendIdx, which waits for nothing
+// but visits the values appended before the first Next.
+// One iterator should not be used by multiple goroutines at the same time.
+type Iterator interface {
+	Next() bool
+	Idx() uint64
+	// The returned value is valid until the DB is closed, even after Next.
+	Value() []byte
+	Err() error
+}
+
+// how many values are read ahead at most by one refill of rangeIterator
+const iteratorReadAheadCt = 256
+
+type rangeDB interface {
+	GetCurrentIdxRange() (leftIdx, toAppendIdx uint64)
+	GetValuesByIdxRange(leftIdx, rightIdx uint64) (vArray [][]byte, e error)
+}
+
+// rangeIterator implements Iterator on top of GetValuesByIdxRange.
+type rangeIterator struct {
+	db           rangeDB
+	backwardFlag bool
+	// the idx to visit by the next Next
+	nextIdx uint64
+	// a backward iterator stops before it, which is leftIdx at the creation
+	lowestIdx uint64
+	// the values read ahead, in the order of visiting
+	buf [][]byte
+	// idx and value of the current position
+	idx uint64
+	v   []byte
+	err error
+	// set when the iterator could not go further
+	endFlag bool
+}
+
+func newRangeIterator(db rangeDB, fromIdx uint64, backwardFlag bool) (*rangeIterator, error) {
+	leftIdx, toAppendIdx := db.GetCurrentIdxRange()
+	if fromIdx < leftIdx || fromIdx > toAppendIdx || (backwardFlag && fromIdx == toAppendIdx && fromIdx > leftIdx) {
+		return nil, fmt.Errorf("fromIdx %d is out of range [%d, %d)", fromIdx, leftIdx, toAppendIdx)
+	}
+	return &rangeIterator{
+		db:           db,
+		backwardFlag: backwardFlag,
+		nextIdx:      fromIdx,
+		lowestIdx:    leftIdx,
+	}, nil
+}
+
+func (it *rangeIterator) Next() bool {
+	if it.endFlag {
+		return false
+	}
+	if len(it.buf) == 0 && !it.refill() {
+		it.endFlag = true
+		it.v = nil
+		return false
+	}
+	it.idx, it.v = it.nextIdx, it.buf[0]
+	it.buf = it.buf[1:]
+	if it.backwardFlag {
+		it.nextIdx--
+	} else {
+		it.nextIdx++
+	}
+	return true
+}
+
+func (it *rangeIterator) refill() bool {
+	leftIdx, toAppendIdx := it.db.GetCurrentIdxRange()
+	if it.nextIdx >= toAppendIdx || (it.backwardFlag && it.nextIdx < it.lowestIdx) {
+		return false
+	}
+	if it.nextIdx < leftIdx {
+		it.err = fmt.Errorf("idx %d is out of range [%d, %d)", it.nextIdx, leftIdx, toAppendIdx)
+		return false
+	}
+	var l, r uint64
+	if it.backwardFlag {
+		l, r = leftIdx, it.nextIdx+1
+		if r-l > iteratorReadAheadCt {
+			l = r - iteratorReadAheadCt
+		}
+	} else {
+		l, r = it.nextIdx, toAppendIdx
+		if r-l > iteratorReadAheadCt {
+			r = l + iteratorReadAheadCt
+		}
+	}
+	vArray, err := it.db.GetValuesByIdxRange(l, r)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	if it.backwardFlag {
+		for i, j := 0, len(vArray)-1; i < j; i, j = i+1, j-1 {
+			vArray[i], vArray[j] = vArray[j], vArray[i]
+		}
+	}
+	it.buf = vArray
+	return true
+}
+
+func (it *rangeIterator) Idx() uint64 {
+	return it.idx
+}
+
+func (it *rangeIterator) Value() []byte {
+	return it.v
+}
+
+func (it *rangeIterator) Err() error {
+	return it.err
+}
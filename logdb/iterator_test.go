@@ -0,0 +1,163 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+// newSegmentedTestDB returns a logdb of [deleteBefore, n+1) over many
+// segments, more than iteratorReadAheadCt values are live.
+func newSegmentedTestDB(t *testing.T, n int, deleteBefore uint64) DB {
+	t.Helper()
+	db, err := CreateDBWithOptions(filepath.Join(t.TempDir(), "db"), NewOptions(WithSegmentSize(256)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	for i := 1; i <= n; i += 10 {
+		var vArray [][]byte
+		for j := i; j < i+10 && j <= n; j++ {
+			vArray = append(vArray, testValue(j))
+		}
+		err = db.AppendAndSync3(uint64(i), vArray, deleteBefore)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if firstIdxs, err := listSegments(db.(*fileDB).dirPath); err != nil || len(firstIdxs) < 10 {
+		t.Fatalf("got segments %v %v", firstIdxs, err)
+	}
+	return db
+}
+
+func checkValues(t *testing.T, vArray [][]byte, leftIdx uint64) {
+	t.Helper()
+	for i, v := range vArray {
+		if !bytes.Equal(v, testValue(int(leftIdx)+i)) {
+			t.Fatalf("idx %d got %q", leftIdx+uint64(i), v)
+		}
+	}
+}
+
+func TestGetValuesByIdxRangeAcrossSegments(t *testing.T) {
+	const n, deleteBefore = 300, 6
+	db := newSegmentedTestDB(t, n, deleteBefore)
+	cases := []struct {
+		leftIdx, rightIdx uint64
+		okFlag            bool
+	}{
+		{deleteBefore, n + 1, true},
+		{8, 95, true},
+		{100, 100, true},
+		{n, n + 1, true},
+		{deleteBefore - 1, 10, false},
+		{1, deleteBefore, false},
+		{10, n + 2, false},
+		{10, 9, false},
+	}
+	for _, c := range cases {
+		vArray, err := db.GetValuesByIdxRange(c.leftIdx, c.rightIdx)
+		if (err == nil) != c.okFlag {
+			t.Fatalf("[%d, %d) got %v", c.leftIdx, c.rightIdx, err)
+		}
+		if !c.okFlag {
+			continue
+		}
+		if len(vArray) != int(c.rightIdx-c.leftIdx) {
+			t.Fatalf("[%d, %d) got %d values", c.leftIdx, c.rightIdx, len(vArray))
+		}
+		checkValues(t, vArray, c.leftIdx)
+	}
+}
+
+func TestIteratorAcrossSegments(t *testing.T) {
+	const n, deleteBefore = 300, 6
+	db := newSegmentedTestDB(t, n, deleteBefore)
+	cases := []struct {
+		fromIdx      uint64
+		backwardFlag bool
+		okFlag       bool
+		visitCt      int
+	}{
+		{deleteBefore, false, true, n + 1 - deleteBefore},
+		{150, false, true, n + 1 - 150},
+		{n + 1, false, true, 0},
+		{n, true, true, n + 1 - deleteBefore},
+		{150, true, true, 150 + 1 - deleteBefore},
+		{deleteBefore, true, true, 1},
+		{deleteBefore - 1, false, false, 0},
+		{deleteBefore - 1, true, false, 0},
+		{n + 1, true, false, 0},
+		{n + 2, false, false, 0},
+	}
+	for _, c := range cases {
+		it, err := db.NewIterator(c.fromIdx, c.backwardFlag)
+		if (err == nil) != c.okFlag {
+			t.Fatalf("from %d backward %v got %v", c.fromIdx, c.backwardFlag, err)
+		}
+		if err != nil {
+			continue
+		}
+		visitCt := 0
+		expectIdx := c.fromIdx
+		for it.Next() {
+			if it.Idx() != expectIdx || !bytes.Equal(it.Value(), testValue(int(expectIdx))) {
+				t.Fatalf("from %d backward %v got idx %d %q but expect idx %d",
+					c.fromIdx, c.backwardFlag, it.Idx(), it.Value(), expectIdx)
+			}
+			visitCt++
+			if c.backwardFlag {
+				expectIdx--
+			} else {
+				expectIdx++
+			}
+		}
+		if it.Err() != nil || visitCt != c.visitCt {
+			t.Fatalf("from %d backward %v visited %d values but expect %d, err %v",
+				c.fromIdx, c.backwardFlag, visitCt, c.visitCt, it.Err())
+		}
+	}
+}
+
+// The iterators fail once the idx to visit next is deleted.
+func TestIteratorIntoDeletedPrefix(t *testing.T) {
+	const n, deleteBefore = 300, 6
+	db := newSegmentedTestDB(t, n, deleteBefore)
+	forward, err := db.NewIterator(deleteBefore, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backward, err := db.NewIterator(20, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AppendAndSync3(n+1, [][]byte{testValue(n + 1)}, 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if forward.Next() || forward.Err() == nil {
+		t.Fatal("expect the forward iterator to fail at the deleted idx")
+	}
+	var visited []uint64
+	for backward.Next() {
+		visited = append(visited, backward.Idx())
+	}
+	if len(visited) != 9 || visited[0] != 20 || visited[8] != 12 || backward.Err() == nil {
+		t.Fatalf("backward iterator visited %v and got %v", visited, backward.Err())
+	}
+}
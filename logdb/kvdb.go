@@ -0,0 +1,572 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/turingcell/veela/util"
+)
+
+type KVPair struct {
+	Key   []byte
+	Value []byte
+}
+
+// KVStore is the minimal general purpose KV engine needed to build a DB by
+// CreateKVDB and OpenKVDBIfExist.
+type KVStore interface {
+	// Return a nil v without error if key does not exist. v is owned by the
+	// caller.
+	Get(key []byte) (v []byte, e error)
+	// Apply sets and then deletes in order. If syncFlag is set, all the
+	// writes so far should be durable once it returns. It is never called
+	// concurrently.
+	Write(sets []KVPair, deletes [][]byte, syncFlag bool) error
+	// Return true if one Write is applied atomically even across a crash.
+	AtomicFlag() bool
+	Close() error
+}
+
+// OpenKVStoreFunc opens the KVStore under the existing directory
+// dirPathStr, creating the files of the engine if necessary.
+type OpenKVStoreFunc func(dirPathStr string) (KVStore, error)
+
+// The layout inside a KVStore:
+//
+//	"m"           -> uint64(toAppendIdx) uint64(deletedIdx) uint32(CRC32C)
+//	"v" uint64(idx) -> value
+//
+// Just like the Meta of the file format, the meta key is the commit point:
+// the values are written and synced before it unless the KVStore is atomic,
+// so the values outside the range described by the meta are garbage. They
+// are ignored, overwritten by the next appends or removed by the next open.
+const (
+	kvMetaLen        = 8 + 8 + 4
+	kvValueKeyPrefix = 'v'
+)
+
+var kvMetaKey = []byte("m")
+
+func kvValueKey(idx uint64) []byte {
+	key := make([]byte, 9)
+	key[0] = kvValueKeyPrefix
+	util.U64SetBs(key[1:], idx)
+	return key
+}
+
+func encodeKVMeta(toAppendIdx uint64, deletedIdx uint64) []byte {
+	bs := make([]byte, kvMetaLen)
+	util.U64SetBs(bs, toAppendIdx)
+	util.U64SetBs(bs[8:], deletedIdx)
+	util.U32SetBs(bs[16:], checksum(bs[:16]))
+	return bs
+}
+
+func decodeKVMeta(bs []byte) (toAppendIdx uint64, deletedIdx uint64, e error) {
+	if len(bs) != kvMetaLen {
+		return 0, 0, corruptionf(ErrCorruptMeta, "len of meta is %d", len(bs))
+	}
+	if util.BsReadU32(bs[16:]) != checksum(bs[:16]) {
+		return 0, 0, corruptionf(ErrCorruptMeta, "%v", ErrChecksumMismatch)
+	}
+	toAppendIdx = util.BsReadU64(bs)
+	deletedIdx = util.BsReadU64(bs[8:])
+	if toAppendIdx == 0 {
+		return 0, 0, corruptionf(ErrCorruptMeta, "invalid toAppendIdx: 0")
+	}
+	return toAppendIdx, deletedIdx, nil
+}
+
+// checkKVOptions rejects the members of Options about the file format, which
+// a KVStore has no counterpart of.
+//
+// The others are honoured: SyncMode SyncNone writes without syncFlag and the
+// other modes are the same, CacheSize, Logger and Metrics work as they do with
+// the file format, and SkipReadChecksum has nothing to skip since the values
+// are checked by the engine if ever.
+func checkKVOptions(opts *Options) error {
+	if opts == nil {
+		return nil
+	}
+	var unsupported []string
+	check := func(setFlag bool, name string) {
+		if setFlag {
+			unsupported = append(unsupported, name)
+		}
+	}
+	check(opts.SegmentSize != 0, "SegmentSize")
+	check(opts.GroupCommitter != nil, "GroupCommitter")
+	check(opts.MmapRead, "MmapRead")
+	check(opts.Compression != CodecNone, "Compression")
+	check(opts.KeyProvider != nil, "KeyProvider")
+	check(opts.PreallocateSize != 0, "PreallocateSize")
+	check(opts.DirectIO, "DirectIO")
+	check(opts.ReadOnly, "ReadOnly")
+	if len(unsupported) > 0 {
+		return fmt.Errorf("the logdb on a KVStore does not support Options.%s", strings.Join(unsupported, ", Options."))
+	}
+	return nil
+}
+
+// kvDB implements DB on top of a KVStore.
+//
+// The physical bytes in its Stats are the bytes of the keys and values handed
+// to the KVStore, which does not include the amplification inside the engine.
+//
+// A read racing with TruncateFrom may return the value appended at the same
+// idx after the truncation, since the KVStore overwrites in place.
+type kvDB struct {
+	// read only
+	dirPath string
+	opts    Options
+	store   KVStore
+	stats   *statCounters
+	cache   *valueCache
+
+	writeMux  sync.Mutex
+	brokenErr error
+	async     asyncAppender
+
+	mux         sync.RWMutex
+	closedFlag  bool
+	toAppendIdx uint64
+	deletedIdx  uint64
+	// the generation of cache, see valueCache
+	truncatedCt uint64
+	// readers which are reading the store without holding mux
+	readers sync.WaitGroup
+}
+
+// The path should be non-exist yet, just like CreateDB.
+func CreateKVDB(dirPathStr string, openStore OpenKVStoreFunc) (DB, error) {
+	return CreateKVDBWithOptions(dirPathStr, openStore, nil)
+}
+
+// The same with CreateKVDB, the members of opts not supported are rejected,
+// see checkKVOptions.
+func CreateKVDBWithOptions(dirPathStr string, openStore OpenKVStoreFunc, opts *Options) (DB, error) {
+	err := checkKVOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Mkdir(dirPathStr, 0755)
+	if err != nil {
+		return nil, err
+	}
+	store, err := openStore(dirPathStr)
+	if err != nil {
+		return nil, err
+	}
+	err = store.Write([]KVPair{{kvMetaKey, encodeKVMeta(1, 0)}}, nil, true)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	return newKVDB(dirPathStr, opts, store, 1, 0), nil
+}
+
+// The errors are the same with OpenDBIfExist, ErrCorruptMeta is returned if
+// the meta key is missing.
+func OpenKVDBIfExist(dirPathStr string, openStore OpenKVStoreFunc) (DB, error) {
+	return OpenKVDBIfExistWithOptions(dirPathStr, openStore, nil)
+}
+
+// The same with OpenKVDBIfExist, the members of opts not supported are
+// rejected, see checkKVOptions.
+func OpenKVDBIfExistWithOptions(dirPathStr string, openStore OpenKVStoreFunc, opts *Options) (DB, error) {
+	err := checkKVOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	_, err = os.Stat(dirPathStr)
+	if err != nil {
+		return nil, err
+	}
+	store, err := openStore(dirPathStr)
+	if err != nil {
+		return nil, err
+	}
+	toAppendIdx, deletedIdx, garbageCt, err := openKVStoreState(store)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	db := newKVDB(dirPathStr, opts, store, toAppendIdx, deletedIdx)
+	if garbageCt > 0 {
+		db.opts.Logger.Infof("logdb %s: removed %d garbage values left by the last run", dirPathStr, garbageCt)
+	}
+	return db, nil
+}
+
+// openKVStoreState reads the meta and removes the garbage values left by
+// the last crash, they are continuous below deletedIdx+1 or from toAppendIdx.
+func openKVStoreState(store KVStore) (toAppendIdx uint64, deletedIdx uint64, garbageCt int, e error) {
+	bs, err := store.Get(kvMetaKey)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if bs == nil {
+		return 0, 0, 0, corruptionf(ErrCorruptMeta, "meta key is missing")
+	}
+	toAppendIdx, deletedIdx, err = decodeKVMeta(bs)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	var garbage [][]byte
+	exist := func(idx uint64) (bool, error) {
+		v, err := store.Get(kvValueKey(idx))
+		return v != nil, err
+	}
+	for idx := deletedIdx; idx > 0 && idx < toAppendIdx; idx-- {
+		ok, err := exist(idx)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		if !ok {
+			break
+		}
+		garbage = append(garbage, kvValueKey(idx))
+	}
+	for idx := toAppendIdx; ; idx++ {
+		ok, err := exist(idx)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		if !ok {
+			break
+		}
+		garbage = append(garbage, kvValueKey(idx))
+	}
+	if len(garbage) > 0 {
+		err = store.Write(nil, garbage, true)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+	}
+	return toAppendIdx, deletedIdx, len(garbage), nil
+}
+
+func newKVDB(dirPathStr string, opts *Options, store KVStore, toAppendIdx uint64, deletedIdx uint64) *kvDB {
+	db := &kvDB{
+		dirPath:     dirPathStr,
+		opts:        opts.withDefaults(),
+		store:       store,
+		stats:       new(statCounters),
+		toAppendIdx: toAppendIdx,
+		deletedIdx:  deletedIdx,
+	}
+	db.cache = newValueCache(db.opts.CacheSize)
+	db.async = asyncAppender{
+		appendAndSync3:     db.appendAndSync3,
+		getCurrentIdxRange: db.GetCurrentIdxRange,
+		maxMergeBytes:      DefaultSegmentSize,
+	}
+	return db
+}
+
+// caller should hold db.mux
+func (db *kvDB) currentIdxRange() (leftIdx, toAppendIdx uint64) {
+	toAppendIdx = db.toAppendIdx
+	leftIdx = db.deletedIdx + 1
+	if leftIdx > toAppendIdx {
+		leftIdx = toAppendIdx
+	}
+	return
+}
+
+func (db *kvDB) GetCurrentIdxRange() (leftIdx, toAppendIdx uint64) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	return db.currentIdxRange()
+}
+
+func (db *kvDB) GetValueByIdx(idx uint64) (v []byte, e error) {
+	gen, err := db.acquireRange(idx, idx+1)
+	if err != nil {
+		return nil, err
+	}
+	defer db.readers.Done()
+	db.opts.Metrics.AddCounter(MetricReadCt, 1)
+	if v, ok := db.cache.get(idx); ok {
+		db.opts.Metrics.AddCounter(MetricCacheHitCt, 1)
+		return v, nil
+	}
+	v, err = db.get(idx)
+	if err != nil {
+		return nil, err
+	}
+	db.cache.put(gen, idx, [][]byte{v})
+	return v, nil
+}
+
+func (db *kvDB) GetValueLeaseByIdx(idx uint64) (l *ValueLease, e error) {
+	v, err := db.GetValueByIdx(idx)
+	if err != nil {
+		return nil, err
+	}
+	return newValueLease(v, nil), nil
+}
+
+// acquireRange checks [leftIdx, rightIdx) is readable and adds a reader,
+// which the caller should release by db.readers.Done. It also returns the
+// generation of the range for valueCache.put.
+func (db *kvDB) acquireRange(leftIdx, rightIdx uint64) (gen uint64, e error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	if db.closedFlag {
+		return 0, fmt.Errorf("logdb is already closed")
+	}
+	curLeftIdx, curToAppendIdx := db.currentIdxRange()
+	if leftIdx > rightIdx || (leftIdx < rightIdx && (leftIdx < curLeftIdx || rightIdx > curToAppendIdx)) {
+		return 0, fmt.Errorf("idx range [%d, %d) is out of range [%d, %d)", leftIdx, rightIdx, curLeftIdx, curToAppendIdx)
+	}
+	db.readers.Add(1)
+	return db.truncatedCt, nil
+}
+
+func (db *kvDB) get(idx uint64) ([]byte, error) {
+	v, err := db.store.Get(kvValueKey(idx))
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, corruptionf(ErrCorruptDirectory, "value of idx %d is missing", idx)
+	}
+	return v, nil
+}
+
+func (db *kvDB) GetValuesByIdxRange(leftIdx, rightIdx uint64) (vArray [][]byte, e error) {
+	_, err := db.acquireRange(leftIdx, rightIdx)
+	if err != nil {
+		return nil, err
+	}
+	defer db.readers.Done()
+
+	vArray = make([][]byte, 0, rightIdx-leftIdx)
+	for idx := leftIdx; idx < rightIdx; idx++ {
+		v, err := db.get(idx)
+		if err != nil {
+			return nil, err
+		}
+		vArray = append(vArray, v)
+	}
+	return vArray, nil
+}
+
+func (db *kvDB) NewIterator(fromIdx uint64, backwardFlag bool) (Iterator, error) {
+	return newRangeIterator(db, fromIdx, backwardFlag)
+}
+
+func (db *kvDB) AppendAndSync(appendAtIdx uint64, vArray [][]byte) (e error) {
+	return db.AppendAndSync3(appendAtIdx, vArray, 0)
+}
+
+func (db *kvDB) AppendAndSync3(appendAtIdx uint64, vArray [][]byte, deleteAllIdxLessThan uint64) (e error) {
+	if err := db.async.flush(); err != nil {
+		return err
+	}
+	return db.appendAndSync3(appendAtIdx, vArray, deleteAllIdxLessThan)
+}
+
+func (db *kvDB) AppendAsync(appendAtIdx uint64, vArray [][]byte) *AppendFuture {
+	return db.async.appendAsync(appendAtIdx, vArray)
+}
+
+func (db *kvDB) Flush() error {
+	return db.async.flush()
+}
+
+// loadForWrite returns the state to write, caller should hold db.writeMux.
+func (db *kvDB) loadForWrite() (toAppendIdx uint64, deletedIdx uint64, e error) {
+	if db.brokenErr != nil {
+		return 0, 0, fmt.Errorf("logdb is broken by a previous error: %v", db.brokenErr)
+	}
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	if db.closedFlag {
+		return 0, 0, fmt.Errorf("logdb is already closed")
+	}
+	return db.toAppendIdx, db.deletedIdx, nil
+}
+
+// write is KVStore.Write with the stats counted, syncFlag is dropped with
+// SyncNone.
+func (db *kvDB) write(sets []KVPair, deletes [][]byte, syncFlag bool) error {
+	if db.opts.SyncMode == SyncNone {
+		syncFlag = false
+	}
+	for _, kv := range sets {
+		if len(kv.Key) > 0 && kv.Key[0] == kvValueKeyPrefix {
+			db.stats.addData(len(kv.Key) + len(kv.Value))
+		} else {
+			db.stats.addMeta(len(kv.Key) + len(kv.Value))
+		}
+	}
+	for _, key := range deletes {
+		db.stats.addData(len(key))
+	}
+	if !syncFlag {
+		return db.store.Write(sets, deletes, false)
+	}
+	db.stats.addSync()
+	start := time.Now()
+	err := db.store.Write(sets, deletes, true)
+	db.opts.Metrics.ObserveLatency(MetricSyncLatency, time.Since(start))
+	return err
+}
+
+// setBroken makes all the later writes fail, the caller should hold
+// db.writeMux.
+func (db *kvDB) setBroken(err error) {
+	db.brokenErr = err
+	db.opts.Logger.Errorf("logdb %s: broken by error: %v", db.dirPath, err)
+}
+
+// commit writes sets, the new meta and deletes, the deletes are only the
+// garbage after the meta is written. Caller should hold db.writeMux.
+func (db *kvDB) commit(sets []KVPair, toAppendIdx uint64, deletedIdx uint64, deletes [][]byte) error {
+	metaPair := KVPair{kvMetaKey, encodeKVMeta(toAppendIdx, deletedIdx)}
+	var err error
+	if db.store.AtomicFlag() {
+		err = db.write(append(sets, metaPair), deletes, true)
+	} else {
+		if len(sets) > 0 {
+			err = db.write(sets, nil, true)
+		}
+		if err == nil {
+			err = db.write([]KVPair{metaPair}, nil, true)
+		}
+	}
+	if err != nil {
+		db.setBroken(err)
+		return err
+	}
+
+	db.mux.Lock()
+	if toAppendIdx < db.toAppendIdx {
+		db.truncatedCt++
+		db.cache.truncateFrom(db.truncatedCt, toAppendIdx)
+	}
+	db.toAppendIdx = toAppendIdx
+	db.deletedIdx = deletedIdx
+	db.mux.Unlock()
+	if !db.store.AtomicFlag() && len(deletes) > 0 {
+		// the garbage left by a failure here is removed by the next open
+		db.write(nil, deletes, false)
+	}
+	return nil
+}
+
+func (db *kvDB) appendAndSync3(appendAtIdx uint64, vArray [][]byte, deleteAllIdxLessThan uint64) (e error) {
+	start := time.Now()
+	db.writeMux.Lock()
+	defer db.writeMux.Unlock()
+	toAppendIdx, deletedIdx, err := db.loadForWrite()
+	if err != nil {
+		return err
+	}
+	if appendAtIdx != toAppendIdx {
+		return fmt.Errorf("appendAtIdx %d != toAppendIdx %d", appendAtIdx, toAppendIdx)
+	}
+	newToAppendIdx := toAppendIdx + uint64(len(vArray))
+	if deleteAllIdxLessThan > newToAppendIdx {
+		return fmt.Errorf("deleteAllIdxLessThan %d > toAppendIdx %d after this append", deleteAllIdxLessThan, newToAppendIdx)
+	}
+	newDeletedIdx := deletedIdx
+	if deleteAllIdxLessThan > 0 && deleteAllIdxLessThan-1 > deletedIdx {
+		newDeletedIdx = deleteAllIdxLessThan - 1
+	}
+	if len(vArray) == 0 && newDeletedIdx == deletedIdx {
+		return nil
+	}
+
+	sets := make([]KVPair, len(vArray))
+	for i, v := range vArray {
+		sets[i] = KVPair{kvValueKey(appendAtIdx + uint64(i)), v}
+	}
+	// in ascending order, see openKVStoreState
+	var deletes [][]byte
+	for idx := deletedIdx + 1; idx <= newDeletedIdx && idx < newToAppendIdx; idx++ {
+		deletes = append(deletes, kvValueKey(idx))
+	}
+	err = db.commit(sets, newToAppendIdx, newDeletedIdx, deletes)
+	if err != nil {
+		return err
+	}
+	// truncatedCt is only modified with writeMux held
+	db.cache.put(db.truncatedCt, appendAtIdx, vArray)
+	userBytes := valuesLen(vArray)
+	db.stats.addUser(userBytes)
+	db.opts.Metrics.AddCounter(MetricAppendCt, 1)
+	db.opts.Metrics.AddCounter(MetricAppendBytes, uint64(userBytes))
+	db.opts.Metrics.ObserveLatency(MetricAppendLatency, time.Since(start))
+	return nil
+}
+
+func (db *kvDB) TruncateFrom(idx uint64) error {
+	if err := db.async.flush(); err != nil {
+		return err
+	}
+	db.writeMux.Lock()
+	defer db.writeMux.Unlock()
+	toAppendIdx, deletedIdx, err := db.loadForWrite()
+	if err != nil {
+		return err
+	}
+	if idx == toAppendIdx {
+		return nil
+	}
+	leftIdx := deletedIdx + 1
+	if leftIdx > toAppendIdx {
+		leftIdx = toAppendIdx
+	}
+	if idx < leftIdx || idx > toAppendIdx {
+		return fmt.Errorf("idx %d is out of range [%d, %d]", idx, leftIdx, toAppendIdx)
+	}
+	// in descending order, see openKVStoreState
+	var deletes [][]byte
+	for i := toAppendIdx; i > idx; i-- {
+		deletes = append(deletes, kvValueKey(i-1))
+	}
+	return db.commit(nil, idx, deletedIdx, deletes)
+}
+
+func (db *kvDB) Stats() Stats {
+	return db.stats.snapshot()
+}
+
+func (db *kvDB) Close() error {
+	flushErr := db.async.flush()
+	db.writeMux.Lock()
+	defer db.writeMux.Unlock()
+	db.mux.Lock()
+	if db.closedFlag {
+		db.mux.Unlock()
+		return fmt.Errorf("logdb is already closed")
+	}
+	db.closedFlag = true
+	db.mux.Unlock()
+	db.readers.Wait()
+	err := db.store.Close()
+	if err != nil {
+		return err
+	}
+	return flushErr
+}
@@ -0,0 +1,142 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mapStore is an atomic KVStore in memory, it counts the synced Writes.
+type mapStore struct {
+	m       map[string][]byte
+	syncCt  int
+	writeCt int
+}
+
+func (s *mapStore) Get(key []byte) ([]byte, error) {
+	v, ok := s.m[string(key)]
+	if !ok {
+		return nil, nil
+	}
+	return append([]byte{}, v...), nil
+}
+
+func (s *mapStore) Write(sets []KVPair, deletes [][]byte, syncFlag bool) error {
+	for _, kv := range sets {
+		s.m[string(kv.Key)] = append([]byte{}, kv.Value...)
+	}
+	for _, key := range deletes {
+		delete(s.m, string(key))
+	}
+	s.writeCt++
+	if syncFlag {
+		s.syncCt++
+	}
+	return nil
+}
+
+func (s *mapStore) AtomicFlag() bool {
+	return true
+}
+
+func (s *mapStore) Close() error {
+	return nil
+}
+
+type countMetrics struct {
+	mux      sync.Mutex
+	counters map[string]uint64
+}
+
+func (m *countMetrics) AddCounter(name string, delta uint64) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.counters[name] += delta
+}
+
+func (m *countMetrics) ObserveLatency(name string, d time.Duration) {
+	m.AddCounter(name, 1)
+}
+
+func (m *countMetrics) get(name string) uint64 {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.counters[name]
+}
+
+func TestKVDBRejectsUnsupportedOptions(t *testing.T) {
+	store := &mapStore{m: make(map[string][]byte)}
+	openStore := func(dirPathStr string) (KVStore, error) { return store, nil }
+	dirPath := filepath.Join(t.TempDir(), "db")
+	opts := NewOptions(WithSegmentSize(1<<20), WithMmapRead(), WithDirectIO())
+	_, err := CreateKVDBWithOptions(dirPath, openStore, opts)
+	if err == nil || !strings.Contains(err.Error(), "Options.SegmentSize, Options.MmapRead, Options.DirectIO") {
+		t.Fatalf("got %v", err)
+	}
+	db, err := CreateKVDB(dirPath, openStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	_, err = OpenKVDBIfExistWithOptions(dirPath, openStore, NewOptions(WithCompression(CodecSnappy, 0)))
+	if err == nil {
+		t.Fatal("expect an error of Options.Compression")
+	}
+}
+
+func TestKVDBOptions(t *testing.T) {
+	store := &mapStore{m: make(map[string][]byte)}
+	openStore := func(dirPathStr string) (KVStore, error) { return store, nil }
+	metrics := &countMetrics{counters: make(map[string]uint64)}
+	opts := NewOptions(WithSyncMode(SyncNone), WithCacheSize(1<<20), WithMetrics(metrics))
+	db, err := CreateKVDBWithOptions(filepath.Join(t.TempDir(), "db"), openStore, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	syncCt := store.syncCt
+	if err := appendTestValues(db, 1, 4, 0); err != nil {
+		t.Fatal(err)
+	}
+	if store.syncCt != syncCt {
+		t.Fatalf("SyncNone synced %d times", store.syncCt-syncCt)
+	}
+	checkMemDB(t, db, 1, 4)
+	if ct := metrics.get(MetricCacheHitCt); ct != 3 {
+		t.Fatalf("cache hit %d times", ct)
+	}
+	// the truncated values are not served by the cache
+	if err := db.TruncateFrom(3); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AppendAndSync(3, [][]byte{[]byte("another")}); err != nil {
+		t.Fatal(err)
+	}
+	v, err := db.GetValueByIdx(3)
+	if err != nil || !bytes.Equal(v, []byte("another")) {
+		t.Fatalf("got %q %v", v, err)
+	}
+	if ct := metrics.get(MetricAppendCt); ct != 2 {
+		t.Fatalf("%d appends", ct)
+	}
+	if ct := metrics.get(MetricReadCt); ct != 4 {
+		t.Fatalf("%d reads", ct)
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"sync"
+)
+
+// ValueLease holds a value returned by GetValueLeaseByIdx.
+//
+// In the mmap read mode (Options.MmapRead) the value is a slice of the mapped
+// segment file without any copy, thus:
+//  1. the value must be treated as read only, writing it crashes the process
+//  2. the value is valid until Release, do not keep any reference after that
+//  3. the segment file is never unlinked or unmapped while a lease on it is
+//     not released, so Close blocks until all the leases are released
+//
+// Otherwise the value is a private heap copy and Release does nothing, but
+// callers should still Release it to keep the code portable between modes.
+type ValueLease struct {
+	v           []byte
+	releaseOnce sync.Once
+	release     func()
+}
+
+func newValueLease(v []byte, release func()) *ValueLease {
+	return &ValueLease{v: v, release: release}
+}
+
+func (l *ValueLease) Value() []byte {
+	return l.v
+}
+
+// Release is idempotent.
+func (l *ValueLease) Release() {
+	l.releaseOnce.Do(func() {
+		l.v = nil
+		if l.release != nil {
+			l.release()
+		}
+	})
+}
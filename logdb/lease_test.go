@@ -0,0 +1,95 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"unsafe"
+)
+
+// inMapping reports whether v is a slice of mapped.
+func inMapping(v []byte, mapped []byte) bool {
+	if len(v) == 0 || len(mapped) == 0 {
+		return false
+	}
+	p := uintptr(unsafe.Pointer(&v[0]))
+	left := uintptr(unsafe.Pointer(&mapped[0]))
+	return p >= left && p+uintptr(len(v)) <= left+uintptr(len(mapped))
+}
+
+func TestValueLeaseMmapRead(t *testing.T) {
+	const n = 12
+	dirPath := filepath.Join(t.TempDir(), "db")
+	db, err := CreateDBWithOptions(dirPath, NewOptions(WithMmapRead(), WithSegmentSize(64)))
+	if err != nil {
+		t.Skipf("MmapRead is not supported here: %v", err)
+	}
+	for i := 1; i <= n; i++ {
+		err = db.AppendAndSync(uint64(i), [][]byte{testValue(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i <= n; i++ {
+		l, err := db.GetValueLeaseByIdx(uint64(i))
+		if err != nil || !bytes.Equal(l.Value(), testValue(i)) {
+			t.Fatalf("idx %d got %q %v", i, l.Value(), err)
+		}
+		l.Release()
+		l.Release()
+	}
+
+	// the lease is a slice of the mapping of the head segment
+	l, err := db.GetValueLeaseByIdx(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head := db.(*fileDB).segments[0]
+	if !inMapping(l.Value(), head.mapped) {
+		t.Fatal("the lease is not a slice of the mapping")
+	}
+	headPath := head.path
+
+	// the segment is wholly deleted but not unlinked or unmapped until the
+	// lease is released
+	err = db.AppendAndSync3(n+1, [][]byte{testValue(n + 1)}, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.GetValueLeaseByIdx(1); err == nil {
+		t.Fatal("expect an error leasing the deleted idx 1")
+	}
+	if !bytes.Equal(l.Value(), testValue(1)) {
+		t.Fatalf("the lease got %q after the delete", l.Value())
+	}
+	if _, err = os.Stat(headPath); err != nil {
+		t.Fatalf("the leased segment is unlinked: %v", err)
+	}
+	l.Release()
+	if l.Value() != nil {
+		t.Fatal("the value is kept after Release")
+	}
+	// the close waits the reclaim in background
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(headPath); !os.IsNotExist(err) {
+		t.Fatalf("the segment is not unlinked after the lease is released: %v", err)
+	}
+}
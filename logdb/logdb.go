@@ -17,13 +17,33 @@ package logdb
 // The path should be non-exist yet and logdb would create it by itself.
 // But you may not expected logdb would create intermediate directories as required.
 // That is just like a simple `mkdir` without `-p` option.
-func CreateDB(dirPathStr string) (DB, error) {
-	return nil, nil
+// The opts are collected by NewOptions, see Options for the defaults.
+func CreateDB(dirPathStr string, opts ...Option) (DB, error) {
+	return CreateDBWithOptions(dirPathStr, NewOptions(opts...))
+}
+
+func CreateDBWithOptions(dirPathStr string, opts *Options) (DB, error) {
+	db, err := createFileDB(dirPathStr, opts)
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
 }
 
 // If the db is invalid yet, error would be returned.
-func OpenDBIfExist(dirPathStr string) (DB, error) {
-	return nil, nil
+// Invalid means one of ErrBadFileHeader, ErrCorruptMeta, ErrTruncatedDirectory and
+// ErrCorruptDirectory. Bytes appended but not committed by a crashed AppendAndSync3
+// are not treated as invalid, they would be cut off silently.
+func OpenDBIfExist(dirPathStr string, opts ...Option) (DB, error) {
+	return OpenDBIfExistWithOptions(dirPathStr, NewOptions(opts...))
+}
+
+func OpenDBIfExistWithOptions(dirPathStr string, opts *Options) (DB, error) {
+	db, err := openFileDB(dirPathStr, opts)
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
 }
 
 // Limitations: One writer and multi reader at the same time.
@@ -35,6 +55,17 @@ type DB interface {
 	// leftIdx > 0
 	GetCurrentIdxRange() (leftIdx, toAppendIdx uint64)
 	GetValueByIdx(idx uint64) (v []byte, e error)
+	// The same as GetValueByIdx but the value is held by a lease, which should be released after use.
+	// It is zero-copy under Options.MmapRead, see ValueLease for the rules.
+	GetValueLeaseByIdx(idx uint64) (l *ValueLease, e error)
+	// Return the values of idx [leftIdx, rightIdx) with sequential reads.
+	// The whole range should be inside GetCurrentIdxRange, thus a range crossing the deleted prefix
+	// would be failed as a whole instead of returning a partial result.
+	// All the values are held in memory at the same time, use NewIterator for a large range.
+	GetValuesByIdxRange(leftIdx, rightIdx uint64) (vArray [][]byte, e error)
+	// Return an iterator starting from fromIdx, which goes towards toAppendIdx, or towards leftIdx
+	// if backwardFlag is true. See Iterator for details.
+	NewIterator(fromIdx uint64, backwardFlag bool) (Iterator, error)
 	// Zero value of deleteAllIdxLessThan means ignore this input arg.
 	// For a positive deleteAllIdxLessThan, this call would mark all the idx between (0, deleteAllIdxLessThan)
 	// `will-be-deleted` state, and the deleting operation could be asynchrous.
@@ -43,6 +74,27 @@ type DB interface {
 	// would be failed.
 	AppendAndSync3(appendAtIdx uint64, vArray [][]byte, deleteAllIdxLessThan uint64) (e error)
 	AppendAndSync(appendAtIdx uint64, vArray [][]byte) (e error)
-	// Close the db handler
+	// Delete all the idx in [idx, toAppendIdx) so that toAppendIdx becomes idx, idx should be inside
+	// [leftIdx, toAppendIdx]. It is committed by the same atomic Meta write with AppendAndSync3, so a crash
+	// leaves either all or none of them truncated.
+	// The reads already in flight, including the unreleased ValueLeases, the values read ahead by iterators
+	// and a running GetValuesByIdxRange, may still return the truncated values, but every read starting
+	// after it returns never sees them.
+	// It would Flush at first, see AppendAsync.
+	TruncateFrom(idx uint64) (e error)
+	// The asynchronous AppendAndSync, it returns at once and the returned future reports whether vArray is durable.
+	// `appendAtIdx` should be exactly equal with the toAppendIdx after all the previous AppendAsync calls.
+	// The futures are always completed in the order of idx, and once one of them failed all the following ones
+	// would be failed too.
+	// vArray is referenced until the future is completed, so the caller should not modify it before that.
+	// AppendAndSync3, AppendAndSync, TruncateFrom and Close would Flush at first and fail if the Flush fails.
+	AppendAsync(appendAtIdx uint64, vArray [][]byte) *AppendFuture
+	// Block until all the previous AppendAsync calls are completed. Return the first failure of the
+	// AppendAsync calls since the previous Flush, so every failure is reported by only one Flush besides
+	// its future. The Flush at first of AppendAndSync3 and the others counts too.
+	Flush() error
+	// Return the counters since the DB is opened, see Stats.
+	Stats() Stats
+	// Close the db handler, it is closed even if the Flush at first fails.
 	Close() error
 }
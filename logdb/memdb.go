@@ -0,0 +1,338 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"fmt"
+	"sync"
+)
+
+// MemDB is a DB purely in memory for tests, with the knobs to inject faults.
+//
+// Every AppendAndSync3 or TruncateFrom is modeled as a write followed by one
+// sync. A write whose sync failed is kept as unsynced and is never visible,
+// and the MemDB is broken just like the file based one: all the following
+// writes fail until a simulated Crash or PowerLoss, which also reopens a
+// closed MemDB. Then:
+//   - Crash is a process crash, the unsynced writes had already reached the
+//     OS, so they survive and become visible
+//   - PowerLoss drops everything after the last successful write
+//
+// The values are always copied in and out, so callers may reuse their
+// buffers. Only UserBytes and SyncCt of its Stats are counted.
+type MemDB struct {
+	writeMux sync.Mutex
+	async    asyncAppender
+	stats    statCounters
+
+	mux        sync.RWMutex
+	closedFlag bool
+	brokenErr  error
+	// values[i] is the value of idx firstIdx+i
+	firstIdx   uint64
+	values     [][]byte
+	deletedIdx uint64
+	// applied by Crash in order
+	unsynced []func()
+
+	// fault knobs
+	syncFailCt   int
+	syncErr      error
+	partialCt    int
+	partialErr   error
+	readErrAtIdx map[uint64]error
+}
+
+func NewMemDB() *MemDB {
+	db := &MemDB{
+		firstIdx:     1,
+		partialCt:    -1,
+		readErrAtIdx: make(map[uint64]error),
+	}
+	db.async = asyncAppender{
+		appendAndSync3:     db.appendAndSync3,
+		getCurrentIdxRange: db.GetCurrentIdxRange,
+		maxMergeBytes:      DefaultSegmentSize,
+	}
+	return db
+}
+
+// FailNextSyncs makes the syncs of the next n writes fail with err.
+func (db *MemDB) FailNextSyncs(n int, err error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	db.syncFailCt = n
+	db.syncErr = err
+}
+
+// FailNextAppendPartially makes the next AppendAndSync3 with more than
+// writtenCt values write only the first writtenCt of them and fail with err
+// before the sync. The written values are unsynced, thus Crash keeps them
+// like a backend without atomic batches.
+func (db *MemDB) FailNextAppendPartially(writtenCt int, err error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	db.partialCt = writtenCt
+	db.partialErr = err
+}
+
+// FailReadAt makes every read of idx fail with err, a nil err removes the
+// fault.
+func (db *MemDB) FailReadAt(idx uint64, err error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	if err == nil {
+		delete(db.readErrAtIdx, idx)
+	} else {
+		db.readErrAtIdx[idx] = err
+	}
+}
+
+// Crash simulates a process crash and reopens the MemDB, the unsynced writes
+// survive.
+func (db *MemDB) Crash() {
+	db.restart(false)
+}
+
+// PowerLoss simulates a power loss and reopens the MemDB, everything after
+// the last successful AppendAndSync3 or TruncateFrom is dropped.
+func (db *MemDB) PowerLoss() {
+	db.restart(true)
+}
+
+func (db *MemDB) restart(loseUnsyncedFlag bool) {
+	// the failures are reported by the futures, nothing to do here
+	db.async.flush()
+	db.writeMux.Lock()
+	defer db.writeMux.Unlock()
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	if !loseUnsyncedFlag {
+		for _, op := range db.unsynced {
+			op()
+		}
+	}
+	db.unsynced = nil
+	db.brokenErr = nil
+	db.closedFlag = false
+}
+
+// caller should hold db.mux
+func (db *MemDB) currentIdxRange() (leftIdx, toAppendIdx uint64) {
+	toAppendIdx = db.firstIdx + uint64(len(db.values))
+	leftIdx = db.firstIdx
+	if db.deletedIdx+1 > leftIdx {
+		leftIdx = db.deletedIdx + 1
+	}
+	if leftIdx > toAppendIdx {
+		leftIdx = toAppendIdx
+	}
+	return
+}
+
+func (db *MemDB) GetCurrentIdxRange() (leftIdx, toAppendIdx uint64) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	return db.currentIdxRange()
+}
+
+func (db *MemDB) GetValueByIdx(idx uint64) (v []byte, e error) {
+	vArray, err := db.GetValuesByIdxRange(idx, idx+1)
+	if err != nil {
+		return nil, err
+	}
+	return vArray[0], nil
+}
+
+func (db *MemDB) GetValueLeaseByIdx(idx uint64) (l *ValueLease, e error) {
+	v, err := db.GetValueByIdx(idx)
+	if err != nil {
+		return nil, err
+	}
+	return newValueLease(v, nil), nil
+}
+
+func (db *MemDB) GetValuesByIdxRange(leftIdx, rightIdx uint64) (vArray [][]byte, e error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	if db.closedFlag {
+		return nil, fmt.Errorf("logdb is already closed")
+	}
+	curLeftIdx, curToAppendIdx := db.currentIdxRange()
+	if leftIdx > rightIdx || (leftIdx < rightIdx && (leftIdx < curLeftIdx || rightIdx > curToAppendIdx)) {
+		return nil, fmt.Errorf("idx range [%d, %d) is out of range [%d, %d)", leftIdx, rightIdx, curLeftIdx, curToAppendIdx)
+	}
+	vArray = make([][]byte, 0, rightIdx-leftIdx)
+	for idx := leftIdx; idx < rightIdx; idx++ {
+		if err := db.readErrAtIdx[idx]; err != nil {
+			return nil, err
+		}
+		vArray = append(vArray, append([]byte{}, db.values[idx-db.firstIdx]...))
+	}
+	return vArray, nil
+}
+
+func (db *MemDB) NewIterator(fromIdx uint64, backwardFlag bool) (Iterator, error) {
+	return newRangeIterator(db, fromIdx, backwardFlag)
+}
+
+func (db *MemDB) AppendAndSync(appendAtIdx uint64, vArray [][]byte) (e error) {
+	return db.AppendAndSync3(appendAtIdx, vArray, 0)
+}
+
+func (db *MemDB) AppendAndSync3(appendAtIdx uint64, vArray [][]byte, deleteAllIdxLessThan uint64) (e error) {
+	if err := db.async.flush(); err != nil {
+		return err
+	}
+	return db.appendAndSync3(appendAtIdx, vArray, deleteAllIdxLessThan)
+}
+
+func (db *MemDB) AppendAsync(appendAtIdx uint64, vArray [][]byte) *AppendFuture {
+	return db.async.appendAsync(appendAtIdx, vArray)
+}
+
+func (db *MemDB) Flush() error {
+	return db.async.flush()
+}
+
+// checkWritable returns the error if db could not be written, caller should
+// hold db.mux.
+func (db *MemDB) checkWritable() error {
+	if db.closedFlag {
+		return fmt.Errorf("logdb is already closed")
+	}
+	if db.brokenErr != nil {
+		return fmt.Errorf("logdb is broken by a previous error: %v", db.brokenErr)
+	}
+	return nil
+}
+
+// commit applies op if the sync succeeds, otherwise op becomes unsynced and
+// db is broken. Caller should hold db.mux.
+func (db *MemDB) commit(op func()) error {
+	db.stats.addSync()
+	if db.syncFailCt > 0 {
+		db.syncFailCt--
+		db.unsynced = append(db.unsynced, op)
+		db.brokenErr = db.syncErr
+		return db.syncErr
+	}
+	op()
+	return nil
+}
+
+func (db *MemDB) appendAndSync3(appendAtIdx uint64, vArray [][]byte, deleteAllIdxLessThan uint64) (e error) {
+	db.writeMux.Lock()
+	defer db.writeMux.Unlock()
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+	_, toAppendIdx := db.currentIdxRange()
+	if appendAtIdx != toAppendIdx {
+		return fmt.Errorf("appendAtIdx %d != toAppendIdx %d", appendAtIdx, toAppendIdx)
+	}
+	newToAppendIdx := toAppendIdx + uint64(len(vArray))
+	if deleteAllIdxLessThan > newToAppendIdx {
+		return fmt.Errorf("deleteAllIdxLessThan %d > toAppendIdx %d after this append", deleteAllIdxLessThan, newToAppendIdx)
+	}
+	newDeletedIdx := db.deletedIdx
+	if deleteAllIdxLessThan > 0 && deleteAllIdxLessThan-1 > newDeletedIdx {
+		newDeletedIdx = deleteAllIdxLessThan - 1
+	}
+	if len(vArray) == 0 && newDeletedIdx == db.deletedIdx {
+		return nil
+	}
+
+	copied := make([][]byte, len(vArray))
+	for i, v := range vArray {
+		copied[i] = append([]byte{}, v...)
+	}
+	if db.partialCt >= 0 && len(copied) > db.partialCt {
+		written := copied[:db.partialCt]
+		err := db.partialErr
+		db.partialCt = -1
+		db.unsynced = append(db.unsynced, func() {
+			db.values = append(db.values, written...)
+		})
+		db.brokenErr = err
+		return err
+	}
+	err := db.commit(func() {
+		db.values = append(db.values, copied...)
+		db.deleteTo(newDeletedIdx)
+	})
+	if err == nil {
+		db.stats.addUser(valuesLen(copied))
+	}
+	return err
+}
+
+// caller should hold db.mux
+func (db *MemDB) deleteTo(deletedIdx uint64) {
+	if deletedIdx <= db.deletedIdx {
+		return
+	}
+	db.deletedIdx = deletedIdx
+	if deletedIdx >= db.firstIdx {
+		k := deletedIdx + 1 - db.firstIdx
+		if k > uint64(len(db.values)) {
+			k = uint64(len(db.values))
+		}
+		db.values = append([][]byte(nil), db.values[k:]...)
+		db.firstIdx += k
+	}
+}
+
+func (db *MemDB) TruncateFrom(idx uint64) error {
+	if err := db.async.flush(); err != nil {
+		return err
+	}
+	db.writeMux.Lock()
+	defer db.writeMux.Unlock()
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+	leftIdx, toAppendIdx := db.currentIdxRange()
+	if idx == toAppendIdx {
+		return nil
+	}
+	if idx < leftIdx || idx > toAppendIdx {
+		return fmt.Errorf("idx %d is out of range [%d, %d]", idx, leftIdx, toAppendIdx)
+	}
+	return db.commit(func() {
+		db.values = append([][]byte(nil), db.values[:idx-db.firstIdx]...)
+	})
+}
+
+func (db *MemDB) Stats() Stats {
+	return db.stats.snapshot()
+}
+
+func (db *MemDB) Close() error {
+	flushErr := db.async.flush()
+	db.writeMux.Lock()
+	defer db.writeMux.Unlock()
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	if db.closedFlag {
+		return fmt.Errorf("logdb is already closed")
+	}
+	db.closedFlag = true
+	return flushErr
+}
@@ -0,0 +1,194 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// checkMemDB checks db holds exactly the values of idx [leftIdx, toAppendIdx).
+func checkMemDB(t *testing.T, db DB, leftIdx, toAppendIdx uint64) {
+	t.Helper()
+	l, r := db.GetCurrentIdxRange()
+	if l != leftIdx || r != toAppendIdx {
+		t.Fatalf("got idx range [%d, %d) but expect [%d, %d)", l, r, leftIdx, toAppendIdx)
+	}
+	for idx := leftIdx; idx < toAppendIdx; idx++ {
+		v, err := db.GetValueByIdx(idx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(v, testValue(int(idx))) {
+			t.Fatalf("idx %d got %q", idx, v)
+		}
+	}
+}
+
+func appendTestValues(db DB, fromIdx, toIdx uint64, deleteAllIdxLessThan uint64) error {
+	var vArray [][]byte
+	for idx := fromIdx; idx < toIdx; idx++ {
+		vArray = append(vArray, testValue(int(idx)))
+	}
+	return db.AppendAndSync3(fromIdx, vArray, deleteAllIdxLessThan)
+}
+
+func TestMemDBFaults(t *testing.T) {
+	cases := []struct {
+		name string
+		// applied to a MemDB holding [1, 3), returns the error of the
+		// faulty write or nil
+		fault func(db *MemDB) error
+		// expected after the fault, and after a Crash and a PowerLoss in
+		// place of each other
+		leftIdx, toAppendIdx                   uint64
+		crashLeftIdx, crashToAppendIdx         uint64
+		powerLossLeftIdx, powerLossToAppendIdx uint64
+		brokenFlag                             bool
+	}{
+		{
+			name: "no fault",
+			fault: func(db *MemDB) error {
+				return appendTestValues(db, 3, 5, 2)
+			},
+			leftIdx: 2, toAppendIdx: 5,
+			crashLeftIdx: 2, crashToAppendIdx: 5,
+			powerLossLeftIdx: 2, powerLossToAppendIdx: 5,
+		},
+		{
+			name: "failed sync of append",
+			fault: func(db *MemDB) error {
+				db.FailNextSyncs(1, errInjected)
+				return appendTestValues(db, 3, 5, 2)
+			},
+			leftIdx: 1, toAppendIdx: 3,
+			crashLeftIdx: 2, crashToAppendIdx: 5,
+			powerLossLeftIdx: 1, powerLossToAppendIdx: 3,
+			brokenFlag: true,
+		},
+		{
+			name: "failed sync of truncate",
+			fault: func(db *MemDB) error {
+				db.FailNextSyncs(1, errInjected)
+				return db.TruncateFrom(2)
+			},
+			leftIdx: 1, toAppendIdx: 3,
+			crashLeftIdx: 1, crashToAppendIdx: 2,
+			powerLossLeftIdx: 1, powerLossToAppendIdx: 3,
+			brokenFlag: true,
+		},
+		{
+			name: "partial append",
+			fault: func(db *MemDB) error {
+				db.FailNextAppendPartially(1, errInjected)
+				return appendTestValues(db, 3, 5, 0)
+			},
+			leftIdx: 1, toAppendIdx: 3,
+			crashLeftIdx: 1, crashToAppendIdx: 4,
+			powerLossLeftIdx: 1, powerLossToAppendIdx: 3,
+			brokenFlag: true,
+		},
+	}
+	restarts := []struct {
+		name    string
+		restart func(db *MemDB)
+	}{
+		{"crash", (*MemDB).Crash},
+		{"power loss", (*MemDB).PowerLoss},
+	}
+	for _, c := range cases {
+		for _, r := range restarts {
+			t.Run(c.name+"/"+r.name, func(t *testing.T) {
+				db := NewMemDB()
+				if err := appendTestValues(db, 1, 3, 0); err != nil {
+					t.Fatal(err)
+				}
+				err := c.fault(db)
+				if c.brokenFlag != (err != nil) {
+					t.Fatalf("got %v", err)
+				}
+				if err != nil && !errors.Is(err, errInjected) {
+					t.Fatalf("expect %v but got %v", errInjected, err)
+				}
+				checkMemDB(t, db, c.leftIdx, c.toAppendIdx)
+				_, toAppendIdx := db.GetCurrentIdxRange()
+				err = appendTestValues(db, toAppendIdx, toAppendIdx+1, 0)
+				if c.brokenFlag != (err != nil) {
+					t.Fatalf("a broken MemDB should reject all the writes until a restart, got %v", err)
+				}
+				if err == nil {
+					// keep the expectations below
+					db.TruncateFrom(toAppendIdx)
+				}
+
+				r.restart(db)
+				if r.name == "crash" {
+					checkMemDB(t, db, c.crashLeftIdx, c.crashToAppendIdx)
+				} else {
+					checkMemDB(t, db, c.powerLossLeftIdx, c.powerLossToAppendIdx)
+				}
+				_, toAppendIdx = db.GetCurrentIdxRange()
+				if err := appendTestValues(db, toAppendIdx, toAppendIdx+1, 0); err != nil {
+					t.Fatal(err)
+				}
+			})
+		}
+	}
+}
+
+func TestMemDBReadFault(t *testing.T) {
+	db := NewMemDB()
+	if err := appendTestValues(db, 1, 4, 0); err != nil {
+		t.Fatal(err)
+	}
+	db.FailReadAt(2, errInjected)
+	if _, err := db.GetValueByIdx(2); !errors.Is(err, errInjected) {
+		t.Fatalf("expect %v but got %v", errInjected, err)
+	}
+	if _, err := db.GetValuesByIdxRange(1, 4); !errors.Is(err, errInjected) {
+		t.Fatalf("expect %v but got %v", errInjected, err)
+	}
+	if _, err := db.GetValueByIdx(3); err != nil {
+		t.Fatal(err)
+	}
+	db.FailReadAt(2, nil)
+	checkMemDB(t, db, 1, 4)
+}
+
+func TestMemDBReopen(t *testing.T) {
+	db := NewMemDB()
+	if err := appendTestValues(db, 1, 3, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetValueByIdx(1); err == nil {
+		t.Fatal("read a closed MemDB")
+	}
+	if err := appendTestValues(db, 3, 4, 0); err == nil {
+		t.Fatal("append to a closed MemDB")
+	}
+	db.Crash()
+	checkMemDB(t, db, 1, 3)
+	// the values are copied in
+	vArray := [][]byte{testValue(3)}
+	if err := db.AppendAndSync(3, vArray); err != nil {
+		t.Fatal(err)
+	}
+	vArray[0][0] = 'x'
+	checkMemDB(t, db, 1, 4)
+}
@@ -0,0 +1,251 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/turingcell/veela/log"
+)
+
+const (
+	DefaultSegmentSize = 64 << 20
+	// one segment file is limited to 4GiB since Pos is uint32
+	MaxSegmentSize = maxFileSize - dataAreaPos
+)
+
+// Zero value of each member means the default.
+// A nil *Options is the same as a zero Options.
+type Options struct {
+	// Soft limit of the data area size of one segment file in bytes. When the
+	// active segment could not hold the next batch within this size, a new
+	// segment is rolled out. A single batch larger than it still goes into
+	// one empty segment. Set MaxSegmentSize to have a single-file logdb as
+	// long as possible.
+	// Segment files which only hold deleted idx are unlinked in background.
+	SegmentSize uint64
+	// If set, the syncs of this logdb are joined with the other logdb
+	// instances sharing the same GroupCommitter, the ones on the same file
+	// system share one syncfs on Linux.
+	GroupCommitter *GroupCommitter
+	// If set, every segment file is mapped into memory read only. Reads copy
+	// from the mapping instead of pread, and GetValueLeaseByIdx returns the
+	// value without any copy unless it is compressed. Only supported on
+	// 64-bit unix platforms.
+	MmapRead bool
+	// The codec to compress the newly appended values, CodecNone by default.
+	// It could be changed between opens, the records keep their own codec. An
+	// unsupported one fails the create and the open.
+	Compression Codec
+	// Values shorter than it are never compressed, DefaultCompressionMinSize
+	// by default.
+	CompressionMinSize int
+	// If set, the newly appended records and the Metas of the newly created
+	// segments are encrypted with its keys. The segments created without it
+	// keep their Meta in plaintext until they are reclaimed, and it is always
+	// needed once any segment or record is encrypted.
+	KeyProvider KeyProvider
+	// If positive, the data area of the active segment is allocated with
+	// fallocate in steps of it ahead of the appends, so that most appends
+	// neither allocate blocks nor change the file size. The unused tail is
+	// cut off when a new segment is rolled out or the logdb is reopened. On
+	// the platforms other than linux the file is only extended.
+	PreallocateSize uint64
+	// How the appends are made durable, SyncFsync by default.
+	SyncMode SyncMode
+	// If set, the records, directory entries and Metas are written with
+	// O_DIRECT in aligned 4096-byte blocks bypassing the page cache, the
+	// reads still go through the page cache or the mapping. The syncs are
+	// still needed for the durability. Only supported on linux by the file
+	// systems supporting O_DIRECT.
+	DirectIO bool
+	// If set, the checksums of the records are not verified by the reads,
+	// which saves the CPU when the storage is trusted. The checksums are
+	// still written, and always verified by Verify and the Inspector. The
+	// encrypted records are still authenticated by the decryption.
+	SkipReadChecksum bool
+	// If positive, up to this bytes of the recently appended or read values
+	// are cached in memory for GetValueByIdx.
+	CacheSize uint64
+	// If set, OpenDBIfExist opens the logdb without modifying anything, even
+	// the uncommitted tail left by a crash is kept. The appends, TruncateFrom
+	// and Compact fail. CreateDB fails with it.
+	ReadOnly bool
+	// Where the logdb reports the events like rolling out a segment and
+	// unlinking segments. Nothing is logged by default.
+	Logger log.Logger
+	// Where the logdb reports its metrics, see the Metric constants. Nothing
+	// is reported by default.
+	Metrics MetricsSink
+}
+
+// SyncMode is how the appends are made durable.
+type SyncMode int
+
+const (
+	// fsync the data before and after writing the Meta, see AppendAndSync3
+	SyncFsync SyncMode = iota
+	// The same as SyncFsync but uses fdatasync, which skips the metadata not
+	// needed to read the data back such as the modification time. Creating
+	// and shrinking a file still use fsync. Same as SyncFsync on the
+	// platforms other than linux.
+	SyncFdatasync
+	// Never sync the appends, they survive a process crash but may be lost
+	// or torn by a power loss. Only for testing and benchmarking.
+	SyncNone
+)
+
+func (m SyncMode) String() string {
+	switch m {
+	case SyncFsync:
+		return "fsync"
+	case SyncFdatasync:
+		return "fdatasync"
+	case SyncNone:
+		return "none"
+	}
+	return fmt.Sprintf("SyncMode(%d)", int(m))
+}
+
+// MetricsSink receives the metrics of a logdb, it should be safe for
+// concurrent use and should never block.
+type MetricsSink interface {
+	// Add delta to the counter of name.
+	AddCounter(name string, delta uint64)
+	// Record one sample of the latency of name.
+	ObserveLatency(name string, d time.Duration)
+}
+
+// The names of the metrics reported to Options.Metrics.
+const (
+	// counters of the successful appends and their bytes of values
+	MetricAppendCt    = "logdb_append_total"
+	MetricAppendBytes = "logdb_append_bytes_total"
+	// latency of the successful AppendAndSync3, including the syncs
+	MetricAppendLatency = "logdb_append_seconds"
+	// latency of every sync of the appends
+	MetricSyncLatency = "logdb_sync_seconds"
+	// counters of the values read by GetValueByIdx, and those of them served
+	// by the cache
+	MetricReadCt     = "logdb_read_total"
+	MetricCacheHitCt = "logdb_cache_hit_total"
+	// counters of the segments rolled out and unlinked
+	MetricSegmentCreateCt = "logdb_segment_create_total"
+	MetricSegmentRemoveCt = "logdb_segment_remove_total"
+)
+
+type discardMetrics struct{}
+
+func (discardMetrics) AddCounter(name string, delta uint64)        {}
+func (discardMetrics) ObserveLatency(name string, d time.Duration) {}
+
+// Option sets one member of Options, see NewOptions.
+type Option func(o *Options)
+
+// NewOptions returns the Options set by opts in order.
+func NewOptions(opts ...Option) *Options {
+	o := new(Options)
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+func WithSegmentSize(size uint64) Option {
+	return func(o *Options) { o.SegmentSize = size }
+}
+
+func WithGroupCommitter(g *GroupCommitter) Option {
+	return func(o *Options) { o.GroupCommitter = g }
+}
+
+func WithMmapRead() Option {
+	return func(o *Options) { o.MmapRead = true }
+}
+
+func WithCompression(codec Codec, minSize int) Option {
+	return func(o *Options) {
+		o.Compression = codec
+		o.CompressionMinSize = minSize
+	}
+}
+
+func WithKeyProvider(keys KeyProvider) Option {
+	return func(o *Options) { o.KeyProvider = keys }
+}
+
+func WithPreallocateSize(size uint64) Option {
+	return func(o *Options) { o.PreallocateSize = size }
+}
+
+func WithSyncMode(mode SyncMode) Option {
+	return func(o *Options) { o.SyncMode = mode }
+}
+
+func WithDirectIO() Option {
+	return func(o *Options) { o.DirectIO = true }
+}
+
+func WithSkipReadChecksum() Option {
+	return func(o *Options) { o.SkipReadChecksum = true }
+}
+
+func WithCacheSize(size uint64) Option {
+	return func(o *Options) { o.CacheSize = size }
+}
+
+func WithReadOnly() Option {
+	return func(o *Options) { o.ReadOnly = true }
+}
+
+func WithLogger(logger log.Logger) Option {
+	return func(o *Options) { o.Logger = logger }
+}
+
+func WithMetrics(metrics MetricsSink) Option {
+	return func(o *Options) { o.Metrics = metrics }
+}
+
+// check rejects the opts which could not be honoured.
+func (o *Options) check() error {
+	if o != nil && !o.Compression.supportedFlag() {
+		return fmt.Errorf("unsupported Options.Compression: %v", o.Compression)
+	}
+	return nil
+}
+
+func (o *Options) withDefaults() Options {
+	var ret Options
+	if o != nil {
+		ret = *o
+	}
+	if ret.SegmentSize == 0 {
+		ret.SegmentSize = DefaultSegmentSize
+	}
+	if ret.SegmentSize > MaxSegmentSize {
+		ret.SegmentSize = MaxSegmentSize
+	}
+	if ret.CompressionMinSize == 0 {
+		ret.CompressionMinSize = DefaultCompressionMinSize
+	}
+	if ret.Logger == nil {
+		ret.Logger = log.NewDiscard()
+	}
+	if ret.Metrics == nil {
+		ret.Metrics = discardMetrics{}
+	}
+	return ret
+}
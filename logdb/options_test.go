@@ -0,0 +1,66 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadOnlyRejectsWrites(t *testing.T) {
+	const n = 4
+	dirPath := newTestDB(t, n)
+	if _, err := CreateDBWithOptions(filepath.Join(t.TempDir(), "db"), NewOptions(WithReadOnly())); err == nil {
+		t.Fatal("expect an error creating a read only logdb")
+	}
+	path := headSegmentPath(dirPath)
+	before := readFileAt(t, path, 0, int(fileSize(t, path)))
+
+	db, err := OpenDBIfExistWithOptions(dirPath, NewOptions(WithReadOnly()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writes := []struct {
+		name string
+		fn   func() error
+	}{
+		{"AppendAndSync", func() error { return db.AppendAndSync(n+1, [][]byte{testValue(n + 1)}) }},
+		{"AppendAndSync3", func() error { return db.AppendAndSync3(n+1, nil, 2) }},
+		{"AppendAsync", func() error { return db.AppendAsync(n+1, [][]byte{testValue(n + 1)}).Wait() }},
+		{"TruncateFrom", func() error { return db.TruncateFrom(2) }},
+		{"Compact", func() error { return db.(Compactor).Compact() }},
+	}
+	for _, w := range writes {
+		if err := w.fn(); err == nil {
+			t.Fatalf("%s: expect an error on a read only logdb", w.name)
+		}
+	}
+	leftIdx, toAppendIdx := db.GetCurrentIdxRange()
+	if leftIdx != 1 || toAppendIdx != n+1 {
+		t.Fatalf("got idx range [%d, %d)", leftIdx, toAppendIdx)
+	}
+	for i := 1; i <= n; i++ {
+		v, err := db.GetValueByIdx(uint64(i))
+		if err != nil || !bytes.Equal(v, testValue(i)) {
+			t.Fatalf("idx %d got %q %v", i, v, err)
+		}
+	}
+	db.Close()
+	if after := readFileAt(t, path, 0, int(fileSize(t, path))); !bytes.Equal(before, after) {
+		t.Fatal("the read only logdb modified the segment file")
+	}
+	checkTestDB(t, dirPath, n)
+}
@@ -0,0 +1,355 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestDB creates a single-segment logdb holding the values of idx [1, n].
+func newTestDB(t *testing.T, n int) (dirPath string) {
+	t.Helper()
+	dirPath = filepath.Join(t.TempDir(), "db")
+	db, err := CreateDB(dirPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= n; i++ {
+		err = db.AppendAndSync(uint64(i), [][]byte{testValue(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dirPath
+}
+
+func testValue(i int) []byte {
+	return []byte(fmt.Sprintf("value-%d", i))
+}
+
+func headSegmentPath(dirPath string) string {
+	return filepath.Join(dirPath, segmentFileName(1))
+}
+
+func readFileAt(t *testing.T, path string, pos int64, n int) []byte {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	bs := make([]byte, n)
+	_, err = f.ReadAt(bs, pos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bs
+}
+
+func writeFileAt(t *testing.T, path string, pos int64, bs []byte) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = f.WriteAt(bs, pos)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func truncateFile(t *testing.T, path string, size int64) {
+	t.Helper()
+	err := os.Truncate(path, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Size()
+}
+
+// checkTestDB opens dirPath and checks it holds exactly the values of idx
+// [1, n], and that it still accepts appends.
+func checkTestDB(t *testing.T, dirPath string, n int) {
+	t.Helper()
+	db, err := OpenDBIfExist(dirPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	leftIdx, toAppendIdx := db.GetCurrentIdxRange()
+	if leftIdx != 1 || toAppendIdx != uint64(n+1) {
+		t.Fatalf("got idx range [%d, %d) but expect [1, %d)", leftIdx, toAppendIdx, n+1)
+	}
+	for i := 1; i <= n; i++ {
+		v, err := db.GetValueByIdx(uint64(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(v, testValue(i)) {
+			t.Fatalf("idx %d got %q", i, v)
+		}
+	}
+	err = db.AppendAndSync(uint64(n+1), [][]byte{testValue(n + 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := db.GetValueByIdx(uint64(n + 1))
+	if err != nil || !bytes.Equal(v, testValue(n+1)) {
+		t.Fatalf("idx %d got %q, %v", n+1, v, err)
+	}
+}
+
+// The power loss in the middle of AppendAndSync3 leaves the records and
+// directory entries written but not committed by Meta, in any part.
+func TestRecoverUncommittedTail(t *testing.T) {
+	const n = 3
+	cases := []struct {
+		name string
+		// applied to the segment of a logdb holding [1, n] whose last
+		// append of idx n is rolled back to uncommitted
+		tear func(t *testing.T, path string, meta fileMeta)
+	}{
+		{"whole batch", func(t *testing.T, path string, meta fileMeta) {}},
+		{"directory entry never written", func(t *testing.T, path string, meta fileMeta) {
+			writeFileAt(t, path, int64(meta.directoryNextPos), make([]byte, directoryEntryLen))
+		}},
+		{"torn directory entry", func(t *testing.T, path string, meta fileMeta) {
+			writeFileAt(t, path, int64(meta.directoryNextPos)+directoryEntryLen/2, make([]byte, directoryEntryLen/2))
+		}},
+		{"torn record", func(t *testing.T, path string, meta fileMeta) {
+			truncateFile(t, path, int64(meta.dataNextPos)+recordHeaderLen/2)
+		}},
+		{"garbage after data", func(t *testing.T, path string, meta fileMeta) {
+			writeFileAt(t, path, fileSize(t, path), bytes.Repeat([]byte{0xff}, 4096))
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dirPath := newTestDB(t, n-1)
+			path := headSegmentPath(dirPath)
+			oldMetaBs := readFileAt(t, path, metaPos, metaLen)
+			var oldMeta fileMeta
+			err := oldMeta.decode(oldMetaBs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			db, err := OpenDBIfExist(dirPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = db.AppendAndSync(n, [][]byte{testValue(n)})
+			if err == nil {
+				err = db.Close()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// roll back the commit point
+			writeFileAt(t, path, metaPos, oldMetaBs)
+			c.tear(t, path, oldMeta)
+
+			checkTestDB(t, dirPath, n-1)
+			if size := fileSize(t, path); size < int64(oldMeta.dataNextPos) {
+				t.Fatalf("file size %d < DataNextPos %d", size, oldMeta.dataNextPos)
+			}
+		})
+	}
+}
+
+func TestRecoverCorruption(t *testing.T) {
+	const n = 3
+	cases := []struct {
+		name    string
+		corrupt func(t *testing.T, path string, meta fileMeta)
+		expect  error
+	}{
+		{"empty file", func(t *testing.T, path string, meta fileMeta) {
+			truncateFile(t, path, 0)
+		}, ErrBadFileHeader},
+		{"header checksum", func(t *testing.T, path string, meta fileMeta) {
+			writeFileAt(t, path, headerPos+6, []byte{0xff})
+		}, ErrBadFileHeader},
+		{"torn meta", func(t *testing.T, path string, meta fileMeta) {
+			writeFileAt(t, path, metaPos+metaLen/2, make([]byte, metaLen/2))
+		}, ErrCorruptMeta},
+		{"zeroed meta sector", func(t *testing.T, path string, meta fileMeta) {
+			writeFileAt(t, path, metaPos, make([]byte, 512))
+		}, ErrCorruptMeta},
+		{"meta cut off", func(t *testing.T, path string, meta fileMeta) {
+			truncateFile(t, path, metaPos+metaLen-1)
+		}, ErrCorruptMeta},
+		{"directory area cut off", func(t *testing.T, path string, meta fileMeta) {
+			truncateFile(t, path, int64(meta.directoryNextPos))
+		}, ErrTruncatedDirectory},
+		{"committed data cut off", func(t *testing.T, path string, meta fileMeta) {
+			truncateFile(t, path, int64(meta.dataNextPos)-1)
+		}, ErrTruncatedDirectory},
+		{"committed directory entry zeroed", func(t *testing.T, path string, meta fileMeta) {
+			writeFileAt(t, path, int64(meta.directoryNextPos)-directoryEntryLen, make([]byte, directoryEntryLen))
+		}, ErrCorruptDirectory},
+		{"committed directory entry out of data area", func(t *testing.T, path string, meta fileMeta) {
+			e := directoryEntry{idx: n, pos: meta.dataNextPos, length: recordHeaderLen}
+			bs := make([]byte, directoryEntryLen)
+			e.encodeTo(bs)
+			writeFileAt(t, path, int64(meta.directoryNextPos)-directoryEntryLen, bs)
+		}, ErrCorruptDirectory},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dirPath := newTestDB(t, n)
+			path := headSegmentPath(dirPath)
+			var meta fileMeta
+			err := meta.decode(readFileAt(t, path, metaPos, metaLen))
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.corrupt(t, path, meta)
+			size := fileSize(t, path)
+			db, err := OpenDBIfExist(dirPath)
+			if err == nil {
+				db.Close()
+				t.Fatalf("expect %v but got nil", c.expect)
+			}
+			if !errors.Is(err, c.expect) {
+				t.Fatalf("expect %v but got %v", c.expect, err)
+			}
+			// nothing is modified by a failed open
+			if fileSize(t, path) != size {
+				t.Fatalf("file size changed from %d to %d", size, fileSize(t, path))
+			}
+		})
+	}
+}
+
+// A corrupted record is only found by the reads and Verify, the others are
+// still readable.
+func TestRecoverCorruptRecord(t *testing.T) {
+	const n = 3
+	dirPath := newTestDB(t, n)
+	path := headSegmentPath(dirPath)
+	var meta fileMeta
+	err := meta.decode(readFileAt(t, path, metaPos, metaLen))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFileAt(t, path, int64(meta.dataNextPos)-1, []byte{0xff})
+
+	db, err := OpenDBIfExist(dirPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.GetValueByIdx(n)
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expect %v but got %v", ErrChecksumMismatch, err)
+	}
+	_, err = db.GetValueByIdx(n - 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	r, err := Verify(dirPath)
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expect %v but got %v", ErrChecksumMismatch, err)
+	}
+	if r.CheckedCt != n || len(r.CorruptIdxs) != 1 || r.CorruptIdxs[0] != n {
+		t.Fatalf("got %+v", r)
+	}
+}
+
+// The crash in the middle of Compact leaves the replaced head segment, and
+// the wholly deleted segments before it which are not unlinked yet.
+func TestRecoverInterruptedCompact(t *testing.T) {
+	cases := []struct {
+		name string
+		// the segments put back after the compaction
+		restoreFirstIdxs []uint64
+	}{
+		{"head segment", []uint64{4}},
+		{"deleted and head segments", []uint64{1, 4}},
+		{"deleted segment", []uint64{1}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dirPath := filepath.Join(t.TempDir(), "db")
+			db, err := CreateDBWithOptions(dirPath, NewOptions(WithSegmentSize(1)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// one segment for each batch: [1, 4) [4, 7) [7, 10) [10, 11)
+			for i := 1; i < 10; i += 3 {
+				err = db.AppendAndSync(uint64(i), [][]byte{testValue(i), testValue(i + 1), testValue(i + 2)})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			saved := make(map[uint64][]byte)
+			for _, firstIdx := range c.restoreFirstIdxs {
+				path := filepath.Join(dirPath, segmentFileName(firstIdx))
+				saved[firstIdx] = readFileAt(t, path, 0, int(fileSize(t, path)))
+			}
+			err = db.AppendAndSync3(10, [][]byte{testValue(10)}, 6)
+			if err == nil {
+				err = db.(Compactor).Compact()
+			}
+			if err == nil {
+				err = db.Close()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			firstIdxs, err := listSegments(dirPath)
+			if err != nil || len(firstIdxs) != 3 || firstIdxs[0] != 6 {
+				t.Fatalf("got segments %v %v", firstIdxs, err)
+			}
+			for firstIdx, bs := range saved {
+				err = ioutil.WriteFile(filepath.Join(dirPath, segmentFileName(firstIdx)), bs, 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			db, err = OpenDBIfExist(dirPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			checkMemDB(t, db, 6, 11)
+			firstIdxs, err = listSegments(dirPath)
+			if err != nil || len(firstIdxs) != 3 || firstIdxs[0] != 6 {
+				t.Fatalf("the stale segments are not removed: %v %v", firstIdxs, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,642 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/turingcell/veela/util"
+)
+
+// One segment is one file with the format described in format.go, it holds
+// the records of idx [firstIdx, firstIdx+len(directory)).
+//
+// meta and directory are guarded by the mux of the fileDB which owns the
+// segment, the other members are read only.
+type segment struct {
+	path      string
+	f         *os.File
+	firstIdx  uint64
+	fileFlags uint16
+	// nil if Options.KeyProvider is not set
+	enc *encryptor
+	// see openSegment
+	keylessFlag bool
+
+	meta fileMeta
+	// directory[i].idx == firstIdx + i
+	directory []directoryEntry
+
+	// the read-only mapping of the whole file if Options.MmapRead is set
+	mapped []byte
+	// set by fileDB.setupSegments from Options
+	preallocateSize  uint64
+	syncMode         SyncMode
+	skipChecksumFlag bool
+	direct           *directWriter
+	metrics          MetricsSink
+	// the end of the preallocated data area, zero if unknown. Only used by
+	// the writer.
+	preallocatedEnd uint64
+	// counters of the owner, nil if there is none
+	stats *statCounters
+
+	// readers which are reading the file without holding fileDB.mux,
+	// including the unreleased leases
+	readers sync.WaitGroup
+}
+
+func segmentFileName(firstIdx uint64) string {
+	return fmt.Sprintf("%020d%s", firstIdx, segmentFileSuffix)
+}
+
+func parseSegmentFileName(name string) (firstIdx uint64, ok bool) {
+	if !strings.HasSuffix(name, segmentFileSuffix) {
+		return 0, false
+	}
+	u64, err := strconv.ParseUint(strings.TrimSuffix(name, segmentFileSuffix), 10, 64)
+	if err != nil || u64 == 0 || segmentFileName(u64) != name {
+		return 0, false
+	}
+	return u64, true
+}
+
+// listSegments returns firstIdx of all the segments under dirPath in ascending order.
+func listSegments(dirPath string) ([]uint64, error) {
+	d, err := os.Open(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		return nil, err
+	}
+	var firstIdxs []uint64
+	for _, name := range names {
+		firstIdx, ok := parseSegmentFileName(name)
+		if ok {
+			firstIdxs = append(firstIdxs, firstIdx)
+		}
+	}
+	sort.Slice(firstIdxs, func(i, j int) bool { return firstIdxs[i] < firstIdxs[j] })
+	return firstIdxs, nil
+}
+
+func syncDir(dirPath string, stats *statCounters) error {
+	d, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	stats.addSync()
+	err = d.Sync()
+	if err != nil {
+		d.Close()
+		return err
+	}
+	return d.Close()
+}
+
+// The file is initialized under a temporary name and renamed at last, thus a
+// crash in the middle never leaves a half-initialized segment.
+func createSegment(dirPath string, firstIdx uint64, deletedIdx uint64, stats *statCounters, enc *encryptor) (*segment, error) {
+	path := filepath.Join(dirPath, segmentFileName(firstIdx))
+	tmpPath := path + tmpFileSuffix
+	f, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s := &segment{
+		path:     path,
+		f:        f,
+		firstIdx: firstIdx,
+		enc:      enc,
+		meta: fileMeta{
+			dataNextPos:      dataAreaPos,
+			directoryNextPos: directoryAreaPos,
+			deletedIdx:       deletedIdx,
+		},
+		stats: stats,
+	}
+	if enc != nil {
+		s.fileFlags = fileFlagEncrypted
+	}
+	err = s.initFile()
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err == nil {
+		err = syncDir(dirPath, stats)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *segment) initFile() error {
+	// the directory area stays sparse until it is used
+	err := s.f.Truncate(dataAreaPos)
+	if err != nil {
+		return err
+	}
+	_, err = s.f.WriteAt(encodeHeader(s.firstIdx, s.fileFlags), headerPos)
+	if err != nil {
+		return err
+	}
+	bs, err := s.encodeMeta(s.meta)
+	if err != nil {
+		return err
+	}
+	_, err = s.f.WriteAt(bs, metaPos)
+	if err != nil {
+		return err
+	}
+	s.stats.addMeta(headerLen + len(bs))
+	return s.sync()
+}
+
+// With readOnlyFlag, the segment is only validated and nothing would be
+// modified. Otherwise it also recovers the segment from a crash in the middle
+// of an append, everything beyond DataNextPos and DirectoryNextPos was never
+// committed by Meta, so it is cut off here.
+//
+// If keylessFlag is set and enc is nil, the fields of an encrypted Meta are
+// used without being authenticated, which is only for the Inspector to check
+// the checksums without the keys.
+func openSegment(dirPath string, firstIdx uint64, readOnlyFlag bool, keylessFlag bool, stats *statCounters, enc *encryptor) (*segment, error) {
+	path := filepath.Join(dirPath, segmentFileName(firstIdx))
+	var f *os.File
+	var err error
+	if readOnlyFlag {
+		f, err = os.Open(path)
+	} else {
+		f, err = os.OpenFile(path, os.O_RDWR, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := &segment{
+		path:        path,
+		f:           f,
+		firstIdx:    firstIdx,
+		enc:         enc,
+		keylessFlag: keylessFlag,
+		stats:       stats,
+	}
+	fi, err := f.Stat()
+	if err == nil {
+		err = s.readState(fi.Size())
+	}
+	if err == nil && !readOnlyFlag {
+		err = s.cutUncommittedTail(fi.Size())
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("segment %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// readState loads header, meta and the committed directory entries and
+// validates them, but never modifies the file.
+func (s *segment) readState(fileSize int64) error {
+	if fileSize < headerLen {
+		return corruptionf(ErrBadFileHeader, "file size %d is too small", fileSize)
+	}
+	bs := make([]byte, headerLen)
+	_, err := s.f.ReadAt(bs, headerPos)
+	if err != nil {
+		return err
+	}
+	firstIdx, fileFlags, err := decodeHeader(bs)
+	if err != nil {
+		return err
+	}
+	if firstIdx != s.firstIdx {
+		return corruptionf(ErrBadFileHeader, "FirstIdx %d in header does not match with the file name", firstIdx)
+	}
+	s.fileFlags = fileFlags
+	n := metaLen
+	if s.fileFlags&fileFlagEncrypted != 0 {
+		n = encryptedMetaLen
+	}
+	if fileSize < metaPos+int64(n) {
+		return corruptionf(ErrCorruptMeta, "file size %d is too small", fileSize)
+	}
+	bs = make([]byte, n)
+	_, err = s.f.ReadAt(bs, metaPos)
+	if err != nil {
+		return err
+	}
+	err = s.decodeMeta(bs)
+	if err != nil {
+		return err
+	}
+	if fileSize < dataAreaPos {
+		return corruptionf(ErrTruncatedDirectory, "file size %d is less than the beginning of data area %d",
+			fileSize, dataAreaPos)
+	}
+	if fileSize < int64(s.meta.dataNextPos) {
+		return corruptionf(ErrTruncatedDirectory, "file size %d is less than DataNextPos %d",
+			fileSize, s.meta.dataNextPos)
+	}
+
+	entryCt := int(s.meta.directoryNextPos-directoryAreaPos) / directoryEntryLen
+	bs = make([]byte, entryCt*directoryEntryLen)
+	_, err = s.f.ReadAt(bs, directoryAreaPos)
+	if err != nil {
+		return err
+	}
+	s.directory = make([]directoryEntry, entryCt)
+	nextPos := uint64(dataAreaPos)
+	for i := range s.directory {
+		e := &s.directory[i]
+		e.decode(bs[i*directoryEntryLen:])
+		if e.idx != s.firstIdx+uint64(i) {
+			return corruptionf(ErrCorruptDirectory, "directory entry %d got idx %d but expect %d",
+				i, e.idx, s.firstIdx+uint64(i))
+		}
+		if e.length < recordHeaderLen ||
+			uint64(e.pos) < nextPos || uint64(e.pos)+uint64(e.length) > uint64(s.meta.dataNextPos) {
+			return corruptionf(ErrCorruptDirectory, "directory entry of idx %d points to [%d, %d) which is out of [%d, %d)",
+				e.idx, e.pos, uint64(e.pos)+uint64(e.length), nextPos, s.meta.dataNextPos)
+		}
+		nextPos = uint64(e.pos) + uint64(e.length)
+	}
+	return nil
+}
+
+func (s *segment) cutUncommittedTail(fileSize int64) error {
+	dirty := false
+	if fileSize > int64(s.meta.dataNextPos) {
+		err := s.f.Truncate(int64(s.meta.dataNextPos))
+		if err != nil {
+			return err
+		}
+		dirty = true
+	}
+	// Uncommitted directory entries are continuous from DirectoryNextPos, and
+	// idx of a valid entry is never zero.
+	const batchEntryCt = 256
+	pos := int64(s.meta.directoryNextPos)
+	zeroBs := make([]byte, batchEntryCt*directoryEntryLen)
+	bs := make([]byte, batchEntryCt*directoryEntryLen)
+	for pos < dataAreaPos {
+		n := len(bs)
+		if int64(n) > dataAreaPos-pos {
+			n = int(dataAreaPos - pos)
+		}
+		_, err := s.f.ReadAt(bs[:n], pos)
+		if err != nil {
+			return err
+		}
+		usedN := 0
+		for usedN < n && util.BsReadU64(bs[usedN:]) != 0 {
+			usedN += directoryEntryLen
+		}
+		if usedN > 0 {
+			_, err = s.f.WriteAt(zeroBs[:usedN], pos)
+			if err != nil {
+				return err
+			}
+			s.stats.addDirectory(usedN)
+			dirty = true
+		}
+		if usedN < n {
+			break
+		}
+		pos += int64(n)
+	}
+	if dirty {
+		return s.sync()
+	}
+	return nil
+}
+
+// footprint is the bytes of the header area and the used directory and data
+// areas, the unused directory area is sparse.
+func (s *segment) footprint() uint64 {
+	return directoryAreaPos + uint64(s.meta.directoryNextPos-directoryAreaPos) + uint64(s.meta.dataNextPos-dataAreaPos)
+}
+
+// mmap maps the max size of a segment file, the range beyond the end of
+// file is never accessed.
+func (s *segment) mmap() error {
+	if strconv.IntSize < 64 {
+		return fmt.Errorf("mmap read mode needs a 64-bit platform")
+	}
+	length := uint64(maxFileSize)
+	bs, err := mmapFile(s.f, int(length))
+	if err != nil {
+		return err
+	}
+	s.mapped = bs
+	return nil
+}
+
+func (s *segment) close() error {
+	if s.mapped != nil {
+		munmapFile(s.mapped)
+		s.mapped = nil
+	}
+	if s.direct != nil {
+		s.direct.close()
+		s.direct = nil
+	}
+	return s.f.Close()
+}
+
+func (s *segment) toAppendIdx() uint64 {
+	return s.firstIdx + uint64(len(s.directory))
+}
+
+func (s *segment) encodeMeta(meta fileMeta) ([]byte, error) {
+	if s.fileFlags&fileFlagEncrypted == 0 {
+		return meta.encode(), nil
+	}
+	fields := meta.encodeFields()
+	tag, err := s.enc.seal(nil, metaAdditionalData(s.firstIdx, fields))
+	if err != nil {
+		return nil, err
+	}
+	return appendChecksum(append(fields, tag...)), nil
+}
+
+// decodeMeta decodes bs into s.meta, the checksum is verified before the
+// authentication.
+func (s *segment) decodeMeta(bs []byte) error {
+	if s.fileFlags&fileFlagEncrypted == 0 {
+		return s.meta.decode(bs)
+	}
+	util.AssertTrue(len(bs) == encryptedMetaLen)
+	body := bs[:len(bs)-4]
+	if util.BsReadU32(bs[len(body):]) != checksum(body) {
+		return corruptionf(ErrCorruptMeta, "%v", ErrChecksumMismatch)
+	}
+	fields := body[:metaFieldsLen]
+	if s.enc != nil {
+		_, err := s.enc.open(body[metaFieldsLen:], metaAdditionalData(s.firstIdx, fields))
+		if err != nil {
+			return err
+		}
+	} else if !s.keylessFlag {
+		return fmt.Errorf("%w: the Meta is encrypted but there is no KeyProvider", ErrDecrypt)
+	}
+	return s.meta.decodeFields(fields)
+}
+
+// decodeRecordValue decodes the record, then decrypts and decompresses its
+// data by the Flags. sharedFlag is true if v shares the underlying array
+// with bs.
+func (s *segment) decodeRecordValue(bs []byte, idx uint64) (v []byte, sharedFlag bool, e error) {
+	flags, data, err := decodeRecord(bs, idx, !s.skipChecksumFlag)
+	if err != nil {
+		return nil, false, err
+	}
+	if flags&recordFlagEncrypted == 0 {
+		return decodeValue(flags, data, idx)
+	}
+	if s.enc == nil {
+		return nil, false, fmt.Errorf("%w: record of idx %d is encrypted but there is no KeyProvider", ErrDecrypt, idx)
+	}
+	data, err = s.enc.open(data, recordAdditionalData(flags, idx))
+	if err != nil {
+		return nil, false, fmt.Errorf("record of idx %d: %w", idx, err)
+	}
+	v, _, err = decodeValue(flags&^recordFlagEncrypted, data, idx)
+	return v, false, err
+}
+
+func (s *segment) readRecord(entry directoryEntry) ([]byte, error) {
+	if s.mapped != nil {
+		v, sharedFlag, err := s.readRecordMapped(entry)
+		if err != nil {
+			return nil, err
+		}
+		if sharedFlag {
+			v = append(make([]byte, 0, len(v)), v...)
+		}
+		return v, nil
+	}
+	bs := make([]byte, entry.length)
+	_, err := s.f.ReadAt(bs, int64(entry.pos))
+	if err != nil {
+		return nil, err
+	}
+	v, _, err := s.decodeRecordValue(bs, entry.idx)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// readRecordMapped returns the value inside the mapping without copying
+// unless the record is compressed, then sharedFlag is false. s.mapped should
+// not be nil.
+func (s *segment) readRecordMapped(entry directoryEntry) (v []byte, sharedFlag bool, e error) {
+	return s.decodeRecordValue(s.mapped[entry.pos:entry.pos+entry.length], entry.idx)
+}
+
+// readRecords reads the records of continuous entries with as few sequential
+// reads as possible, each read is up to readAheadBytes unless a single record
+// is larger than it.
+func (s *segment) readRecords(entries []directoryEntry, readAheadBytes uint64) ([][]byte, error) {
+	vArray := make([][]byte, 0, len(entries))
+	for len(entries) > 0 {
+		if s.mapped != nil {
+			v, err := s.readRecord(entries[0])
+			if err != nil {
+				return nil, err
+			}
+			vArray = append(vArray, v)
+			entries = entries[1:]
+			continue
+		}
+		beginPos := uint64(entries[0].pos)
+		n := 1
+		for n < len(entries) && uint64(entries[n].pos)+uint64(entries[n].length)-beginPos <= readAheadBytes {
+			n++
+		}
+		last := entries[n-1]
+		bs := make([]byte, uint64(last.pos)+uint64(last.length)-beginPos)
+		_, err := s.f.ReadAt(bs, int64(beginPos))
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries[:n] {
+			off := uint64(entry.pos) - beginPos
+			v, _, err := s.decodeRecordValue(bs[off:off+uint64(entry.length)], entry.idx)
+			if err != nil {
+				return nil, err
+			}
+			// values share bs, cap them so that appending one never overwrites the next
+			vArray = append(vArray, v[:len(v):len(v)])
+		}
+		entries = entries[n:]
+	}
+	return vArray, nil
+}
+
+func recordsLen(vArray [][]byte) (n uint64) {
+	for _, v := range vArray {
+		n += recordHeaderLen + uint64(len(v))
+	}
+	return
+}
+
+// canHold reports whether vArray could be appended into this segment without
+// exceeding segmentSize. A segment without any entry only has the hard
+// limits, which may still hold data after a TruncateFrom to its firstIdx.
+func (s *segment) canHold(meta fileMeta, vArray [][]byte, segmentSize uint64) bool {
+	entryCt := int(meta.directoryNextPos-directoryAreaPos)/directoryEntryLen + len(vArray)
+	if entryCt > directoryAreaCap {
+		return false
+	}
+	dataLen := uint64(meta.dataNextPos-dataAreaPos) + recordsLen(vArray)
+	if dataLen > maxFileSize-dataAreaPos {
+		return false
+	}
+	return meta.directoryNextPos == directoryAreaPos || dataLen <= segmentSize
+}
+
+// writeRecords writes the records and their directory entries after the
+// positions in meta, but neither syncs nor commits them. The returned meta
+// would commit them once it is written by writeMeta. flags[i] is the Flags of
+// the record of dataArray[i], a nil flags means all zero.
+func (s *segment) writeRecords(meta fileMeta, appendAtIdx uint64, dataArray [][]byte, flags []uint16) ([]directoryEntry, fileMeta, error) {
+	dataLen := recordsLen(dataArray)
+	entries := make([]directoryEntry, len(dataArray))
+	dataBs := make([]byte, dataLen)
+	dirBs := make([]byte, len(dataArray)*directoryEntryLen)
+	pos := meta.dataNextPos
+	for i, data := range dataArray {
+		entries[i] = directoryEntry{
+			idx:    appendAtIdx + uint64(i),
+			pos:    pos,
+			length: util.IntToUint32Assert(recordHeaderLen + len(data)),
+		}
+		entries[i].encodeTo(dirBs[i*directoryEntryLen:])
+		off := pos - meta.dataNextPos
+		var recordFlags uint16
+		if flags != nil {
+			recordFlags = flags[i]
+		}
+		encodeRecordTo(dataBs[off:off+entries[i].length], recordFlags, entries[i].idx, data)
+		pos += entries[i].length
+	}
+	err := s.preallocate(uint64(meta.dataNextPos), uint64(pos))
+	var n int
+	if err == nil {
+		n, err = s.writeAt(dataBs, int64(meta.dataNextPos))
+	}
+	if err == nil {
+		s.stats.addData(n)
+		n, err = s.writeAt(dirBs, int64(meta.directoryNextPos))
+	}
+	if err != nil {
+		return nil, meta, err
+	}
+	s.stats.addDirectory(n)
+	meta.dataNextPos = pos
+	meta.directoryNextPos += util.IntToUint32Assert(len(dirBs))
+	return entries, meta, nil
+}
+
+func (s *segment) writeMeta(meta fileMeta) error {
+	bs, err := s.encodeMeta(meta)
+	if err != nil {
+		return err
+	}
+	n, err := s.writeAt(bs, metaPos)
+	if err != nil {
+		return err
+	}
+	s.stats.addMeta(n)
+	return nil
+}
+
+// writeAt returns the bytes physically written, which are the aligned blocks
+// with Options.DirectIO.
+func (s *segment) writeAt(bs []byte, pos int64) (int, error) {
+	if s.direct != nil {
+		return s.direct.writeAt(bs, pos)
+	}
+	return s.f.WriteAt(bs, pos)
+}
+
+// preallocate makes sure the data area is allocated up to end, it allocates
+// in steps of preallocateSize from pos.
+func (s *segment) preallocate(pos uint64, end uint64) error {
+	if s.preallocateSize == 0 || end <= s.preallocatedEnd {
+		return nil
+	}
+	newEnd := dataAreaPos + (end-dataAreaPos+s.preallocateSize-1)/s.preallocateSize*s.preallocateSize
+	if newEnd > maxFileSize {
+		newEnd = maxFileSize
+	}
+	err := fallocate(s.f, int64(pos), int64(newEnd-pos))
+	if err != nil {
+		return err
+	}
+	s.preallocatedEnd = newEnd
+	return nil
+}
+
+// trimPreallocated cuts the preallocated space after DataNextPos, once no
+// more records would be appended into s.
+func (s *segment) trimPreallocated(meta fileMeta) error {
+	if s.preallocatedEnd <= uint64(meta.dataNextPos) {
+		return nil
+	}
+	err := s.f.Truncate(int64(meta.dataNextPos))
+	if err != nil {
+		return err
+	}
+	s.preallocatedEnd = 0
+	return nil
+}
+
+func (s *segment) sync() error {
+	s.stats.addSync()
+	return s.f.Sync()
+}
+
+// syncData is the sync committing the appends by syncMode, the file is
+// neither created nor shrunk since the last sync, so fdatasync is enough.
+func (s *segment) syncData() error {
+	if s.syncMode == SyncNone {
+		return nil
+	}
+	start := time.Now()
+	var err error
+	if s.syncMode == SyncFdatasync {
+		s.stats.addSync()
+		err = fdatasync(s.f)
+	} else {
+		err = s.sync()
+	}
+	s.metrics.ObserveLatency(MetricSyncLatency, time.Since(start))
+	return err
+}
@@ -0,0 +1,95 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+// The appends roll over small segments, and the segments wholly deleted are
+// unlinked.
+func TestSegmentRollAndReclaim(t *testing.T) {
+	const n, deleteBefore = 20, 15
+	dirPath := filepath.Join(t.TempDir(), "db")
+	opts := NewOptions(WithSegmentSize(64))
+	db, err := CreateDBWithOptions(dirPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= n; i++ {
+		err = db.AppendAndSync(uint64(i), [][]byte{testValue(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	firstIdxs, err := listSegments(dirPath)
+	if err != nil || len(firstIdxs) < 4 {
+		t.Fatalf("got segments %v %v", firstIdxs, err)
+	}
+
+	err = db.AppendAndSync3(n+1, [][]byte{testValue(n + 1)}, deleteBefore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leftIdx, toAppendIdx := db.GetCurrentIdxRange()
+	if leftIdx != deleteBefore || toAppendIdx != n+2 {
+		t.Fatalf("got idx range [%d, %d)", leftIdx, toAppendIdx)
+	}
+	// the close waits the reclaim in background
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Stats().ReclaimedBytes == 0 {
+		t.Fatal("nothing is reclaimed")
+	}
+	leftFirstIdxs, err := listSegments(dirPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the segment holding deleteBefore and the ones after are left
+	if len(leftFirstIdxs) == 0 || leftFirstIdxs[0] > deleteBefore ||
+		(len(leftFirstIdxs) > 1 && leftFirstIdxs[1] <= deleteBefore) {
+		t.Fatalf("got segments %v but expect the ones from holding idx %d", leftFirstIdxs, deleteBefore)
+	}
+	if firstIdxs[1] > deleteBefore || leftFirstIdxs[0] == firstIdxs[0] {
+		t.Fatalf("segments %v are not unlinked, %v are left", firstIdxs, leftFirstIdxs)
+	}
+
+	db, err = OpenDBIfExistWithOptions(dirPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	leftIdx, toAppendIdx = db.GetCurrentIdxRange()
+	if leftIdx != deleteBefore || toAppendIdx != n+2 {
+		t.Fatalf("got idx range [%d, %d) after reopen", leftIdx, toAppendIdx)
+	}
+	if _, err = db.GetValueByIdx(deleteBefore - 1); err == nil {
+		t.Fatalf("expect an error reading the deleted idx %d", deleteBefore-1)
+	}
+	err = db.AppendAndSync(n+2, [][]byte{testValue(n + 2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := deleteBefore; i <= n+2; i++ {
+		v, err := db.GetValueByIdx(uint64(i))
+		if err != nil || !bytes.Equal(v, testValue(i)) {
+			t.Fatalf("idx %d got %q %v", i, v, err)
+		}
+	}
+}
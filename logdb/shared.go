@@ -0,0 +1,741 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/turingcell/veela/util"
+)
+
+// SharedLog hosts many logical DB handles (e.g. one per Paxos group or per
+// acceptor) inside one physical logdb. Each handle is keyed by a name and has
+// its own idx space and GetCurrentIdxRange semantics, just like a standalone
+// logdb.
+//
+// Every AppendAndSync3 of a handle is stored as one physical record called
+// envelope. Concurrent AppendAndSync3 calls from different handles are
+// written by one physical AppendAndSync3, thus they share the syncs.
+//
+// The physical prefix is deleted when no handle needs it anymore. A handle
+// needs the envelope of its first live idx, or its last envelope if it has
+// no live idx (to remember its toAppendIdx and deletedIdx). A handle lagging
+// sharedRehomeLag envelopes behind with at most sharedRehomeMaxValues live idx
+// is re-homed by a checkpoint envelope, which appends its live values again
+// at its first live idx (or nothing at its toAppendIdx), so an idle handle
+// does not pin the physical log.
+type SharedLog struct {
+	// read only
+	db *fileDB
+	// bytes of the values appended by all the handles
+	userBytes statCounters
+
+	// protects the members below and all the handle states
+	mux        sync.RWMutex
+	closedFlag bool
+	states     map[string]*sharedHandleState
+
+	pendingMux sync.Mutex
+	pending    []*sharedAppendReq
+	kickCh     chan struct{}
+	loopDone   chan struct{}
+}
+
+type sharedHandleState struct {
+	openFlag   bool
+	deletedIdx uint64
+	// locs[i] is the location of idx firstIdx+i, deleted idx are trimmed, so
+	// firstIdx is always leftIdx
+	firstIdx uint64
+	locs     []sharedValueLoc
+	// physical idx of the last envelope, zero means none
+	lastPhysIdx uint64
+}
+
+type sharedValueLoc struct {
+	physIdx uint64
+	// [off, off+length) of the envelope
+	off    uint32
+	length uint32
+}
+
+const (
+	sharedRehomeLag       = 1024
+	sharedRehomeMaxValues = 64
+)
+
+type sharedAppendReq struct {
+	name        string
+	appendAtIdx uint64
+	deletedIdx  uint64
+	envelope    []byte
+	locs        []sharedValueLoc
+	errCh       chan error
+}
+
+// bs: uint32(ver:0) uint32(lenOfName) uint64(appendAtIdx) uint64(deletedIdx) uint32(ct) Name [uint32(lenOfV) V]...
+// The returned locs hold the offsets inside the envelope and a zero physIdx.
+func encodeEnvelope(name string, appendAtIdx uint64, deletedIdx uint64, vArray [][]byte) ([]byte, []sharedValueLoc) {
+	lenOfBs := 4 + 4 + 8 + 8 + 4 + len(name)
+	for _, v := range vArray {
+		lenOfBs += 4 + len(v)
+	}
+	bs := make([]byte, lenOfBs)
+	util.U32SetBs(bs, 0)
+	util.U32SetBs(bs[4:], util.IntToUint32Assert(len(name)))
+	util.U64SetBs(bs[8:], appendAtIdx)
+	util.U64SetBs(bs[16:], deletedIdx)
+	util.U32SetBs(bs[24:], util.IntToUint32Assert(len(vArray)))
+	off := 28
+	copy(bs[off:], name)
+	off += len(name)
+	locs := make([]sharedValueLoc, len(vArray))
+	for i, v := range vArray {
+		util.U32SetBs(bs[off:], util.IntToUint32Assert(len(v)))
+		off += 4
+		copy(bs[off:], v)
+		locs[i] = sharedValueLoc{
+			off:    util.IntToUint32Assert(off),
+			length: util.IntToUint32Assert(len(v)),
+		}
+		off += len(v)
+	}
+	util.AssertTrue(off == len(bs))
+	return bs, locs
+}
+
+func decodeEnvelope(bs []byte) (name string, appendAtIdx uint64, deletedIdx uint64, locs []sharedValueLoc, e error) {
+	if len(bs) < 28 {
+		return "", 0, 0, nil, fmt.Errorf("len of envelope is too short: %d", len(bs))
+	}
+	if ver := util.BsReadU32(bs); ver != 0 {
+		return "", 0, 0, nil, fmt.Errorf("only support version 0 of envelope but got %d", ver)
+	}
+	lenOfName := uint64(util.BsReadU32(bs[4:]))
+	appendAtIdx = util.BsReadU64(bs[8:])
+	deletedIdx = util.BsReadU64(bs[16:])
+	ct := util.BsReadU32(bs[24:])
+	off := uint64(28)
+	if off+lenOfName > uint64(len(bs)) {
+		return "", 0, 0, nil, fmt.Errorf("lenOfName out of bound")
+	}
+	name = string(bs[off : off+lenOfName])
+	off += lenOfName
+	for i := uint32(0); i < ct; i++ {
+		if off+4 > uint64(len(bs)) {
+			return "", 0, 0, nil, fmt.Errorf("lenOfV out of bound")
+		}
+		lenOfV := uint64(util.BsReadU32(bs[off:]))
+		off += 4
+		if off+lenOfV > uint64(len(bs)) {
+			return "", 0, 0, nil, fmt.Errorf("V out of bound")
+		}
+		locs = append(locs, sharedValueLoc{off: uint32(off), length: uint32(lenOfV)})
+		off += lenOfV
+	}
+	if off != uint64(len(bs)) {
+		return "", 0, 0, nil, fmt.Errorf("envelope got some unparsed bytes")
+	}
+	return name, appendAtIdx, deletedIdx, locs, nil
+}
+
+func CreateSharedLog(dirPathStr string, opts *Options) (*SharedLog, error) {
+	db, err := createFileDB(dirPathStr, opts)
+	if err != nil {
+		return nil, err
+	}
+	sl := newSharedLog(db)
+	go sl.loop()
+	return sl, nil
+}
+
+// The errors are the same with OpenDBIfExist, and ErrCorruptDirectory is also
+// returned if the envelopes of one handle are not continuous.
+func OpenSharedLogIfExist(dirPathStr string, opts *Options) (*SharedLog, error) {
+	db, err := openFileDB(dirPathStr, opts)
+	if err != nil {
+		return nil, err
+	}
+	sl := newSharedLog(db)
+	err = sl.recover()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	go sl.loop()
+	return sl, nil
+}
+
+func newSharedLog(db *fileDB) *SharedLog {
+	return &SharedLog{
+		db:       db,
+		states:   make(map[string]*sharedHandleState),
+		kickCh:   make(chan struct{}, 1),
+		loopDone: make(chan struct{}),
+	}
+}
+
+func (sl *SharedLog) recover() error {
+	leftIdx, toAppendIdx := sl.db.GetCurrentIdxRange()
+	for physIdx := leftIdx; physIdx < toAppendIdx; physIdx++ {
+		bs, err := sl.db.GetValueByIdx(physIdx)
+		if err != nil {
+			return err
+		}
+		name, appendAtIdx, deletedIdx, locs, err := decodeEnvelope(bs)
+		if err != nil {
+			return corruptionf(ErrCorruptDirectory, "envelope of physical idx %d: %v", physIdx, err)
+		}
+		st := sl.states[name]
+		if st == nil {
+			st = &sharedHandleState{firstIdx: appendAtIdx}
+			sl.states[name] = st
+		}
+		if appendAtIdx > st.toAppendIdx() {
+			return corruptionf(ErrCorruptDirectory, "envelope of physical idx %d appends handle %q at %d but expect %d",
+				physIdx, name, appendAtIdx, st.toAppendIdx())
+		}
+		if appendAtIdx < st.firstIdx {
+			// A TruncateFrom into the idx whose envelopes are already
+			// deleted, they are either truncated or deleted later, which is
+			// checked at last.
+			st.firstIdx = appendAtIdx
+			st.locs = nil
+		}
+		for i := range locs {
+			locs[i].physIdx = physIdx
+		}
+		st.apply(physIdx, appendAtIdx, locs, deletedIdx)
+	}
+	for name, st := range sl.states {
+		if st.firstIdx > st.deletedIdx+1 {
+			return corruptionf(ErrCorruptDirectory, "idx [%d, %d) of handle %q are missing",
+				st.deletedIdx+1, st.firstIdx, name)
+		}
+	}
+	return nil
+}
+
+func (st *sharedHandleState) toAppendIdx() uint64 {
+	return st.firstIdx + uint64(len(st.locs))
+}
+
+// pinnedPhysIdx returns the least physical idx this handle still needs.
+func (st *sharedHandleState) pinnedPhysIdx() uint64 {
+	if len(st.locs) > 0 {
+		return st.locs[0].physIdx
+	}
+	return st.lastPhysIdx
+}
+
+// pinnedPhysIdxAfter returns pinnedPhysIdx as if the envelope at physIdx
+// which appends at appendAtIdx and sets deletedIdx was applied.
+func (st *sharedHandleState) pinnedPhysIdxAfter(physIdx uint64, appendAtIdx uint64, deletedIdx uint64) uint64 {
+	firstLiveIdx := st.firstIdx
+	if deletedIdx+1 > firstLiveIdx {
+		firstLiveIdx = deletedIdx + 1
+	}
+	if firstLiveIdx < appendAtIdx {
+		return st.locs[firstLiveIdx-st.firstIdx].physIdx
+	}
+	// either the first live idx is inside this envelope or there is none
+	return physIdx
+}
+
+// An envelope appending before toAppendIdx truncates the idx from
+// appendAtIdx at first, see sharedHandle.TruncateFrom.
+func (st *sharedHandleState) apply(physIdx uint64, appendAtIdx uint64, locs []sharedValueLoc, deletedIdx uint64) {
+	if appendAtIdx < st.toAppendIdx() {
+		st.locs = append([]sharedValueLoc(nil), st.locs[:appendAtIdx-st.firstIdx]...)
+	}
+	st.locs = append(st.locs, locs...)
+	st.lastPhysIdx = physIdx
+	if deletedIdx > st.deletedIdx {
+		st.deletedIdx = deletedIdx
+	}
+	if st.deletedIdx >= st.firstIdx {
+		k := st.deletedIdx + 1 - st.firstIdx
+		st.locs = append([]sharedValueLoc(nil), st.locs[k:]...)
+		st.firstIdx += k
+	}
+}
+
+// Return the names of all the handles which have ever appended anything.
+func (sl *SharedLog) HandleNames() []string {
+	sl.mux.RLock()
+	defer sl.mux.RUnlock()
+	names := make([]string, 0, len(sl.states))
+	for name, st := range sl.states {
+		if st.lastPhysIdx > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// OpenHandle opens the logical DB of name, an unknown name gets an empty DB
+// whose idx starts from 1. One name could only be opened once at the same
+// time.
+func (sl *SharedLog) OpenHandle(name string) (DB, error) {
+	sl.mux.Lock()
+	defer sl.mux.Unlock()
+	if sl.closedFlag {
+		return nil, fmt.Errorf("shared log is already closed")
+	}
+	st := sl.states[name]
+	if st == nil {
+		st = &sharedHandleState{firstIdx: 1}
+		sl.states[name] = st
+	}
+	if st.openFlag {
+		return nil, fmt.Errorf("handle %q is already opened", name)
+	}
+	st.openFlag = true
+	h := &sharedHandle{sl: sl, name: name, st: st}
+	h.async = asyncAppender{
+		appendAndSync3:     h.appendAndSync3,
+		getCurrentIdxRange: h.GetCurrentIdxRange,
+		maxMergeBytes:      sl.db.opts.SegmentSize,
+	}
+	return h, nil
+}
+
+// Stats of the physical logdb, but UserBytes only counts the values appended
+// by the handles without the envelope overhead.
+func (sl *SharedLog) Stats() Stats {
+	s := sl.db.Stats()
+	s.UserBytes = sl.userBytes.snapshot().UserBytes
+	return s
+}
+
+// DeadBytes of the physical logdb.
+func (sl *SharedLog) DeadBytes() uint64 {
+	return sl.db.DeadBytes()
+}
+
+// Compact the physical logdb, the locations kept by the handles are physical
+// idx thus they stay valid.
+func (sl *SharedLog) Compact() error {
+	return sl.db.Compact()
+}
+
+// Close the shared log and the physical logdb. All the handles should be
+// closed before.
+func (sl *SharedLog) Close() error {
+	sl.mux.Lock()
+	if sl.closedFlag {
+		sl.mux.Unlock()
+		return fmt.Errorf("shared log is already closed")
+	}
+	sl.closedFlag = true
+	sl.mux.Unlock()
+
+	sl.pendingMux.Lock()
+	close(sl.kickCh)
+	sl.pendingMux.Unlock()
+	<-sl.loopDone
+	return sl.db.Close()
+}
+
+func (sl *SharedLog) submit(req *sharedAppendReq) error {
+	sl.pendingMux.Lock()
+	sl.mux.RLock()
+	closedFlag := sl.closedFlag
+	sl.mux.RUnlock()
+	if closedFlag {
+		sl.pendingMux.Unlock()
+		return fmt.Errorf("shared log is already closed")
+	}
+	sl.pending = append(sl.pending, req)
+	select {
+	case sl.kickCh <- struct{}{}:
+	default:
+	}
+	sl.pendingMux.Unlock()
+	return <-req.errCh
+}
+
+func (sl *SharedLog) loop() {
+	defer close(sl.loopDone)
+	for range sl.kickCh {
+		sl.pendingMux.Lock()
+		reqs := sl.pending
+		sl.pending = nil
+		sl.pendingMux.Unlock()
+		if len(reqs) > 0 {
+			sl.runRound(reqs)
+		}
+	}
+}
+
+// runRound writes all the reqs by one physical AppendAndSync3. Every handle
+// has at most one req in flight since its AppendAndSync3 is blocking.
+func (sl *SharedLog) runRound(reqs []*sharedAppendReq) {
+	_, physToAppendIdx := sl.db.GetCurrentIdxRange()
+	reqs = append(reqs, sl.rehomeReqs(reqs, physToAppendIdx)...)
+	vArray := make([][]byte, len(reqs))
+	inRound := make(map[string]uint64, len(reqs))
+	for i, req := range reqs {
+		vArray[i] = req.envelope
+		physIdx := physToAppendIdx + uint64(i)
+		for j := range req.locs {
+			req.locs[j].physIdx = physIdx
+		}
+		inRound[req.name] = physIdx
+	}
+
+	// the physical idx less than deleteBefore are needed by nobody
+	deleteBefore := physToAppendIdx + uint64(len(reqs))
+	sl.mux.RLock()
+	for name, st := range sl.states {
+		var pinned uint64
+		if physIdx, ok := inRound[name]; ok {
+			req := reqs[physIdx-physToAppendIdx]
+			pinned = st.pinnedPhysIdxAfter(physIdx, req.appendAtIdx, req.deletedIdx)
+		} else if st.lastPhysIdx > 0 {
+			pinned = st.pinnedPhysIdx()
+		} else {
+			continue
+		}
+		if pinned < deleteBefore {
+			deleteBefore = pinned
+		}
+	}
+	sl.mux.RUnlock()
+
+	err := sl.db.AppendAndSync3(physToAppendIdx, vArray, deleteBefore)
+	if err == nil {
+		sl.mux.Lock()
+		for i, req := range reqs {
+			sl.states[req.name].apply(physToAppendIdx+uint64(i), req.appendAtIdx, req.locs, req.deletedIdx)
+		}
+		sl.mux.Unlock()
+	}
+	for _, req := range reqs {
+		req.errCh <- err
+	}
+}
+
+// rehomeReqs returns the checkpoint envelopes of the handles lagging behind
+// physToAppendIdx, except the ones already in reqs.
+func (sl *SharedLog) rehomeReqs(reqs []*sharedAppendReq, physToAppendIdx uint64) []*sharedAppendReq {
+	inRound := make(map[string]bool, len(reqs))
+	for _, req := range reqs {
+		inRound[req.name] = true
+	}
+	type lagging struct {
+		name       string
+		firstIdx   uint64
+		deletedIdx uint64
+		locs       []sharedValueLoc
+	}
+	var lags []lagging
+	sl.mux.RLock()
+	for name, st := range sl.states {
+		if inRound[name] || st.lastPhysIdx == 0 || len(st.locs) > sharedRehomeMaxValues ||
+			st.pinnedPhysIdx()+sharedRehomeLag > physToAppendIdx {
+			continue
+		}
+		lags = append(lags, lagging{
+			name:       name,
+			firstIdx:   st.firstIdx,
+			deletedIdx: st.deletedIdx,
+			locs:       append([]sharedValueLoc(nil), st.locs...),
+		})
+	}
+	sl.mux.RUnlock()
+
+	// only this loop applies envelopes, so the states are not changed since
+	var rehomes []*sharedAppendReq
+	for _, lag := range lags {
+		vArray, err := sl.readValues(lag.firstIdx, lag.locs)
+		if err != nil {
+			// keeps pinning until the next round
+			sl.db.opts.Logger.Warnf("logdb %s: failed to re-home handle %q: %v", sl.db.dirPath, lag.name, err)
+			continue
+		}
+		envelope, locs := encodeEnvelope(lag.name, lag.firstIdx, lag.deletedIdx, vArray)
+		rehomes = append(rehomes, &sharedAppendReq{
+			name:        lag.name,
+			appendAtIdx: lag.firstIdx,
+			deletedIdx:  lag.deletedIdx,
+			envelope:    envelope,
+			locs:        locs,
+			errCh:       make(chan error, 1),
+		})
+	}
+	return rehomes
+}
+
+// readValues reads the values of idx [leftIdx, leftIdx+len(locs)) at locs.
+func (sl *SharedLog) readValues(leftIdx uint64, locs []sharedValueLoc) ([][]byte, error) {
+	if len(locs) == 0 {
+		return nil, nil
+	}
+	// The envelopes of the other handles in between are read too, that is
+	// still cheaper than one random read per idx.
+	firstPhysIdx := locs[0].physIdx
+	envelopes, err := sl.db.GetValuesByIdxRange(firstPhysIdx, locs[len(locs)-1].physIdx+1)
+	if err != nil {
+		return nil, err
+	}
+	vArray := make([][]byte, len(locs))
+	for i, loc := range locs {
+		vArray[i], err = sliceEnvelope(leftIdx+uint64(i), envelopes[loc.physIdx-firstPhysIdx], loc)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return vArray, nil
+}
+
+type sharedHandle struct {
+	sl   *SharedLog
+	name string
+	// guarded by sl.mux
+	st *sharedHandleState
+	// only one writer at the same time
+	writeMux sync.Mutex
+	async    asyncAppender
+}
+
+func (h *sharedHandle) GetCurrentIdxRange() (leftIdx, toAppendIdx uint64) {
+	h.sl.mux.RLock()
+	defer h.sl.mux.RUnlock()
+	return h.st.firstIdx, h.st.toAppendIdx()
+}
+
+func (h *sharedHandle) locate(idx uint64) (sharedValueLoc, error) {
+	h.sl.mux.RLock()
+	defer h.sl.mux.RUnlock()
+	if !h.st.openFlag {
+		return sharedValueLoc{}, fmt.Errorf("handle %q is already closed", h.name)
+	}
+	leftIdx, toAppendIdx := h.st.firstIdx, h.st.toAppendIdx()
+	if idx < leftIdx || idx >= toAppendIdx {
+		return sharedValueLoc{}, fmt.Errorf("idx %d is out of range [%d, %d)", idx, leftIdx, toAppendIdx)
+	}
+	return h.st.locs[idx-h.st.firstIdx], nil
+}
+
+func sliceEnvelope(idx uint64, bs []byte, loc sharedValueLoc) ([]byte, error) {
+	if uint64(loc.off)+uint64(loc.length) > uint64(len(bs)) {
+		return nil, corruptionf(ErrCorruptDirectory, "value of idx %d is out of its envelope", idx)
+	}
+	return bs[loc.off : loc.off+loc.length], nil
+}
+
+// movedFlag reports whether idx is moved away from *loc since located, by a
+// re-home whose round may have deleted *loc already, and sets *loc to where
+// idx is now.
+func (h *sharedHandle) movedFlag(idx uint64, loc *sharedValueLoc) bool {
+	newLoc, err := h.locate(idx)
+	if err != nil || newLoc.physIdx == loc.physIdx {
+		return false
+	}
+	*loc = newLoc
+	return true
+}
+
+func (h *sharedHandle) GetValueByIdx(idx uint64) (v []byte, e error) {
+	loc, err := h.locate(idx)
+	if err != nil {
+		return nil, err
+	}
+	bs, err := h.sl.db.GetValueByIdx(loc.physIdx)
+	if err != nil && h.movedFlag(idx, &loc) {
+		bs, err = h.sl.db.GetValueByIdx(loc.physIdx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sliceEnvelope(idx, bs, loc)
+}
+
+func (h *sharedHandle) GetValueLeaseByIdx(idx uint64) (l *ValueLease, e error) {
+	loc, err := h.locate(idx)
+	if err != nil {
+		return nil, err
+	}
+	physL, err := h.sl.db.GetValueLeaseByIdx(loc.physIdx)
+	if err != nil && h.movedFlag(idx, &loc) {
+		physL, err = h.sl.db.GetValueLeaseByIdx(loc.physIdx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	v, err := sliceEnvelope(idx, physL.Value(), loc)
+	if err != nil {
+		physL.Release()
+		return nil, err
+	}
+	return newValueLease(v, physL.Release), nil
+}
+
+func (h *sharedHandle) GetValuesByIdxRange(leftIdx, rightIdx uint64) (vArray [][]byte, e error) {
+	locs, err := h.locateRange(leftIdx, rightIdx)
+	if err != nil {
+		return nil, err
+	}
+	if len(locs) == 0 {
+		return [][]byte{}, nil
+	}
+	vArray, err = h.sl.readValues(leftIdx, locs)
+	if err != nil && h.movedFlag(leftIdx, &locs[0]) {
+		// re-homed, all the values of the handle are moved together
+		locs, err = h.locateRange(leftIdx, rightIdx)
+		if err != nil {
+			return nil, err
+		}
+		vArray, err = h.sl.readValues(leftIdx, locs)
+	}
+	return vArray, err
+}
+
+func (h *sharedHandle) locateRange(leftIdx, rightIdx uint64) ([]sharedValueLoc, error) {
+	h.sl.mux.RLock()
+	if !h.st.openFlag {
+		h.sl.mux.RUnlock()
+		return nil, fmt.Errorf("handle %q is already closed", h.name)
+	}
+	curLeftIdx, curToAppendIdx := h.st.firstIdx, h.st.toAppendIdx()
+	if leftIdx > rightIdx || (leftIdx < rightIdx && (leftIdx < curLeftIdx || rightIdx > curToAppendIdx)) {
+		h.sl.mux.RUnlock()
+		return nil, fmt.Errorf("idx range [%d, %d) is out of range [%d, %d)", leftIdx, rightIdx, curLeftIdx, curToAppendIdx)
+	}
+	locs := append([]sharedValueLoc(nil), h.st.locs[leftIdx-curLeftIdx:rightIdx-curLeftIdx]...)
+	h.sl.mux.RUnlock()
+	return locs, nil
+}
+
+func (h *sharedHandle) NewIterator(fromIdx uint64, backwardFlag bool) (Iterator, error) {
+	return newRangeIterator(h, fromIdx, backwardFlag)
+}
+
+func (h *sharedHandle) AppendAndSync(appendAtIdx uint64, vArray [][]byte) (e error) {
+	return h.AppendAndSync3(appendAtIdx, vArray, 0)
+}
+
+func (h *sharedHandle) AppendAndSync3(appendAtIdx uint64, vArray [][]byte, deleteAllIdxLessThan uint64) (e error) {
+	if err := h.async.flush(); err != nil {
+		return err
+	}
+	return h.appendAndSync3(appendAtIdx, vArray, deleteAllIdxLessThan)
+}
+
+func (h *sharedHandle) AppendAsync(appendAtIdx uint64, vArray [][]byte) *AppendFuture {
+	return h.async.appendAsync(appendAtIdx, vArray)
+}
+
+func (h *sharedHandle) Flush() error {
+	return h.async.flush()
+}
+
+func (h *sharedHandle) appendAndSync3(appendAtIdx uint64, vArray [][]byte, deleteAllIdxLessThan uint64) (e error) {
+	h.writeMux.Lock()
+	defer h.writeMux.Unlock()
+
+	h.sl.mux.RLock()
+	openFlag := h.st.openFlag
+	toAppendIdx := h.st.toAppendIdx()
+	deletedIdx := h.st.deletedIdx
+	h.sl.mux.RUnlock()
+	if !openFlag {
+		return fmt.Errorf("handle %q is already closed", h.name)
+	}
+	if appendAtIdx != toAppendIdx {
+		return fmt.Errorf("appendAtIdx %d != toAppendIdx %d", appendAtIdx, toAppendIdx)
+	}
+	newToAppendIdx := toAppendIdx + uint64(len(vArray))
+	if deleteAllIdxLessThan > newToAppendIdx {
+		return fmt.Errorf("deleteAllIdxLessThan %d > toAppendIdx %d after this append", deleteAllIdxLessThan, newToAppendIdx)
+	}
+	newDeletedIdx := deletedIdx
+	if deleteAllIdxLessThan > 0 && deleteAllIdxLessThan-1 > deletedIdx {
+		newDeletedIdx = deleteAllIdxLessThan - 1
+	}
+	if len(vArray) == 0 && newDeletedIdx == deletedIdx {
+		return nil
+	}
+	envelope, locs := encodeEnvelope(h.name, appendAtIdx, newDeletedIdx, vArray)
+	err := h.sl.submit(&sharedAppendReq{
+		name:        h.name,
+		appendAtIdx: appendAtIdx,
+		deletedIdx:  newDeletedIdx,
+		envelope:    envelope,
+		locs:        locs,
+		errCh:       make(chan error, 1),
+	})
+	if err == nil {
+		h.sl.userBytes.addUser(valuesLen(vArray))
+	}
+	return err
+}
+
+// Stats of a handle are the Stats of the whole SharedLog.
+func (h *sharedHandle) Stats() Stats {
+	return h.sl.Stats()
+}
+
+// TruncateFrom is stored as an envelope without any value which appends at
+// idx, thus it is as atomic as AppendAndSync3.
+func (h *sharedHandle) TruncateFrom(idx uint64) error {
+	if err := h.async.flush(); err != nil {
+		return err
+	}
+	h.writeMux.Lock()
+	defer h.writeMux.Unlock()
+
+	h.sl.mux.RLock()
+	openFlag := h.st.openFlag
+	leftIdx, toAppendIdx := h.st.firstIdx, h.st.toAppendIdx()
+	deletedIdx := h.st.deletedIdx
+	h.sl.mux.RUnlock()
+	if !openFlag {
+		return fmt.Errorf("handle %q is already closed", h.name)
+	}
+	if idx == toAppendIdx {
+		return nil
+	}
+	if idx < leftIdx || idx > toAppendIdx {
+		return fmt.Errorf("idx %d is out of range [%d, %d]", idx, leftIdx, toAppendIdx)
+	}
+	envelope, locs := encodeEnvelope(h.name, idx, deletedIdx, nil)
+	return h.sl.submit(&sharedAppendReq{
+		name:        h.name,
+		appendAtIdx: idx,
+		deletedIdx:  deletedIdx,
+		envelope:    envelope,
+		locs:        locs,
+		errCh:       make(chan error, 1),
+	})
+}
+
+// Close the handle, the shared log is still open.
+func (h *sharedHandle) Close() error {
+	flushErr := h.async.flush()
+	h.writeMux.Lock()
+	defer h.writeMux.Unlock()
+	h.sl.mux.Lock()
+	defer h.sl.mux.Unlock()
+	if !h.st.openFlag {
+		return fmt.Errorf("handle %q is already closed", h.name)
+	}
+	h.st.openFlag = false
+	return flushErr
+}
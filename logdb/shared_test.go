@@ -0,0 +1,261 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func handleValue(name string, i uint64) []byte {
+	return []byte(fmt.Sprintf("%s-%d", name, i))
+}
+
+func openTestHandle(t *testing.T, sl *SharedLog, name string) DB {
+	t.Helper()
+	h, err := sl.OpenHandle(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// checkHandle checks h holds exactly the values of [leftIdx, toAppendIdx).
+func checkHandle(t *testing.T, h DB, name string, leftIdx, toAppendIdx uint64) {
+	t.Helper()
+	gotLeft, gotToAppend := h.GetCurrentIdxRange()
+	if gotLeft != leftIdx || gotToAppend != toAppendIdx {
+		t.Fatalf("handle %q got idx range [%d, %d) but expect [%d, %d)", name, gotLeft, gotToAppend, leftIdx, toAppendIdx)
+	}
+	for idx := leftIdx; idx < toAppendIdx; idx++ {
+		v, err := h.GetValueByIdx(idx)
+		if err != nil || !bytes.Equal(v, handleValue(name, idx)) {
+			t.Fatalf("handle %q idx %d got %q %v", name, idx, v, err)
+		}
+	}
+	vArray, err := h.GetValuesByIdxRange(leftIdx, toAppendIdx)
+	if err != nil || len(vArray) != int(toAppendIdx-leftIdx) {
+		t.Fatalf("handle %q got %d values %v", name, len(vArray), err)
+	}
+	for i, v := range vArray {
+		if !bytes.Equal(v, handleValue(name, leftIdx+uint64(i))) {
+			t.Fatalf("handle %q idx %d got %q", name, leftIdx+uint64(i), v)
+		}
+	}
+	if leftIdx > 1 {
+		if _, err := h.GetValueByIdx(leftIdx - 1); err == nil {
+			t.Fatalf("handle %q expect an error reading the deleted idx %d", name, leftIdx-1)
+		}
+	}
+}
+
+func TestSharedLogHandles(t *testing.T) {
+	const appendCt = 100
+	dirPath := filepath.Join(t.TempDir(), "db")
+	sl, err := CreateSharedLog(dirPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{"a", "b", "c"}
+	var hs []DB
+	for _, name := range names {
+		hs = append(hs, openTestHandle(t, sl, name))
+	}
+	if _, err := sl.OpenHandle("a"); err == nil {
+		t.Fatal("expect an error opening a handle twice")
+	}
+
+	// concurrent appends from all the handles share the physical appends
+	var wg sync.WaitGroup
+	errs := make([]error, len(hs))
+	for i := range hs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for idx := uint64(1); idx <= appendCt; idx++ {
+				err := hs[i].AppendAndSync(idx, [][]byte{handleValue(names[i], idx)})
+				if err != nil {
+					errs[i] = err
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("handle %q: %v", names[i], err)
+		}
+		checkHandle(t, hs[i], names[i], 1, appendCt+1)
+	}
+	if _, physToAppendIdx := sl.db.GetCurrentIdxRange(); physToAppendIdx > 3*appendCt+1 {
+		t.Fatalf("got %d envelopes for %d appends", physToAppendIdx-1, 3*appendCt)
+	}
+
+	// b deletes a prefix, c truncates a suffix and appends again
+	err = hs[1].AppendAndSync3(appendCt+1, [][]byte{handleValue("b", appendCt+1)}, 51)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHandle(t, hs[1], "b", 51, appendCt+2)
+	err = hs[2].TruncateFrom(81)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHandle(t, hs[2], "c", 1, 81)
+	err = hs[2].AppendAndSync(81, [][]byte{handleValue("c", 81)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range hs {
+		if err := h.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sl.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sl, err = OpenSharedLogIfExist(dirPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sl.Close()
+	if got := sl.HandleNames(); !reflect.DeepEqual(got, names) {
+		t.Fatalf("got handle names %v", got)
+	}
+	checkHandle(t, openTestHandle(t, sl, "a"), "a", 1, appendCt+1)
+	checkHandle(t, openTestHandle(t, sl, "b"), "b", 51, appendCt+2)
+	checkHandle(t, openTestHandle(t, sl, "c"), "c", 1, 82)
+	checkHandle(t, openTestHandle(t, sl, "d"), "d", 1, 1)
+}
+
+// An idle handle is re-homed so the physical prefix is reclaimed.
+func TestSharedLogReclaimWithIdleHandle(t *testing.T) {
+	const busyCt = 2 * sharedRehomeLag
+	dirPath := filepath.Join(t.TempDir(), "db")
+	opts := NewOptions(WithSegmentSize(16<<10), WithSyncMode(SyncNone))
+	sl, err := CreateSharedLog(dirPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// idle keeps two live idx, empty deletes all of its idx
+	idle := openTestHandle(t, sl, "idle")
+	empty := openTestHandle(t, sl, "empty")
+	busy := openTestHandle(t, sl, "busy")
+	for idx := uint64(1); idx <= 3; idx++ {
+		for _, h := range []DB{idle, empty} {
+			if err := h.AppendAndSync(idx, [][]byte{handleValue("x", idx)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := idle.AppendAndSync3(4, [][]byte{handleValue("idle", 4)}, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := empty.AppendAndSync3(4, nil, 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := idle.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// read is re-homed while being read
+	read := openTestHandle(t, sl, "read")
+	if err := read.AppendAndSync(1, [][]byte{handleValue("read", 1)}); err != nil {
+		t.Fatal(err)
+	}
+	stopCh := make(chan struct{})
+	readErrCh := make(chan error, 1)
+	go func() {
+		for {
+			select {
+			case <-stopCh:
+				readErrCh <- nil
+				return
+			default:
+			}
+			if _, err := read.GetValueByIdx(1); err != nil {
+				readErrCh <- err
+				return
+			}
+			if _, err := read.GetValuesByIdxRange(1, 2); err != nil {
+				readErrCh <- err
+				return
+			}
+		}
+	}()
+
+	// busy only keeps its last idx, only the idle handles pin the prefix
+	for idx := uint64(1); idx <= busyCt; idx++ {
+		err := busy.AppendAndSync3(idx, [][]byte{handleValue("busy", idx)}, idx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stopCh)
+	if err := <-readErrCh; err != nil {
+		t.Fatalf("read of a re-homed handle: %v", err)
+	}
+	checkHandle(t, read, "read", 1, 2)
+	physLeftIdx, physToAppendIdx := sl.db.GetCurrentIdxRange()
+	if physLeftIdx+sharedRehomeLag+1 < physToAppendIdx {
+		t.Fatalf("physical idx range [%d, %d) is pinned", physLeftIdx, physToAppendIdx)
+	}
+	idle = openTestHandle(t, sl, "idle")
+	gotLeft, gotToAppend := idle.GetCurrentIdxRange()
+	if gotLeft != 3 || gotToAppend != 5 {
+		t.Fatalf("idle got idx range [%d, %d)", gotLeft, gotToAppend)
+	}
+	for idx, v := range map[uint64][]byte{3: handleValue("x", 3), 4: handleValue("idle", 4)} {
+		got, err := idle.GetValueByIdx(idx)
+		if err != nil || !bytes.Equal(got, v) {
+			t.Fatalf("idle idx %d got %q %v", idx, got, err)
+		}
+	}
+	for _, h := range []DB{idle, empty, busy, read} {
+		if err := h.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sl.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// the close waits the reclaim of the wholly deleted segments
+	if _, err := os.Stat(filepath.Join(dirPath, segmentFileName(1))); !os.IsNotExist(err) {
+		t.Fatalf("the head segment is not reclaimed: %v", err)
+	}
+
+	sl, err = OpenSharedLogIfExist(dirPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sl.Close()
+	idle = openTestHandle(t, sl, "idle")
+	if gotLeft, gotToAppend := idle.GetCurrentIdxRange(); gotLeft != 3 || gotToAppend != 5 {
+		t.Fatalf("idle got idx range [%d, %d) after reopen", gotLeft, gotToAppend)
+	}
+	if v, err := idle.GetValueByIdx(4); err != nil || !bytes.Equal(v, handleValue("idle", 4)) {
+		t.Fatalf("idle idx 4 got %q %v after reopen", v, err)
+	}
+	if gotLeft, gotToAppend := openTestHandle(t, sl, "empty").GetCurrentIdxRange(); gotLeft != 4 || gotToAppend != 4 {
+		t.Fatalf("empty got idx range [%d, %d) after reopen", gotLeft, gotToAppend)
+	}
+	checkHandle(t, openTestHandle(t, sl, "busy"), "busy", busyCt, busyCt+1)
+}
@@ -0,0 +1,117 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"sync/atomic"
+)
+
+// Stats are the counters since the DB is opened.
+type Stats struct {
+	// bytes of the values appended by the user
+	UserBytes uint64
+	// bytes physically written into the files, including the record headers
+	// in the data area, the directory entries and the metas (and headers).
+	// With Options.DirectIO they are the bytes of the aligned blocks written.
+	DataBytes      uint64
+	DirectoryBytes uint64
+	MetaBytes      uint64
+	// count of the fsyncs on files and directories
+	SyncCt uint64
+	// bytes of the header area, used directory entries and used data area of
+	// the segment files which are unlinked
+	ReclaimedBytes uint64
+}
+
+func (s Stats) PhysicalBytes() uint64 {
+	return s.DataBytes + s.DirectoryBytes + s.MetaBytes
+}
+
+// WriteAmplification is PhysicalBytes / UserBytes, zero if nothing is
+// appended yet.
+func (s Stats) WriteAmplification() float64 {
+	if s.UserBytes == 0 {
+		return 0
+	}
+	return float64(s.PhysicalBytes()) / float64(s.UserBytes)
+}
+
+// statCounters is updated atomically, all the methods are no-op on a nil
+// receiver.
+type statCounters struct {
+	userBytes      uint64
+	dataBytes      uint64
+	directoryBytes uint64
+	metaBytes      uint64
+	syncCt         uint64
+	reclaimedBytes uint64
+}
+
+func (c *statCounters) addUser(n int) {
+	if c != nil {
+		atomic.AddUint64(&c.userBytes, uint64(n))
+	}
+}
+
+func (c *statCounters) addData(n int) {
+	if c != nil {
+		atomic.AddUint64(&c.dataBytes, uint64(n))
+	}
+}
+
+func (c *statCounters) addDirectory(n int) {
+	if c != nil {
+		atomic.AddUint64(&c.directoryBytes, uint64(n))
+	}
+}
+
+func (c *statCounters) addMeta(n int) {
+	if c != nil {
+		atomic.AddUint64(&c.metaBytes, uint64(n))
+	}
+}
+
+func (c *statCounters) addSync() {
+	if c != nil {
+		atomic.AddUint64(&c.syncCt, 1)
+	}
+}
+
+func (c *statCounters) addReclaimed(n uint64) {
+	if c != nil {
+		atomic.AddUint64(&c.reclaimedBytes, n)
+	}
+}
+
+func (c *statCounters) snapshot() Stats {
+	if c == nil {
+		return Stats{}
+	}
+	return Stats{
+		UserBytes:      atomic.LoadUint64(&c.userBytes),
+		DataBytes:      atomic.LoadUint64(&c.dataBytes),
+		DirectoryBytes: atomic.LoadUint64(&c.directoryBytes),
+		MetaBytes:      atomic.LoadUint64(&c.metaBytes),
+		SyncCt:         atomic.LoadUint64(&c.syncCt),
+		ReclaimedBytes: atomic.LoadUint64(&c.reclaimedBytes),
+	}
+}
+
+func valuesLen(vArray [][]byte) (n int) {
+	for _, v := range vArray {
+		n += len(v)
+	}
+	return
+}
@@ -0,0 +1,168 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func againValue(i int) []byte {
+	return []byte(fmt.Sprintf("again-%d", i))
+}
+
+// checkTruncatedDB checks db holds testValue in [1, idx) and againValue in
+// [idx, toAppendIdx).
+func checkTruncatedDB(t *testing.T, db DB, idx int, toAppendIdx int) {
+	t.Helper()
+	leftIdx, gotToAppendIdx := db.GetCurrentIdxRange()
+	if leftIdx != 1 || gotToAppendIdx != uint64(toAppendIdx) {
+		t.Fatalf("got idx range [%d, %d) but expect [1, %d)", leftIdx, gotToAppendIdx, toAppendIdx)
+	}
+	for i := 1; i < toAppendIdx; i++ {
+		expect := testValue(i)
+		if i >= idx {
+			expect = againValue(i)
+		}
+		v, err := db.GetValueByIdx(uint64(i))
+		if err != nil || !bytes.Equal(v, expect) {
+			t.Fatalf("idx %d got %q %v but expect %q", i, v, err, expect)
+		}
+	}
+}
+
+// TruncateFrom into an earlier segment drops the segments after it, and the
+// appends after that roll over new segments again.
+func TestTruncateAcrossSegments(t *testing.T) {
+	const n, idx = 12, 5
+	dirPath := filepath.Join(t.TempDir(), "db")
+	opts := NewOptions(WithSegmentSize(64))
+	db, err := CreateDBWithOptions(dirPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= n; i++ {
+		err = db.AppendAndSync(uint64(i), [][]byte{testValue(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	firstIdxs, err := listSegments(dirPath)
+	if err != nil || len(firstIdxs) < 3 || firstIdxs[len(firstIdxs)-2] <= idx {
+		t.Fatalf("got segments %v %v but expect at least two after idx %d", firstIdxs, err, idx)
+	}
+
+	err = db.TruncateFrom(idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTruncatedDB(t, db, idx, idx)
+	if _, err = db.GetValueByIdx(idx); err == nil {
+		t.Fatalf("expect an error reading the truncated idx %d", idx)
+	}
+	if err = db.TruncateFrom(idx + 1); err == nil {
+		t.Fatalf("expect an error truncating from %d beyond toAppendIdx", idx+1)
+	}
+	leftFirstIdxs, err := listSegments(dirPath)
+	if err != nil || leftFirstIdxs[len(leftFirstIdxs)-1] > idx {
+		t.Fatalf("got segments %v %v after truncating from %d", leftFirstIdxs, err, idx)
+	}
+	for i := idx; i <= n; i++ {
+		err = db.AppendAndSync(uint64(i), [][]byte{againValue(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkTruncatedDB(t, db, idx, n+1)
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenDBIfExistWithOptions(dirPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkTruncatedDB(t, db, idx, n+1)
+}
+
+// The truncated idx stay truncated after a reopen.
+func TestTruncateThenReopen(t *testing.T) {
+	const n, idx = 6, 3
+	dirPath := newTestDB(t, n)
+	db, err := OpenDBIfExist(dirPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.TruncateFrom(idx)
+	if err == nil {
+		err = db.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenDBIfExist(dirPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkTruncatedDB(t, db, idx, idx)
+	err = db.AppendAndSync(idx, [][]byte{againValue(idx)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTruncatedDB(t, db, idx, idx+1)
+}
+
+// A value cached before the truncation is never served for the idx appended
+// again.
+func TestTruncateThenAppendWithCache(t *testing.T) {
+	const n, idx = 6, 3
+	dirPath := filepath.Join(t.TempDir(), "db")
+	metrics := &countMetrics{counters: make(map[string]uint64)}
+	db, err := CreateDBWithOptions(dirPath, NewOptions(WithCacheSize(1<<20), WithMetrics(metrics)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 1; i <= n; i++ {
+		err = db.AppendAndSync(uint64(i), [][]byte{testValue(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// served by the cache
+	checkTruncatedDB(t, db, n+1, n+1)
+	if ct := metrics.get(MetricCacheHitCt); ct != n {
+		t.Fatalf("cache hit %d times", ct)
+	}
+	err = db.TruncateFrom(idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AppendAndSync(idx, [][]byte{againValue(idx), againValue(idx + 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTruncatedDB(t, db, idx, idx+2)
+	vArray, err := db.GetValuesByIdxRange(idx, idx+2)
+	if err != nil || len(vArray) != 2 || !bytes.Equal(vArray[0], againValue(idx)) || !bytes.Equal(vArray[1], againValue(idx+1)) {
+		t.Fatalf("got %q %v", vArray, err)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"errors"
+)
+
+type VerifyResult struct {
+	LeftIdx     uint64
+	ToAppendIdx uint64
+	SegmentCt   int
+	// count of the records checked, they are all inside [LeftIdx, ToAppendIdx)
+	CheckedCt int
+	// count of the encrypted records of CheckedCt whose checksums are verified
+	// but which are not decrypted since there is no KeyProvider
+	UndecryptedCt int
+	// idx of the records which failed the verification
+	CorruptIdxs []uint64
+}
+
+// Verify scans the whole logdb under dirPathStr offline and never modifies it,
+// the logdb should not be opened by others at the same time.
+// Error would be returned if the file structure is invalid or any record is
+// corrupted, and the result holds everything found before that.
+func Verify(dirPathStr string) (VerifyResult, error) {
+	return VerifyWithOptions(dirPathStr, nil)
+}
+
+// VerifyWithOptions is Verify with the KeyProvider of opts to authenticate
+// and decrypt an encrypted logdb, the other members of opts are ignored.
+// Without the KeyProvider only the checksums of an encrypted logdb are
+// verified, see OpenInspector.
+func VerifyWithOptions(dirPathStr string, opts *Options) (VerifyResult, error) {
+	var ret VerifyResult
+	in, err := OpenInspector(dirPathStr, opts)
+	if err != nil {
+		return ret, err
+	}
+	defer in.Close()
+	r := in.Result()
+	ret.SegmentCt = len(r.Segments)
+	ret.LeftIdx, ret.ToAppendIdx = r.LeftIdx, r.ToAppendIdx
+	var firstErr error
+	for idx := ret.LeftIdx; idx < ret.ToAppendIdx; idx++ {
+		info, err := in.ReadRecord(idx)
+		ret.CheckedCt++
+		if err == nil {
+			continue
+		}
+		if info.EncryptedFlag && in.db.enc == nil && errors.Is(err, ErrDecrypt) {
+			ret.UndecryptedCt++
+			continue
+		}
+		if !errors.Is(err, ErrChecksumMismatch) && !errors.Is(err, ErrCorruptDirectory) {
+			return ret, err
+		}
+		ret.CorruptIdxs = append(ret.CorruptIdxs, idx)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return ret, firstErr
+}
@@ -0,0 +1,122 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/turingcell/veela/util"
+)
+
+type staticKeys struct{}
+
+func (staticKeys) CurrentKey() (uint32, []byte, error) {
+	return 7, bytes.Repeat([]byte{7}, 32), nil
+}
+
+func (staticKeys) Key(keyID uint32) ([]byte, error) {
+	if keyID != 7 {
+		return nil, fmt.Errorf("unknown key %d", keyID)
+	}
+	return bytes.Repeat([]byte{7}, 32), nil
+}
+
+// newEncryptedTestDB is newTestDB with encryption.
+func newEncryptedTestDB(t *testing.T, n int) (dirPath string) {
+	t.Helper()
+	dirPath = filepath.Join(t.TempDir(), "db")
+	db, err := CreateDBWithOptions(dirPath, NewOptions(WithKeyProvider(staticKeys{})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= n; i++ {
+		err = db.AppendAndSync(uint64(i), [][]byte{testValue(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dirPath
+}
+
+func TestVerifyWithoutKey(t *testing.T) {
+	const n = 3
+	dirPath := newEncryptedTestDB(t, n)
+	if _, err := OpenDBIfExist(dirPath); !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("expect %v but got %v", ErrDecrypt, err)
+	}
+	r, err := Verify(dirPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.LeftIdx != 1 || r.ToAppendIdx != n+1 || r.CheckedCt != n || r.UndecryptedCt != n {
+		t.Fatalf("got %+v", r)
+	}
+	r, err = VerifyWithOptions(dirPath, NewOptions(WithKeyProvider(staticKeys{})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.CheckedCt != n || r.UndecryptedCt != 0 {
+		t.Fatalf("got %+v", r)
+	}
+
+	// the corrupted ciphertext is found by its checksum
+	path := headSegmentPath(dirPath)
+	body := readFileAt(t, path, metaPos, encryptedMetaLen-4)
+	dataNextPos := util.BsReadU32(body)
+	writeFileAt(t, path, int64(dataNextPos)-1, []byte{0xff})
+	r, err = Verify(dirPath)
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expect %v but got %v", ErrChecksumMismatch, err)
+	}
+	if r.CheckedCt != n || r.UndecryptedCt != n-1 || len(r.CorruptIdxs) != 1 || r.CorruptIdxs[0] != n {
+		t.Fatalf("got %+v", r)
+	}
+
+	writeFileAt(t, path, metaPos+encryptedMetaLen-1, []byte{0xff})
+	if _, err = Verify(dirPath); !errors.Is(err, ErrCorruptMeta) {
+		t.Fatalf("expect %v but got %v", ErrCorruptMeta, err)
+	}
+}
+
+// The fields of an encrypted Meta are in plaintext but authenticated.
+func TestEncryptedMetaAuthenticated(t *testing.T) {
+	const n = 3
+	dirPath := newEncryptedTestDB(t, n)
+	path := headSegmentPath(dirPath)
+	body := readFileAt(t, path, metaPos, encryptedMetaLen-4)
+	// commit one record less with a valid checksum
+	util.U32SetBs(body[4:], util.BsReadU32(body[4:])-directoryEntryLen)
+	writeFileAt(t, path, metaPos, appendChecksum(body))
+
+	r, err := Verify(dirPath)
+	if err != nil || r.ToAppendIdx != n {
+		t.Fatalf("got %+v %v", r, err)
+	}
+	opts := NewOptions(WithKeyProvider(staticKeys{}))
+	if _, err = VerifyWithOptions(dirPath, opts); !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("expect %v but got %v", ErrDecrypt, err)
+	}
+	if _, err = OpenDBIfExistWithOptions(dirPath, opts); !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("expect %v but got %v", ErrDecrypt, err)
+	}
+}
@@ -0,0 +1,353 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package veela
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	vpb "github.com/turingcell/veela/proto/veela"
+	"github.com/turingcell/veela/util"
+)
+
+const (
+	// The low proposerIDBits of a prepareEpoch is the id of its proposer, so
+	// the proposers never share an epoch. The high bits are its round.
+	proposerIDBits = 16
+	MaxProposerID  = 1<<proposerIDBits - 1
+	maxRound       = 1<<(64-proposerIDBits) - 1
+
+	// the failed PA rounds are retried after a random delay up to it
+	maxProposeBackoff = 100 * time.Millisecond
+)
+
+func (pg *PaxosGroup) NewProposer(id Epoch) (*Proposer, error) {
+	if id == 0 || id > MaxProposerID {
+		return nil, fmt.Errorf("proposer id should be in [1, %d] but got %d", MaxProposerID, id.ToUint64())
+	}
+	return &Proposer{id: id, pg: pg}, nil
+}
+
+func (p *Proposer) GetID() Epoch {
+	return p.id
+}
+
+// AddElectionResult adds the term the proposer could propose in, the terms
+// should not overlap.
+func (p *Proposer) AddElectionResult(er ElectionResult) error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	err := p.terms.add(er)
+	if err == nil {
+		p.pg.acceptorProxy.addElectionResultHints(&er)
+	}
+	return err
+}
+
+func (p *Proposer) findTerm(instE Epoch) (ElectionResult, error) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	er, ok := p.terms.find(instE)
+	if !ok {
+		return ElectionResult{}, fmt.Errorf("inst %d is not in any term of proposer %d", instE.ToUint64(), p.id.ToUint64())
+	}
+	return er, nil
+}
+
+// nextEpoch returns a prepareEpoch of this proposer higher than seenE and all
+// the ones returned before.
+func (p *Proposer) nextEpoch(seenE uint64) uint64 {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	round := seenE >> proposerIDBits
+	if round < p.round {
+		round = p.round
+	}
+	util.AssertTrue(round < maxRound)
+	round++
+	p.round = round
+	return round<<proposerIDBits | p.id.ToUint64()
+}
+
+// Propose runs the PA rounds on instE until a value is chosen or ctx is done.
+// If an AcceptValue has been accepted by any acceptor of the promised quorum,
+// the one with the highest acceptEpoch is proposed again by a help-proposed
+// PA, otherwise v is proposed by a self-proposed PA whose epoch becomes its
+// id. v is not modified. The chosen AcceptValue is returned, ownFlag reports
+// whether it is v.
+//
+// The AcceptValues are sent and replied by id whenever the acceptor is known
+// to hold it, see goal-zh.md.
+func (p *Proposer) Propose(ctx context.Context, instE Epoch, v *AcceptValue) (chosen *AcceptValue, ownFlag bool, err error) {
+	if v == nil || len(v.memberIdxs.Idxs) == 0 {
+		return nil, false, fmt.Errorf("invalid AcceptValue, see NewAcceptValue")
+	}
+	er, err := p.findTerm(instE)
+	if err != nil {
+		return nil, false, err
+	}
+	st := proposeState{
+		p:       p,
+		instE:   instE,
+		er:      er,
+		own:     *v,
+		ownIDs:  make(map[uint64]bool),
+		values:  make(map[uint64][]byte),
+		holders: make(map[uint64]map[Epoch]bool),
+	}
+	for attempt := 0; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return nil, false, err
+		}
+		e := p.nextEpoch(st.seenE)
+		id, promisedFlag, chosenFlag, err := st.prepare(ctx, e)
+		if err == nil && chosenFlag {
+			return st.finish(ctx, id)
+		}
+		if err == nil && promisedFlag {
+			var acceptedFlag bool
+			acceptedFlag, err = st.accept(ctx, e, id)
+			if err == nil && acceptedFlag {
+				return st.finish(ctx, id)
+			}
+		}
+		if err != nil {
+			vlog.Debugf("proposer %d failed to propose inst %d with epoch %d: %v", p.id.ToUint64(),
+				instE.ToUint64(), e, err)
+		}
+		backoff := time.Millisecond << uint(attempt)
+		if backoff <= 0 || backoff > maxProposeBackoff {
+			backoff = maxProposeBackoff
+		}
+		timer := time.NewTimer(time.Duration(rand.Int63n(int64(backoff)) + 1))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, false, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// proposeState is what one Propose knows about its inst.
+type proposeState struct {
+	p     *Proposer
+	instE Epoch
+	er    ElectionResult
+	// the AcceptValue to propose, its id is assigned by each self-proposed PA
+	own    AcceptValue
+	ownIDs map[uint64]bool
+	// AcceptValueID -> the marshaled AcceptValue
+	values map[uint64][]byte
+	// AcceptValueID -> the acceptors known to hold it
+	holders map[uint64]map[Epoch]bool
+	// the highest prepareEpoch seen
+	seenE uint64
+}
+
+func (st *proposeState) observe(acceptorID Epoch, state *vpb.AcceptorInOnePaxosInstanceState) {
+	if state == nil {
+		return
+	}
+	if state.PrepareEpoch > st.seenE {
+		st.seenE = state.PrepareEpoch
+	}
+	for id := range state.AcceptValueLogdbIdxMap {
+		st.addHolder(id, acceptorID)
+	}
+}
+
+func (st *proposeState) addHolder(id uint64, acceptorID Epoch) {
+	m := st.holders[id]
+	if m == nil {
+		m = make(map[Epoch]bool)
+		st.holders[id] = m
+	}
+	m[acceptorID] = true
+}
+
+// prepare runs the Prepare phase with epoch e. If a quorum promised, it
+// returns the AcceptValueID to propose, whose AcceptValue is known then. If
+// the inst is already chosen, it returns the chosen AcceptValueID instead.
+func (st *proposeState) prepare(ctx context.Context, e uint64) (id uint64, promisedFlag bool, chosenFlag bool, err error) {
+	ids := st.er.acceptorIDs
+	resps := st.p.pg.acceptorProxy.prepare(ctx, ids, st.er.quorum(),
+		func(ctx context.Context, i int, c AcceptorRpcClient) (*vpb.AcceptorRpcPrepareResponese, error) {
+			return c.Prepare(ctx, &vpb.AcceptorRpcPrepareRequest{
+				GroupName:                   st.p.pg.groupName,
+				ProposerID:                  st.p.id.ToUint64(),
+				AcceptorID:                  ids[i].ToUint64(),
+				InstE:                       st.instE.ToUint64(),
+				PrepareEpoch:                e,
+				OnlyRetureAcceptValueIDFlag: true,
+			})
+		})
+	promisedCt := 0
+	var maxAcceptEpoch uint64
+	for i, resp := range resps {
+		if resp == nil || resp.StatusCode != int32(vpb.StatusCode_OK) {
+			continue
+		}
+		state := resp.AcceptorInOnePaxosInstanceState
+		if state == nil {
+			// a promise without the accepted one could not be counted
+			vlog.Debugf("proposer %d: acceptor %d replied no state of inst %d", st.p.id.ToUint64(),
+				ids[i].ToUint64(), st.instE.ToUint64())
+			continue
+		}
+		st.observe(ids[i], state)
+		if state.ChosenFlag {
+			return state.AcceptValueID, false, true, nil
+		}
+		if !resp.PromisedFlag {
+			continue
+		}
+		promisedCt++
+		if state.AcceptEpoch > maxAcceptEpoch {
+			maxAcceptEpoch = state.AcceptEpoch
+			id = state.AcceptValueID
+		}
+	}
+	if promisedCt < st.er.quorum() {
+		return 0, false, false, nil
+	}
+	if maxAcceptEpoch > 0 {
+		// help-proposed
+		err = st.fetch(ctx, id)
+		if err != nil {
+			return 0, false, false, err
+		}
+		return id, true, false, nil
+	}
+	// self-proposed
+	st.own.id.SetFromUint64(e)
+	st.values[e] = st.own.Marshal()
+	st.ownIDs[e] = true
+	return e, true, false, nil
+}
+
+// accept runs the Accept phase with epoch e and AcceptValueID id.
+func (st *proposeState) accept(ctx context.Context, e uint64, id uint64) (acceptedFlag bool, err error) {
+	ids := st.er.acceptorIDs
+	valueBs := st.values[id]
+	util.AssertTrue(len(valueBs) > 0)
+	// the calls may outlive this function, so they must not read st.holders
+	onlyIDFlags := make([]bool, len(ids))
+	for i, acceptorID := range ids {
+		onlyIDFlags[i] = st.holders[id][acceptorID]
+	}
+	resps := st.p.pg.acceptorProxy.accept(ctx, ids, st.er.quorum(),
+		func(ctx context.Context, i int, c AcceptorRpcClient) (*vpb.AcceptorRpcAcceptResponse, error) {
+			req := vpb.AcceptorRpcAcceptRequest{
+				GroupName:       st.p.pg.groupName,
+				ProposerID:      st.p.id.ToUint64(),
+				AcceptorID:      ids[i].ToUint64(),
+				InstE:           st.instE.ToUint64(),
+				PreparedEpoch:   e,
+				ToAcceptValueID: id,
+			}
+			if onlyIDFlags[i] {
+				req.OnlyContainAcceptValueIDFlag = true
+			} else {
+				req.ToAcceptValueBs = valueBs
+			}
+			resp, err := c.Accept(ctx, &req)
+			if err == nil && resp.StatusCode == int32(vpb.StatusCode_EAGAIN) && req.OnlyContainAcceptValueIDFlag {
+				req.OnlyContainAcceptValueIDFlag = false
+				req.ToAcceptValueBs = valueBs
+				resp, err = c.Accept(ctx, &req)
+			}
+			return resp, err
+		})
+	acceptedCt := 0
+	for i, resp := range resps {
+		if resp == nil {
+			continue
+		}
+		st.observe(ids[i], resp.AcceptorInOnePaxosInstanceState)
+		if resp.StatusCode == int32(vpb.StatusCode_OK) && resp.AcceptedFlag {
+			acceptedCt++
+		} else if resp.StatusCode != int32(vpb.StatusCode_OK) {
+			err = fmt.Errorf("acceptor %d: %s", ids[i].ToUint64(), resp.ErrStr)
+		}
+	}
+	if acceptedCt >= st.er.quorum() {
+		return true, nil
+	}
+	return false, err
+}
+
+// fetch gets the AcceptValue of id from the acceptors known to hold it at
+// first, then from the others.
+func (st *proposeState) fetch(ctx context.Context, id uint64) error {
+	if _, ok := st.values[id]; ok {
+		return nil
+	}
+	ids := make([]Epoch, 0, len(st.er.acceptorIDs))
+	for _, acceptorID := range st.er.acceptorIDs {
+		if st.holders[id][acceptorID] {
+			ids = append(ids, acceptorID)
+		}
+	}
+	for _, acceptorID := range st.er.acceptorIDs {
+		if !st.holders[id][acceptorID] {
+			ids = append(ids, acceptorID)
+		}
+	}
+	bs, acceptorID, err := st.p.pg.acceptorProxy.getAcceptValue(ctx, st.p.id, st.instE, id, ids)
+	if err != nil {
+		return err
+	}
+	st.values[id] = bs
+	st.addHolder(id, acceptorID)
+	return nil
+}
+
+// finish notifies the acceptors that id is chosen and returns its
+// AcceptValue. It waits only a quorum of them to reply.
+func (st *proposeState) finish(ctx context.Context, id uint64) (chosen *AcceptValue, ownFlag bool, err error) {
+	ids := st.er.acceptorIDs
+	st.p.pg.acceptorProxy.notifyChosen(ctx, ids, st.er.quorum(), func(i int) *vpb.AcceptorRpcChosenNotifyRequest {
+		return &vpb.AcceptorRpcChosenNotifyRequest{
+			GroupName:                    st.p.pg.groupName,
+			ProposerID:                   st.p.id.ToUint64(),
+			AcceptorID:                   ids[i].ToUint64(),
+			InstE:                        st.instE.ToUint64(),
+			AcceptValueID:                id,
+			OnlyContainAcceptValueIDFlag: true,
+		}
+	})
+	var v AcceptValue
+	if st.ownIDs[id] {
+		v = st.own
+		v.id.SetFromUint64(id)
+		ownFlag = true
+	} else {
+		err = st.fetch(ctx, id)
+		if err != nil {
+			return nil, false, err
+		}
+		err = v.UnMarshal(st.values[id])
+		if err != nil {
+			vlog.Errorf("proposer %d: the accept value %d of inst %d is invalid: %v",
+				st.p.id.ToUint64(), id, st.instE.ToUint64(), err)
+			return nil, false, fmt.Errorf("the chosen accept value %d is invalid: %v", id, err)
+		}
+	}
+	st.p.pg.learnerOnChosen(st.instE, id, &v)
+	return &v, ownFlag, nil
+}
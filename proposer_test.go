@@ -0,0 +1,150 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package veela
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	vpb "github.com/turingcell/veela/proto/veela"
+)
+
+func newTestProposer(t *testing.T, pg *PaxosGroup, id Epoch, er ElectionResult) *Proposer {
+	t.Helper()
+	p, err := pg.NewProposer(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.AddElectionResult(er)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func propose(t *testing.T, p *Proposer, instE Epoch, body string) (string, bool) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	chosen, ownFlag, err := p.Propose(ctx, instE, testAcceptValue(t, 0, body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(chosen.GetBody()), ownFlag
+}
+
+// One round across 3 in-process acceptors, one of which is unreachable.
+func TestProposeOneRound(t *testing.T) {
+	pg, as, er := newTestGroup(t, 3, 2, 4)
+	defer func() {
+		for _, a := range as {
+			a.Close()
+		}
+	}()
+	p1 := newTestProposer(t, pg, 1, er)
+	p2 := newTestProposer(t, pg, 2, er)
+
+	body, ownFlag := propose(t, p1, 1, "a")
+	if body != "a" || !ownFlag {
+		t.Fatalf("got %q %v", body, ownFlag)
+	}
+	// the chosen one is kept
+	body, ownFlag = propose(t, p2, 1, "b")
+	if body != "a" || ownFlag {
+		t.Fatalf("got %q %v", body, ownFlag)
+	}
+	body, ownFlag = propose(t, p2, 2, "c")
+	if body != "c" || !ownFlag {
+		t.Fatalf("got %q %v", body, ownFlag)
+	}
+	// both the reachable ones are notified as a quorum
+	for _, a := range as[:2] {
+		r := a.GetAcceptValueByID(&vpb.AcceptorRpcGetAcceptValueByIDRequest{GroupName: testGroupName,
+			AcceptorID: a.id.ToUint64(), InstE: 1})
+		if r.StatusCode != int32(vpb.StatusCode_OK) || !r.AcceptorInOnePaxosInstanceState.ChosenFlag {
+			t.Fatalf("acceptor %d got %+v", a.id.ToUint64(), r)
+		}
+	}
+}
+
+// A value accepted by a quorum but never notified as chosen is proposed
+// again by the next proposer.
+func TestProposeAfterAcceptedOnly(t *testing.T) {
+	_, as, er := newTestGroup(t, 3, 3, 4)
+	for _, a := range as[:2] {
+		runAcceptorSteps(t, a, []acceptorStep{
+			{"accept", acceptStep(t, 1, 3, 3, "x"), vpb.StatusCode_OK, true, nil},
+		})
+	}
+	p := newTestProposer(t, as[0].pg, 1, er)
+	body, ownFlag := propose(t, p, 1, "y")
+	if body != "x" || ownFlag {
+		t.Fatalf("got %q %v", body, ownFlag)
+	}
+}
+
+// statelessClient replies without the AcceptorInOnePaxosInstanceState like
+// a buggy peer.
+type statelessClient struct {
+	localAcceptorClient
+}
+
+func (c statelessClient) Prepare(ctx context.Context, req *vpb.AcceptorRpcPrepareRequest) (
+	*vpb.AcceptorRpcPrepareResponese, error) {
+
+	resp, err := c.localAcceptorClient.Prepare(ctx, req)
+	if resp != nil {
+		resp.AcceptorInOnePaxosInstanceState = nil
+	}
+	return resp, err
+}
+
+func (c statelessClient) Accept(ctx context.Context, req *vpb.AcceptorRpcAcceptRequest) (
+	*vpb.AcceptorRpcAcceptResponse, error) {
+
+	resp, err := c.localAcceptorClient.Accept(ctx, req)
+	if resp != nil {
+		resp.AcceptorInOnePaxosInstanceState = nil
+	}
+	return resp, err
+}
+
+// statelessDialer dials the acceptor whose id is the port of the addr.
+type statelessDialer map[Epoch]*Acceptor
+
+func (d statelessDialer) DialAcceptor(addr NetworkAddr) (AcceptorRpcClient, error) {
+	return statelessClient{localAcceptorClient{a: d[Epoch(addr.port)]}}, nil
+}
+
+// The promises without the state are not counted.
+func TestProposeIgnoresStatelessReplies(t *testing.T) {
+	pg, as, er := newTestGroup(t, 3, 1, 4)
+	ap := pg.GetAcceptorProxy()
+	ap.SetDialer(statelessDialer{2: as[1], 3: as[2]})
+	addrs := vpb.AcceptorIDMapToNetworkAddr{AcceptorIDMapToNetworkAddr: make(map[uint64]*vpb.NetworkAddr)}
+	for _, id := range []uint64{2, 3} {
+		addrs.AcceptorIDMapToNetworkAddr[id] = &vpb.NetworkAddr{Protocol: "test", Ip: "127.0.0.1", Port: uint32(id)}
+	}
+	if err := ap.SetAcceptorAddrs(addrs); err != nil {
+		t.Fatal(err)
+	}
+	p := newTestProposer(t, pg, 1, er)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, _, err := p.Propose(ctx, 1, testAcceptValue(t, 0, "a")); err == nil {
+		t.Fatal("expect no quorum")
+	}
+}
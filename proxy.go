@@ -0,0 +1,348 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package veela
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	vpb "github.com/turingcell/veela/proto/veela"
+)
+
+// The AcceptorProxy is where the proposers and the learner of a PaxosGroup
+// reach the acceptors. The acceptors added by AddAcceptor are called directly
+// with the same request and response objects, the others are called by the
+// clients from the AcceptorDialer with their NetworkAddr, so the same code
+// works with any placement of the roles.
+
+const DefaultAcceptorRpcTimeout = time.Second
+
+// AcceptorDialer returns the clients of the remote acceptors.
+type AcceptorDialer interface {
+	// It is called without the mux of the AcceptorProxy held, concurrent
+	// calls for the same acceptor may happen and only one client is kept.
+	// The client is reused until the addr of the acceptor changes.
+	DialAcceptor(addr NetworkAddr) (AcceptorRpcClient, error)
+}
+
+func newAcceptorProxy(pg *PaxosGroup) *AcceptorProxy {
+	return &AcceptorProxy{
+		pg:         pg,
+		addrs:      make(map[Epoch]NetworkAddr),
+		remotes:    make(map[Epoch]AcceptorRpcClient),
+		rpcTimeout: DefaultAcceptorRpcTimeout,
+	}
+}
+
+func (pg *PaxosGroup) GetAcceptorProxy() *AcceptorProxy {
+	return pg.acceptorProxy
+}
+
+func (ap *AcceptorProxy) SetDialer(dialer AcceptorDialer) {
+	ap.mux.Lock()
+	defer ap.mux.Unlock()
+	ap.dialer = dialer
+	ap.remotes = make(map[Epoch]AcceptorRpcClient)
+}
+
+// SetRpcTimeout sets the timeout of every rpc sent by the proxy, 0 means
+// DefaultAcceptorRpcTimeout.
+func (ap *AcceptorProxy) SetRpcTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = DefaultAcceptorRpcTimeout
+	}
+	ap.mux.Lock()
+	defer ap.mux.Unlock()
+	ap.rpcTimeout = timeout
+}
+
+// SetAcceptorAddrs sets the addrs of the acceptors, which override the ones
+// known from the acceptors and ElectionResults.
+func (ap *AcceptorProxy) SetAcceptorAddrs(m vpb.AcceptorIDMapToNetworkAddr) error {
+	addrs := make(map[Epoch]NetworkAddr, len(m.AcceptorIDMapToNetworkAddr))
+	for id, pbAddr := range m.AcceptorIDMapToNetworkAddr {
+		addr, err := networkAddrFromPb(pbAddr)
+		if err != nil {
+			return fmt.Errorf("the addr of acceptor %d: %v", id, err)
+		}
+		addrs[Epoch(id)] = addr
+	}
+	ap.mux.Lock()
+	defer ap.mux.Unlock()
+	for id, addr := range addrs {
+		ap.setAddr(id, addr)
+	}
+	return nil
+}
+
+// addAddrHints adds the addrs of the acceptors not known yet, the invalid
+// ones are skipped.
+func (ap *AcceptorProxy) addAddrHints(m *vpb.AcceptorIDMapToNetworkAddr) {
+	if m == nil {
+		return
+	}
+	ap.mux.Lock()
+	defer ap.mux.Unlock()
+	for id, pbAddr := range m.AcceptorIDMapToNetworkAddr {
+		if _, ok := ap.addrs[Epoch(id)]; ok {
+			continue
+		}
+		addr, err := networkAddrFromPb(pbAddr)
+		if err != nil {
+			vlog.Warnf("skip the addr of acceptor %d: %v", id, err)
+			continue
+		}
+		ap.setAddr(Epoch(id), addr)
+	}
+}
+
+func (ap *AcceptorProxy) addElectionResultHints(er *ElectionResult) {
+	ap.mux.Lock()
+	defer ap.mux.Unlock()
+	for i, addr := range er.acceptorAddrHints {
+		if _, ok := ap.addrs[er.acceptorIDs[i]]; !ok {
+			ap.setAddr(er.acceptorIDs[i], addr)
+		}
+	}
+}
+
+func (ap *AcceptorProxy) setAddr(id Epoch, addr NetworkAddr) {
+	if old, ok := ap.addrs[id]; ok && sameAddr(old, addr) {
+		return
+	}
+	ap.addrs[id] = addr
+	delete(ap.remotes, id)
+}
+
+func sameAddr(a, b NetworkAddr) bool {
+	return a.flag == b.flag && a.ip.Equal(b.ip) && a.port == b.port
+}
+
+// client returns the client of the acceptor id.
+func (ap *AcceptorProxy) client(id Epoch) (AcceptorRpcClient, error) {
+	ap.pg.mux.Lock()
+	a := ap.pg.acceptorMap[id]
+	ap.pg.mux.Unlock()
+	if a != nil {
+		return localAcceptorClient{a: a}, nil
+	}
+	ap.mux.Lock()
+	c, ok := ap.remotes[id]
+	addr, addrFlag := ap.addrs[id]
+	dialer := ap.dialer
+	ap.mux.Unlock()
+	if ok {
+		return c, nil
+	}
+	if !addrFlag {
+		return nil, fmt.Errorf("the addr of acceptor %d is unknown", id.ToUint64())
+	}
+	if dialer == nil {
+		return nil, fmt.Errorf("acceptor %d is remote but there is no AcceptorDialer", id.ToUint64())
+	}
+	c, err := dialer.DialAcceptor(addr)
+	if err != nil {
+		return nil, fmt.Errorf("dial acceptor %d at %s: %v", id.ToUint64(), addr.String(), err)
+	}
+	ap.mux.Lock()
+	defer ap.mux.Unlock()
+	// another one may have dialed meanwhile, the client dialed to an addr
+	// changed meanwhile is used once but not kept
+	if old, ok := ap.remotes[id]; ok {
+		closeClient(c)
+		return old, nil
+	}
+	if cur, ok := ap.addrs[id]; ok && sameAddr(cur, addr) {
+		ap.remotes[id] = c
+	}
+	return c, nil
+}
+
+// closeClient closes c if it could be closed.
+func closeClient(c AcceptorRpcClient) {
+	if closer, ok := c.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+func (ap *AcceptorProxy) getRpcTimeout() time.Duration {
+	ap.mux.Lock()
+	defer ap.mux.Unlock()
+	return ap.rpcTimeout
+}
+
+type acceptorReply struct {
+	i      int
+	resp   interface{}
+	okFlag bool
+}
+
+// fanOut calls call with the client of each of ids concurrently, every call
+// is limited by the rpc timeout. It returns the responses indexed as ids once
+// quorum calls returned ok, all of them returned, or ctx is done. The calls
+// still running go on in background and their responses are dropped, call
+// should not touch anything changed after fanOut returns. The response of a
+// failed call should be nil.
+func (ap *AcceptorProxy) fanOut(ctx context.Context, ids []Epoch, quorum int,
+	call func(ctx context.Context, i int, c AcceptorRpcClient) (resp interface{}, okFlag bool)) []interface{} {
+
+	resps := make([]interface{}, len(ids))
+	replyCh := make(chan acceptorReply, len(ids))
+	timeout := ap.getRpcTimeout()
+	pendingCt := 0
+	for i, id := range ids {
+		c, err := ap.client(id)
+		if err != nil {
+			continue
+		}
+		pendingCt++
+		go func(i int, c AcceptorRpcClient) {
+			callCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			resp, okFlag := call(callCtx, i, c)
+			replyCh <- acceptorReply{i: i, resp: resp, okFlag: okFlag}
+		}(i, c)
+	}
+	okCt := 0
+	for ; pendingCt > 0 && okCt < quorum; pendingCt-- {
+		select {
+		case r := <-replyCh:
+			resps[r.i] = r.resp
+			if r.okFlag {
+				okCt++
+			}
+		case <-ctx.Done():
+			return resps
+		}
+	}
+	return resps
+}
+
+// prepare returns once quorum acceptors promised or any of them replied the
+// inst is chosen.
+func (ap *AcceptorProxy) prepare(ctx context.Context, ids []Epoch, quorum int,
+	call func(ctx context.Context, i int, c AcceptorRpcClient) (*vpb.AcceptorRpcPrepareResponese, error)) []*vpb.AcceptorRpcPrepareResponese {
+
+	replies := ap.fanOut(ctx, ids, quorum, func(ctx context.Context, i int, c AcceptorRpcClient) (interface{}, bool) {
+		resp, err := call(ctx, i, c)
+		if err != nil {
+			return nil, false
+		}
+		okFlag := resp.StatusCode == int32(vpb.StatusCode_OK) &&
+			(resp.PromisedFlag || resp.AcceptorInOnePaxosInstanceState.GetChosenFlag())
+		return resp, okFlag
+	})
+	resps := make([]*vpb.AcceptorRpcPrepareResponese, len(ids))
+	for i, r := range replies {
+		if r != nil {
+			resps[i] = r.(*vpb.AcceptorRpcPrepareResponese)
+		}
+	}
+	return resps
+}
+
+// accept returns once quorum acceptors accepted.
+func (ap *AcceptorProxy) accept(ctx context.Context, ids []Epoch, quorum int,
+	call func(ctx context.Context, i int, c AcceptorRpcClient) (*vpb.AcceptorRpcAcceptResponse, error)) []*vpb.AcceptorRpcAcceptResponse {
+
+	replies := ap.fanOut(ctx, ids, quorum, func(ctx context.Context, i int, c AcceptorRpcClient) (interface{}, bool) {
+		resp, err := call(ctx, i, c)
+		if err != nil {
+			return nil, false
+		}
+		return resp, resp.StatusCode == int32(vpb.StatusCode_OK) && resp.AcceptedFlag
+	})
+	resps := make([]*vpb.AcceptorRpcAcceptResponse, len(ids))
+	for i, r := range replies {
+		if r != nil {
+			resps[i] = r.(*vpb.AcceptorRpcAcceptResponse)
+		}
+	}
+	return resps
+}
+
+// notifyChosen sends ChosenNotify to all of ids and returns once quorum of
+// them replied.
+func (ap *AcceptorProxy) notifyChosen(ctx context.Context, ids []Epoch, quorum int,
+	req func(i int) *vpb.AcceptorRpcChosenNotifyRequest) {
+
+	ap.fanOut(ctx, ids, quorum, func(ctx context.Context, i int, c AcceptorRpcClient) (interface{}, bool) {
+		resp, err := c.ChosenNotify(ctx, req(i))
+		if err != nil {
+			return nil, false
+		}
+		return resp, true
+	})
+}
+
+// getSummaries returns the summaries replied by ids.
+func (ap *AcceptorProxy) getSummaries(ctx context.Context, ids []Epoch,
+	req func(i int) *vpb.AcceptorRpcGetSummaryRequest) []*vpb.AcceptorStateSummary {
+
+	replies := ap.fanOut(ctx, ids, len(ids), func(ctx context.Context, i int, c AcceptorRpcClient) (interface{}, bool) {
+		resp, err := c.GetSummary(ctx, req(i))
+		if err != nil || resp.StatusCode != int32(vpb.StatusCode_OK) || resp.Summary == nil {
+			return nil, false
+		}
+		return resp.Summary, true
+	})
+	summaries := make([]*vpb.AcceptorStateSummary, len(ids))
+	for i, r := range replies {
+		if r != nil {
+			summaries[i] = r.(*vpb.AcceptorStateSummary)
+		}
+	}
+	return summaries
+}
+
+// getAcceptValue gets the marshaled AcceptValue id of instE from the first one
+// of acceptorIDs which holds it, and the id of that acceptor.
+func (ap *AcceptorProxy) getAcceptValue(ctx context.Context, proposerID Epoch, instE Epoch, id uint64,
+	acceptorIDs []Epoch) ([]byte, Epoch, error) {
+
+	timeout := ap.getRpcTimeout()
+	for _, acceptorID := range acceptorIDs {
+		c, err := ap.client(acceptorID)
+		if err != nil {
+			continue
+		}
+		callCtx, cancel := context.WithTimeout(ctx, timeout)
+		resp, err := c.GetAcceptValueByID(callCtx, &vpb.AcceptorRpcGetAcceptValueByIDRequest{
+			GroupName:      ap.pg.groupName,
+			ProposerID:     proposerID.ToUint64(),
+			AcceptorID:     acceptorID.ToUint64(),
+			InstE:          instE.ToUint64(),
+			AcceptValueIDs: []uint64{id},
+		})
+		cancel()
+		if err != nil || resp.StatusCode != int32(vpb.StatusCode_OK) {
+			continue
+		}
+		bs, ok := resp.AcceptValueIDMapToAcceptValueBs[id]
+		if !ok {
+			continue
+		}
+		var v AcceptValue
+		if v.UnMarshal(bs) != nil || v.id.ToUint64() != id {
+			vlog.Errorf("acceptor %d replied an invalid accept value %d of inst %d", acceptorID.ToUint64(), id,
+				instE.ToUint64())
+			continue
+		}
+		return bs, acceptorID, nil
+	}
+	return nil, 0, fmt.Errorf("could not get the accept value %d of inst %d from any acceptor", id, instE.ToUint64())
+}
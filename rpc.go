@@ -0,0 +1,83 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package veela
+
+import (
+	"context"
+
+	vpb "github.com/turingcell/veela/proto/veela"
+)
+
+// AcceptorRpcClient sends the acceptor rpcs to one acceptor. A non-nil error
+// means no response is received, the errors of the acceptor itself are
+// replied by the StatusCode and errStr of the responses.
+type AcceptorRpcClient interface {
+	Prepare(ctx context.Context, req *vpb.AcceptorRpcPrepareRequest) (*vpb.AcceptorRpcPrepareResponese, error)
+	Accept(ctx context.Context, req *vpb.AcceptorRpcAcceptRequest) (*vpb.AcceptorRpcAcceptResponse, error)
+	ChosenNotify(ctx context.Context, req *vpb.AcceptorRpcChosenNotifyRequest) (*vpb.AcceptorRpcChosenNotifyResponse, error)
+	GetAcceptValueByID(ctx context.Context, req *vpb.AcceptorRpcGetAcceptValueByIDRequest) (
+		*vpb.AcceptorRpcGetAcceptValueByIDResponse, error)
+	GetSummary(ctx context.Context, req *vpb.AcceptorRpcGetSummaryRequest) (*vpb.AcceptorRpcGetSummaryResponse, error)
+}
+
+// localAcceptorClient calls the acceptor in this process directly.
+type localAcceptorClient struct {
+	a *Acceptor
+}
+
+func (c localAcceptorClient) Prepare(ctx context.Context, req *vpb.AcceptorRpcPrepareRequest) (
+	*vpb.AcceptorRpcPrepareResponese, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.a.Prepare(req), nil
+}
+
+func (c localAcceptorClient) Accept(ctx context.Context, req *vpb.AcceptorRpcAcceptRequest) (
+	*vpb.AcceptorRpcAcceptResponse, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.a.Accept(req), nil
+}
+
+func (c localAcceptorClient) ChosenNotify(ctx context.Context, req *vpb.AcceptorRpcChosenNotifyRequest) (
+	*vpb.AcceptorRpcChosenNotifyResponse, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.a.ChosenNotify(req), nil
+}
+
+func (c localAcceptorClient) GetAcceptValueByID(ctx context.Context, req *vpb.AcceptorRpcGetAcceptValueByIDRequest) (
+	*vpb.AcceptorRpcGetAcceptValueByIDResponse, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.a.GetAcceptValueByID(req), nil
+}
+
+func (c localAcceptorClient) GetSummary(ctx context.Context, req *vpb.AcceptorRpcGetSummaryRequest) (
+	*vpb.AcceptorRpcGetSummaryResponse, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.a.GetSummary(req), nil
+}
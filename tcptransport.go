@@ -0,0 +1,412 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package veela
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/turingcell/veela/util"
+)
+
+// TCPTransport is the default Transport of the protocol "tcp". Every frame
+// is a length-prefixed marshaled protobuf message:
+//
+//	request:  uint32(lenOfBody) uint8(RpcMethod) Body
+//	response: uint32(lenOfBody) uint8(status) Body
+//
+// A status 0 means Body is the response, otherwise Body is the error string
+// returned by the handler. The integers are big endian.
+//
+// A connection carries one call at a time, the idle connections to each peer
+// are pooled and reused. A peer failed to dial is not dialed again until a
+// backoff doubling from MinReconnectBackoff up to MaxReconnectBackoff, the
+// calls to it fail at once meanwhile. The deadline of ctx is set on the
+// connection for each call, and a canceled call closes its connection.
+
+const TCPProtocol = "tcp"
+
+const (
+	DefaultTCPMaxIdleConnsPerPeer = 4
+	DefaultTCPDialTimeout         = 3 * time.Second
+	DefaultTCPMinReconnectBackoff = 50 * time.Millisecond
+	DefaultTCPMaxReconnectBackoff = 5 * time.Second
+	DefaultTCPMaxFrameSize        = 64 << 20
+
+	tcpFrameHeaderLen = 4 + 1
+)
+
+// Zero value of each member means the default.
+// A nil *TCPTransportOptions is the same as a zero TCPTransportOptions.
+type TCPTransportOptions struct {
+	MaxIdleConnsPerPeer int
+	DialTimeout         time.Duration
+	MinReconnectBackoff time.Duration
+	MaxReconnectBackoff time.Duration
+	// The frames with a longer body are rejected by both sides.
+	MaxFrameSize uint32
+}
+
+func (o *TCPTransportOptions) withDefaults() TCPTransportOptions {
+	var ret TCPTransportOptions
+	if o != nil {
+		ret = *o
+	}
+	if ret.MaxIdleConnsPerPeer == 0 {
+		ret.MaxIdleConnsPerPeer = DefaultTCPMaxIdleConnsPerPeer
+	}
+	if ret.DialTimeout == 0 {
+		ret.DialTimeout = DefaultTCPDialTimeout
+	}
+	if ret.MinReconnectBackoff == 0 {
+		ret.MinReconnectBackoff = DefaultTCPMinReconnectBackoff
+	}
+	if ret.MaxReconnectBackoff == 0 {
+		ret.MaxReconnectBackoff = DefaultTCPMaxReconnectBackoff
+	}
+	if ret.MaxReconnectBackoff < ret.MinReconnectBackoff {
+		ret.MaxReconnectBackoff = ret.MinReconnectBackoff
+	}
+	if ret.MaxFrameSize == 0 {
+		ret.MaxFrameSize = DefaultTCPMaxFrameSize
+	}
+	return ret
+}
+
+var errTransportClosed = errors.New("transport is closed")
+
+type TCPTransport struct {
+	opts TCPTransportOptions
+
+	mux         sync.Mutex
+	closedFlag  bool
+	peers       map[string]*tcpPeer
+	listeners   []net.Listener
+	serverConns map[net.Conn]struct{}
+	serverWg    sync.WaitGroup
+}
+
+type tcpPeer struct {
+	idleConns []net.Conn
+	// the dial failures in a row
+	failCt     int
+	nextDialAt time.Time
+	lastErr    error
+}
+
+func NewTCPTransport(opts *TCPTransportOptions) *TCPTransport {
+	return &TCPTransport{
+		opts:        opts.withDefaults(),
+		peers:       make(map[string]*tcpPeer),
+		serverConns: make(map[net.Conn]struct{}),
+	}
+}
+
+func (t *TCPTransport) Protocol() string {
+	return TCPProtocol
+}
+
+func (t *TCPTransport) Call(ctx context.Context, addr NetworkAddr, method RpcMethod, req []byte) ([]byte, error) {
+	if uint64(len(req)) > uint64(t.opts.MaxFrameSize) {
+		return nil, fmt.Errorf("request of %dB exceeds MaxFrameSize", len(req))
+	}
+	key := addr.String()
+	conn, reusedFlag, err := t.getConn(ctx, key, false)
+	if err != nil {
+		return nil, err
+	}
+	resp, status, respFlag, err := t.roundTrip(ctx, conn, uint8(method), req)
+	if err != nil && reusedFlag && !respFlag && ctx.Err() == nil {
+		// the idle conn may be closed by the peer meanwhile, retry once on a
+		// fresh one
+		conn.Close()
+		conn, _, err = t.getConn(ctx, key, true)
+		if err != nil {
+			return nil, err
+		}
+		resp, status, _, err = t.roundTrip(ctx, conn, uint8(method), req)
+	}
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("call %s on %s: %v", method, key, err)
+	}
+	t.putConn(key, conn)
+	if status != 0 {
+		return nil, fmt.Errorf("call %s on %s: remote error: %s", method, key, resp)
+	}
+	return resp, nil
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r  io.Reader
+	ct int
+}
+
+func (cr *countingReader) Read(bs []byte) (int, error) {
+	n, err := cr.r.Read(bs)
+	cr.ct += n
+	return n, err
+}
+
+// roundTrip writes one request frame and reads its response frame within
+// the deadline of ctx, a canceled ctx interrupts it. respFlag is true if any
+// byte of the response is read.
+func (t *TCPTransport) roundTrip(ctx context.Context, conn net.Conn, method uint8, req []byte) (
+	resp []byte, status uint8, respFlag bool, err error) {
+
+	deadline, _ := ctx.Deadline()
+	err = conn.SetDeadline(deadline)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	stopCh := make(chan struct{})
+	watcherDoneCh := make(chan struct{})
+	go func() {
+		defer close(watcherDoneCh)
+		select {
+		case <-ctx.Done():
+			// unblock the reads and writes
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-stopCh:
+		}
+	}()
+	defer func() {
+		close(stopCh)
+		<-watcherDoneCh
+	}()
+	err = writeTCPFrame(conn, method, req)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	cr := &countingReader{r: conn}
+	resp, status, err = readTCPFrame(cr, t.opts.MaxFrameSize)
+	return resp, status, cr.ct > 0, err
+}
+
+func writeTCPFrame(conn net.Conn, kind uint8, body []byte) error {
+	bs := make([]byte, tcpFrameHeaderLen+len(body))
+	util.U32SetBs(bs, util.IntToUint32Assert(len(body)))
+	bs[4] = kind
+	copy(bs[tcpFrameHeaderLen:], body)
+	_, err := conn.Write(bs)
+	return err
+}
+
+func readTCPFrame(conn io.Reader, maxFrameSize uint32) (body []byte, kind uint8, err error) {
+	var header [tcpFrameHeaderLen]byte
+	_, err = io.ReadFull(conn, header[:])
+	if err != nil {
+		return nil, 0, err
+	}
+	bodyLen := util.BsReadU32(header[:])
+	if bodyLen > maxFrameSize {
+		return nil, 0, fmt.Errorf("frame of %dB exceeds MaxFrameSize", bodyLen)
+	}
+	body = make([]byte, bodyLen)
+	_, err = io.ReadFull(conn, body)
+	if err != nil {
+		return nil, 0, err
+	}
+	return body, header[4], nil
+}
+
+// getConn returns an idle conn to key, reusedFlag is true, or dials a new one
+// if there is none or dialFlag.
+func (t *TCPTransport) getConn(ctx context.Context, key string, dialFlag bool) (
+	conn net.Conn, reusedFlag bool, err error) {
+
+	t.mux.Lock()
+	if t.closedFlag {
+		t.mux.Unlock()
+		return nil, false, errTransportClosed
+	}
+	p := t.peers[key]
+	if p == nil {
+		p = &tcpPeer{}
+		t.peers[key] = p
+	}
+	if n := len(p.idleConns); n > 0 && !dialFlag {
+		conn = p.idleConns[n-1]
+		p.idleConns = p.idleConns[:n-1]
+		t.mux.Unlock()
+		return conn, true, nil
+	}
+	if time.Now().Before(p.nextDialAt) {
+		err = fmt.Errorf("dial %s: in reconnect backoff after: %v", key, p.lastErr)
+		t.mux.Unlock()
+		return nil, false, err
+	}
+	t.mux.Unlock()
+
+	dialer := net.Dialer{Timeout: t.opts.DialTimeout}
+	conn, err = dialer.DialContext(ctx, "tcp", key)
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, false, ctx.Err()
+		}
+		p.failCt++
+		backoff := t.opts.MaxReconnectBackoff
+		if p.failCt < 32 && t.opts.MinReconnectBackoff<<uint(p.failCt-1) < backoff {
+			backoff = t.opts.MinReconnectBackoff << uint(p.failCt-1)
+		}
+		p.nextDialAt = time.Now().Add(backoff)
+		p.lastErr = err
+		return nil, false, err
+	}
+	p.failCt = 0
+	p.nextDialAt = time.Time{}
+	p.lastErr = nil
+	if t.closedFlag {
+		conn.Close()
+		return nil, false, errTransportClosed
+	}
+	return conn, false, nil
+}
+
+func (t *TCPTransport) putConn(key string, conn net.Conn) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	p := t.peers[key]
+	if t.closedFlag || p == nil || len(p.idleConns) >= t.opts.MaxIdleConnsPerPeer {
+		conn.Close()
+		return
+	}
+	p.idleConns = append(p.idleConns, conn)
+}
+
+func (t *TCPTransport) Listen(addr NetworkAddr, handler TransportHandler) (NetworkAddr, error) {
+	if addr.flag != "" && addr.flag != TCPProtocol {
+		return NetworkAddr{}, fmt.Errorf("TCPTransport could not listen on protocol %q", addr.flag)
+	}
+	ln, err := net.Listen("tcp", addr.String())
+	if err != nil {
+		return NetworkAddr{}, err
+	}
+	t.mux.Lock()
+	if t.closedFlag {
+		t.mux.Unlock()
+		ln.Close()
+		return NetworkAddr{}, errTransportClosed
+	}
+	t.listeners = append(t.listeners, ln)
+	t.serverWg.Add(1)
+	t.mux.Unlock()
+	go t.acceptLoop(ln, handler)
+	tcpAddr := ln.Addr().(*net.TCPAddr)
+	return NewNetworkAddr(TCPProtocol, tcpAddr.IP, uint16(tcpAddr.Port)), nil
+}
+
+func (t *TCPTransport) acceptLoop(ln net.Listener, handler TransportHandler) {
+	defer t.serverWg.Done()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.mux.Lock()
+			closedFlag := t.closedFlag
+			t.mux.Unlock()
+			if closedFlag {
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			vlog.Errorf("tcp transport stops listening on %s: %v", ln.Addr(), err)
+			return
+		}
+		t.mux.Lock()
+		if t.closedFlag {
+			t.mux.Unlock()
+			conn.Close()
+			return
+		}
+		t.serverConns[conn] = struct{}{}
+		t.serverWg.Add(1)
+		t.mux.Unlock()
+		go t.serveConn(conn, handler)
+	}
+}
+
+func (t *TCPTransport) serveConn(conn net.Conn, handler TransportHandler) {
+	defer t.serverWg.Done()
+	defer func() {
+		conn.Close()
+		t.mux.Lock()
+		delete(t.serverConns, conn)
+		t.mux.Unlock()
+	}()
+	for {
+		req, method, err := readTCPFrame(conn, t.opts.MaxFrameSize)
+		if err != nil {
+			t.mux.Lock()
+			closedFlag := t.closedFlag
+			t.mux.Unlock()
+			if err != io.EOF && !closedFlag {
+				vlog.Debugf("tcp transport: read from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		var status uint8
+		resp, err := handler(RpcMethod(method), req)
+		if err == nil && uint64(len(resp)) > uint64(t.opts.MaxFrameSize) {
+			err = fmt.Errorf("response of %dB exceeds MaxFrameSize", len(resp))
+		}
+		if err != nil {
+			status = 1
+			resp = []byte(err.Error())
+		}
+		err = writeTCPFrame(conn, status, resp)
+		if err != nil {
+			vlog.Debugf("tcp transport: write to %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+// Close also waits all the handlers running to return.
+func (t *TCPTransport) Close() error {
+	t.mux.Lock()
+	if t.closedFlag {
+		t.mux.Unlock()
+		return nil
+	}
+	t.closedFlag = true
+	for _, ln := range t.listeners {
+		ln.Close()
+	}
+	for conn := range t.serverConns {
+		conn.Close()
+	}
+	for _, p := range t.peers {
+		for _, conn := range p.idleConns {
+			conn.Close()
+		}
+		p.idleConns = nil
+	}
+	t.mux.Unlock()
+	t.serverWg.Wait()
+	return nil
+}
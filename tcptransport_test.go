@@ -0,0 +1,53 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package veela
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// A pooled conn closed by the peer while idle is replaced transparently.
+func TestTCPTransportRetryStaleConn(t *testing.T) {
+	server := NewTCPTransport(nil)
+	defer server.Close()
+	addr, err := server.Listen(NewNetworkAddr(TCPProtocol, net.IPv4(127, 0, 0, 1), 0),
+		func(method RpcMethod, req []byte) ([]byte, error) { return req, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewTCPTransport(nil)
+	defer client.Close()
+	call := func() {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		resp, err := client.Call(ctx, addr, RpcMethodPrepare, []byte("ping"))
+		if err != nil || string(resp) != "ping" {
+			t.Fatalf("got %q %v", resp, err)
+		}
+	}
+	call()
+	server.mux.Lock()
+	for conn := range server.serverConns {
+		conn.Close()
+	}
+	server.mux.Unlock()
+	// wait for the close to reach the client
+	time.Sleep(50 * time.Millisecond)
+	call()
+}
@@ -0,0 +1,270 @@
+// Copyright 2021 The Veela Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package veela
+
+import (
+	"context"
+	"fmt"
+
+	vpb "github.com/turingcell/veela/proto/veela"
+)
+
+// A Transport carries the marshaled acceptor rpcs between the processes, the
+// network layer could be replaced by implementing it, see TCPTransport for
+// the default one. The processes serving the acceptors call ServeAcceptors,
+// and the others reach them by the AcceptorDialer from NewTransportDialer.
+type Transport interface {
+	// The protocol of the NetworkAddrs this transport serves, e.g. "tcp".
+	Protocol() string
+	// Call sends req of method to addr and returns the response. ctx bounds
+	// the whole call. It is safe for concurrent use, the connections to each
+	// peer are managed by the transport.
+	Call(ctx context.Context, addr NetworkAddr, method RpcMethod, req []byte) (resp []byte, err error)
+	// Listen serves the requests received at addr with handler in background
+	// until Close, and returns the addr actually listened on, e.g. with the
+	// port chosen by the system for the port 0.
+	Listen(addr NetworkAddr, handler TransportHandler) (NetworkAddr, error)
+	// Close stops serving and closes all the connections, the calls running
+	// fail.
+	Close() error
+}
+
+// TransportHandler serves one request, the error is returned to the caller of
+// Call as an error.
+type TransportHandler func(method RpcMethod, req []byte) (resp []byte, err error)
+
+type RpcMethod uint8
+
+const (
+	RpcMethodPrepare RpcMethod = iota + 1
+	RpcMethodAccept
+	RpcMethodChosenNotify
+	RpcMethodGetAcceptValueByID
+	RpcMethodGetSummary
+)
+
+func (m RpcMethod) String() string {
+	switch m {
+	case RpcMethodPrepare:
+		return "Prepare"
+	case RpcMethodAccept:
+		return "Accept"
+	case RpcMethodChosenNotify:
+		return "ChosenNotify"
+	case RpcMethodGetAcceptValueByID:
+		return "GetAcceptValueByID"
+	case RpcMethodGetSummary:
+		return "GetSummary"
+	}
+	return fmt.Sprintf("RpcMethod(%d)", uint8(m))
+}
+
+type transportDialer struct {
+	transports []Transport
+}
+
+// NewTransportDialer returns the AcceptorDialer which sends the rpcs by the
+// transport of the protocol of each NetworkAddr, an empty protocol means the
+// first one of transports.
+func NewTransportDialer(transports ...Transport) AcceptorDialer {
+	return transportDialer{transports: append([]Transport(nil), transports...)}
+}
+
+func (d transportDialer) DialAcceptor(addr NetworkAddr) (AcceptorRpcClient, error) {
+	for i, t := range d.transports {
+		if addr.flag == t.Protocol() || (addr.flag == "" && i == 0) {
+			return transportAcceptorClient{t: t, addr: addr}, nil
+		}
+	}
+	return nil, fmt.Errorf("no transport for protocol %q", addr.flag)
+}
+
+type pbMessage interface {
+	Marshal() ([]byte, error)
+	Unmarshal(bs []byte) error
+}
+
+// transportAcceptorClient sends the marshaled rpcs to the acceptor at addr.
+type transportAcceptorClient struct {
+	t    Transport
+	addr NetworkAddr
+}
+
+func (c transportAcceptorClient) call(ctx context.Context, method RpcMethod, req pbMessage, resp pbMessage) error {
+	reqBs, err := req.Marshal()
+	if err != nil {
+		return err
+	}
+	respBs, err := c.t.Call(ctx, c.addr, method, reqBs)
+	if err != nil {
+		return err
+	}
+	err = resp.Unmarshal(respBs)
+	if err != nil {
+		return fmt.Errorf("invalid %s response from %s: %v", method, c.addr.String(), err)
+	}
+	return nil
+}
+
+func (c transportAcceptorClient) Prepare(ctx context.Context, req *vpb.AcceptorRpcPrepareRequest) (
+	*vpb.AcceptorRpcPrepareResponese, error) {
+
+	var resp vpb.AcceptorRpcPrepareResponese
+	err := c.call(ctx, RpcMethodPrepare, req, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c transportAcceptorClient) Accept(ctx context.Context, req *vpb.AcceptorRpcAcceptRequest) (
+	*vpb.AcceptorRpcAcceptResponse, error) {
+
+	var resp vpb.AcceptorRpcAcceptResponse
+	err := c.call(ctx, RpcMethodAccept, req, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c transportAcceptorClient) ChosenNotify(ctx context.Context, req *vpb.AcceptorRpcChosenNotifyRequest) (
+	*vpb.AcceptorRpcChosenNotifyResponse, error) {
+
+	var resp vpb.AcceptorRpcChosenNotifyResponse
+	err := c.call(ctx, RpcMethodChosenNotify, req, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c transportAcceptorClient) GetAcceptValueByID(ctx context.Context, req *vpb.AcceptorRpcGetAcceptValueByIDRequest) (
+	*vpb.AcceptorRpcGetAcceptValueByIDResponse, error) {
+
+	var resp vpb.AcceptorRpcGetAcceptValueByIDResponse
+	err := c.call(ctx, RpcMethodGetAcceptValueByID, req, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c transportAcceptorClient) GetSummary(ctx context.Context, req *vpb.AcceptorRpcGetSummaryRequest) (
+	*vpb.AcceptorRpcGetSummaryResponse, error) {
+
+	var resp vpb.AcceptorRpcGetSummaryResponse
+	err := c.call(ctx, RpcMethodGetSummary, req, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ServeAcceptors serves the rpcs to the acceptors added by AddAcceptor at
+// addr by t, and returns the addr actually listened on.
+func (pg *PaxosGroup) ServeAcceptors(t Transport, addr NetworkAddr) (NetworkAddr, error) {
+	return t.Listen(addr, pg.handleAcceptorRpc)
+}
+
+// routeAcceptorRpc returns the acceptor the rpc is sent to, or the reply if
+// there is no such acceptor here.
+func (pg *PaxosGroup) routeAcceptorRpc(groupName string, acceptorID uint64) (*Acceptor, *acceptorErr) {
+	if groupName != pg.groupName {
+		return nil, newAcceptorErr(vpb.StatusCode_GROUP_NAME_DONT_MATCH, "group name %q does not match %q",
+			groupName, pg.groupName)
+	}
+	pg.mux.Lock()
+	a := pg.acceptorMap[Epoch(acceptorID)]
+	pg.mux.Unlock()
+	if a == nil {
+		return nil, newAcceptorErr(vpb.StatusCode_ACCEPTOR_ID_DONT_MATCH, "acceptor %d is not served here", acceptorID)
+	}
+	return a, nil
+}
+
+func (pg *PaxosGroup) handleAcceptorRpc(method RpcMethod, reqBs []byte) ([]byte, error) {
+	var resp pbMessage
+	switch method {
+	case RpcMethodPrepare:
+		var req vpb.AcceptorRpcPrepareRequest
+		if err := req.Unmarshal(reqBs); err != nil {
+			return nil, err
+		}
+		a, aerr := pg.routeAcceptorRpc(req.GroupName, req.AcceptorID)
+		if a != nil {
+			resp = a.Prepare(&req)
+		} else {
+			var r vpb.AcceptorRpcPrepareResponese
+			r.StatusCode, r.ErrStr = aerr.reply()
+			resp = &r
+		}
+	case RpcMethodAccept:
+		var req vpb.AcceptorRpcAcceptRequest
+		if err := req.Unmarshal(reqBs); err != nil {
+			return nil, err
+		}
+		a, aerr := pg.routeAcceptorRpc(req.GroupName, req.AcceptorID)
+		if a != nil {
+			resp = a.Accept(&req)
+		} else {
+			var r vpb.AcceptorRpcAcceptResponse
+			r.StatusCode, r.ErrStr = aerr.reply()
+			resp = &r
+		}
+	case RpcMethodChosenNotify:
+		var req vpb.AcceptorRpcChosenNotifyRequest
+		if err := req.Unmarshal(reqBs); err != nil {
+			return nil, err
+		}
+		a, aerr := pg.routeAcceptorRpc(req.GroupName, req.AcceptorID)
+		if a != nil {
+			resp = a.ChosenNotify(&req)
+		} else {
+			var r vpb.AcceptorRpcChosenNotifyResponse
+			r.StatusCode, r.ErrStr = aerr.reply()
+			resp = &r
+		}
+	case RpcMethodGetAcceptValueByID:
+		var req vpb.AcceptorRpcGetAcceptValueByIDRequest
+		if err := req.Unmarshal(reqBs); err != nil {
+			return nil, err
+		}
+		a, aerr := pg.routeAcceptorRpc(req.GroupName, req.AcceptorID)
+		if a != nil {
+			resp = a.GetAcceptValueByID(&req)
+		} else {
+			var r vpb.AcceptorRpcGetAcceptValueByIDResponse
+			r.StatusCode, r.ErrStr = aerr.reply()
+			resp = &r
+		}
+	case RpcMethodGetSummary:
+		var req vpb.AcceptorRpcGetSummaryRequest
+		if err := req.Unmarshal(reqBs); err != nil {
+			return nil, err
+		}
+		a, aerr := pg.routeAcceptorRpc(req.GroupName, req.AcceptorID)
+		if a != nil {
+			resp = a.GetSummary(&req)
+		} else {
+			var r vpb.AcceptorRpcGetSummaryResponse
+			r.StatusCode, r.ErrStr = aerr.reply()
+			resp = &r
+		}
+	default:
+		return nil, fmt.Errorf("unknown rpc method %d", uint8(method))
+	}
+	return resp.Marshal()
+}
@@ -54,6 +54,16 @@ func AssertTrue(b bool) {
 	}
 }
 
+func U16SetBs(bs []byte, u16 uint16) {
+	bs[0] = byte(u16 >> 8)
+	bs[1] = byte(u16 >> 0)
+}
+
+func BsReadU16(bs []byte) (u16 uint16) {
+	u16 = uint16(bs[0])<<8 + uint16(bs[1])<<0
+	return
+}
+
 func U32SetBs(bs []byte, u32 uint32) {
 	bs[0] = byte(u32 >> 24)
 	bs[1] = byte(u32 >> 16)
@@ -15,12 +15,16 @@
 package veela
 
 import (
+	"context"
 	"fmt"
+	"math"
 	"net"
+	"strconv"
 	"sync"
+	"time"
 
-	"github.com/turingcell/veela/dummy/log"
-	"github.com/turingcell/veela/dummy/logdb"
+	"github.com/turingcell/veela/log"
+	"github.com/turingcell/veela/logdb"
 	vpb "github.com/turingcell/veela/proto/veela"
 	"github.com/turingcell/veela/util"
 )
@@ -56,6 +60,8 @@ func (e *Epoch) Incr1() {
 type PaxosGroup struct {
 	// read only
 	groupName string
+	// name of the logdb backend of all the acceptors, see logdb.RegisterBackend
+	logdbBackend string
 
 	mux           sync.Mutex
 	acceptorMap   map[Epoch]*Acceptor
@@ -70,12 +76,122 @@ type ElectionResult struct {
 	acceptorAddrHints []NetworkAddr
 }
 
+// NewElectionResult returns the ElectionResult of the term of termLen insts
+// starting from startFromInstE. acceptorIDs should be in ascending order, and
+// acceptorAddrHints is either empty or the addrs of acceptorIDs one by one.
+func NewElectionResult(startFromInstE Epoch, termLen uint64, acceptorIDs []Epoch,
+	acceptorAddrHints []NetworkAddr) (ElectionResult, error) {
+
+	if startFromInstE == 0 {
+		return ElectionResult{}, fmt.Errorf("startFromInstE should > 0")
+	}
+	if termLen < 2 || termLen > math.MaxInt32 {
+		return ElectionResult{}, fmt.Errorf("invalid termLen %d", termLen)
+	}
+	if len(acceptorIDs) == 0 {
+		return ElectionResult{}, fmt.Errorf("acceptorIDs should not be empty")
+	}
+	for i, id := range acceptorIDs {
+		if id == 0 || (i > 0 && id <= acceptorIDs[i-1]) {
+			return ElectionResult{}, fmt.Errorf("acceptorIDs should be positive and in ascending order")
+		}
+	}
+	if len(acceptorAddrHints) != 0 && len(acceptorAddrHints) != len(acceptorIDs) {
+		return ElectionResult{}, fmt.Errorf("len(acceptorAddrHints) != len(acceptorIDs)")
+	}
+	return ElectionResult{
+		termLen:           termLen,
+		startFromInstE:    startFromInstE,
+		acceptorIDs:       append([]Epoch(nil), acceptorIDs...),
+		acceptorAddrHints: append([]NetworkAddr(nil), acceptorAddrHints...),
+	}, nil
+}
+
+// containInst reports whether instE is in the term.
+func (er *ElectionResult) containInst(instE Epoch) bool {
+	return instE >= er.startFromInstE && uint64(instE-er.startFromInstE) < er.termLen
+}
+
+// quorum is the least number of acceptors of a majority.
+func (er *ElectionResult) quorum() int {
+	return len(er.acceptorIDs)/2 + 1
+}
+
+// electionResults is a set of terms in ascending order by startFromInstE,
+// the terms never overlap.
+type electionResults []ElectionResult
+
+func (ers *electionResults) add(er ElectionResult) error {
+	if len(er.acceptorIDs) == 0 {
+		return fmt.Errorf("invalid ElectionResult, see NewElectionResult")
+	}
+	i := 0
+	for ; i < len(*ers); i++ {
+		t := &(*ers)[i]
+		if t.containInst(er.startFromInstE) || er.containInst(t.startFromInstE) {
+			return fmt.Errorf("term starting from inst %d overlaps with the term starting from inst %d",
+				er.startFromInstE.ToUint64(), t.startFromInstE.ToUint64())
+		}
+		if er.startFromInstE < t.startFromInstE {
+			break
+		}
+	}
+	*ers = append(*ers, ElectionResult{})
+	copy((*ers)[i+1:], (*ers)[i:])
+	(*ers)[i] = er
+	return nil
+}
+
+func (ers electionResults) find(instE Epoch) (ElectionResult, bool) {
+	for _, er := range ers {
+		if er.containInst(instE) {
+			return er, true
+		}
+	}
+	return ElectionResult{}, false
+}
+
 type NetworkAddr struct {
 	flag string // tcp, udp ...
 	ip   net.IP
 	port uint16
 }
 
+func NewNetworkAddr(protocol string, ip net.IP, port uint16) NetworkAddr {
+	return NetworkAddr{flag: protocol, ip: ip, port: port}
+}
+
+func networkAddrFromPb(addr *vpb.NetworkAddr) (NetworkAddr, error) {
+	if addr == nil {
+		return NetworkAddr{}, fmt.Errorf("nil NetworkAddr")
+	}
+	ip := net.ParseIP(addr.Ip)
+	if ip == nil {
+		return NetworkAddr{}, fmt.Errorf("invalid ip %q", addr.Ip)
+	}
+	if addr.Port == 0 || addr.Port > math.MaxUint16 {
+		return NetworkAddr{}, fmt.Errorf("invalid port %d", addr.Port)
+	}
+	return NewNetworkAddr(addr.Protocol, ip, uint16(addr.Port)), nil
+}
+
+func (addr NetworkAddr) GetProtocol() string {
+	return addr.flag
+}
+
+func (addr NetworkAddr) GetIP() net.IP {
+	return addr.ip
+}
+
+func (addr NetworkAddr) GetPort() uint16 {
+	return addr.port
+}
+
+// String returns the addr in the form of host:port.
+func (addr NetworkAddr) String() string {
+	return net.JoinHostPort(addr.ip.String(), strconv.Itoa(int(addr.port)))
+}
+
 type AcceptValue struct {
 	// id of accept value, uniq inside one paxos instance
 	id Epoch
@@ -86,6 +202,32 @@ type AcceptValue struct {
 	bodyBs     []byte
 }
 
+// NewAcceptValue returns an AcceptValue to propose, its id is assigned by the
+// Proposer. memberIdxs should not be empty, see AcceptValue.
+func NewAcceptValue(memberIdxs vpb.AcceptValueMemberIdxs, body []byte) (*AcceptValue, error) {
+	if len(memberIdxs.Idxs) == 0 {
+		return nil, fmt.Errorf("memberIdxs should not be empty")
+	}
+	for i, idx := range memberIdxs.Idxs {
+		if idx == nil || idx.Offset < 0 || idx.Len < 0 || int64(idx.Offset)+int64(idx.Len) > int64(len(body)) {
+			return nil, fmt.Errorf("memberIdxs[%d] is out of the body of %dB", i, len(body))
+		}
+	}
+	return &AcceptValue{memberIdxs: memberIdxs, bodyBs: body}, nil
+}
+
+func (v *AcceptValue) GetID() Epoch {
+	return v.id
+}
+
+func (v *AcceptValue) GetMemberIdxs() vpb.AcceptValueMemberIdxs {
+	return v.memberIdxs
+}
+
+func (v *AcceptValue) GetBody() []byte {
+	return v.bodyBs
+}
+
 func (v *AcceptValue) GetMemberByIdx(idx vpb.AcceptValueMemberIdx) []byte {
 	if idx.Len == 0 {
 		return nil
@@ -179,7 +321,13 @@ type Acceptor struct {
 	pg *PaxosGroup
 	db logdb.DB
 
+	// protects db and the members below, see acceptor.go
+	mux          sync.Mutex
 	stateSummary vpb.AcceptorStateSummary
+	// count of the inst records after the last checkpoint
+	instRecordCt int
+	// the deleteAllIdxLessThan of the last AppendAndSync3
+	deleteBeforeIdx uint64
 }
 
 func (a *Acceptor) CheckAcceptorStateSummary() error {
@@ -226,27 +374,89 @@ type AcceptStateInOnePaxosInstance struct {
 
 type AcceptorProxy struct {
 	pg *PaxosGroup
+
+	// protects the members below, see proxy.go
+	mux        sync.Mutex
+	addrs      map[Epoch]NetworkAddr
+	dialer     AcceptorDialer
+	remotes    map[Epoch]AcceptorRpcClient
+	rpcTimeout time.Duration
 }
 
 type Learner struct {
 	pg *PaxosGroup
+
+	// read only, see learner.go
+	pollInterval time.Duration
+	handler      ChosenValueHandler
+	kickCh       chan struct{}
+	deliverKick  chan struct{}
+	ctx          context.Context
+	cancel       context.CancelFunc
+	doneCh       chan struct{}
+	deliverDone  chan struct{}
+
+	mux   sync.Mutex
+	terms electionResults
+	// the next inst to deliver
+	nextInstE Epoch
+	// instE -> the chosen AcceptValueID whose AcceptValue is not fetched yet
+	chosenIDs map[Epoch]uint64
+	// instE -> the chosen AcceptValue not delivered yet
+	chosenValues map[Epoch]*AcceptValue
 }
 
 type Proposer struct {
 	// uniq inside Paxos Group
 	id Epoch
 	pg *PaxosGroup
+
+	// protects the members below, see proposer.go
+	mux   sync.Mutex
+	terms electionResults
+	// the high bits of the last prepareEpoch
+	round uint64
 }
 
 func New(groupName string) *PaxosGroup {
 	pg := PaxosGroup{
-		groupName: groupName,
+		groupName:    groupName,
+		logdbBackend: logdb.FileBackendName,
+		acceptorMap:  make(map[Epoch]*Acceptor),
 	}
+	pg.acceptorProxy = newAcceptorProxy(&pg)
 	return &pg
 }
 
+// NewWithLogDbBackend is the same with New but the acceptors would use the
+// logdb backend named logdbBackend, whose package should be imported for
+// registering, e.g.
+//
+//	import _ "github.com/turingcell/veela/logdb/backends/pebblebackend"
+func NewWithLogDbBackend(groupName string, logdbBackend string) (*PaxosGroup, error) {
+	for _, name := range logdb.BackendNames() {
+		if name == logdbBackend {
+			pg := New(groupName)
+			pg.logdbBackend = logdbBackend
+			return pg, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown logdb backend %q", logdbBackend)
+}
+
+// logdbOptions collects the options of the acceptor logdb, the logdb logs
+// to vlog unless another Logger is given.
+func logdbOptions(opts []logdb.Option) *logdb.Options {
+	o := logdb.NewOptions(opts...)
+	if o.Logger == nil {
+		o.Logger = vlog
+	}
+	return o
+}
+
+// The opts are passed to the logdb backend, see logdb.Options.
 func (pg *PaxosGroup) InitAcceptorLogDb(logdbDirPath string, startFromInstE uint64, electionResult vpb.ElectionResult,
-	acceptorIDMapToNetworkAddr vpb.AcceptorIDMapToNetworkAddr) error {
+	acceptorIDMapToNetworkAddr vpb.AcceptorIDMapToNetworkAddr, opts ...logdb.Option) error {
 
 	var summary vpb.AcceptorStateSummary
 	summary.DeleteInstBeforeEpoch = 0
@@ -266,18 +476,14 @@ func (pg *PaxosGroup) InitAcceptorLogDb(logdbDirPath string, startFromInstE uint
 	}
 	summary.AcceptorTermStates = make([]*vpb.AcceptorTermState, 1)
 	summary.AcceptorTermStates[0] = &state
-	summaryBs, err := summary.Marshal()
-	if err != nil {
-		return err
-	}
-	util.AssertTrue(len(summaryBs) > 0)
-	db, err := logdb.CreateDB(logdbDirPath)
+	summaryBs := (&AcceptorRecord{Kind: AcceptorRecordCheckpoint, Summary: &summary}).Marshal()
+	db, err := logdb.CreateDBWithBackend(pg.logdbBackend, logdbDirPath, logdbOptions(opts))
 	if err != nil {
 		return err
 	}
 	leftIdx, toAppendIdx := db.GetCurrentIdxRange()
 	util.AssertTrue(leftIdx == 1 && toAppendIdx == 1)
-	vArray := make([][]byte, 1)
+	vArray := make([][]byte, 0, 1)
 	vArray = append(vArray, summaryBs)
 	err = db.AppendAndSync(1, vArray)
 	if err != nil {
@@ -286,8 +492,10 @@ func (pg *PaxosGroup) InitAcceptorLogDb(logdbDirPath string, startFromInstE uint
 	return db.Close()
 }
 
-func (pg *PaxosGroup) LoadAcceptorFromLogDb(logdbDirPath string, acceptorID Epoch) (*Acceptor, error) {
-	db, err := logdb.OpenDBIfExist(logdbDirPath)
+// The opts are passed to the logdb backend, see logdb.Options. The acceptor
+// could not accept anything with logdb.WithReadOnly.
+func (pg *PaxosGroup) LoadAcceptorFromLogDb(logdbDirPath string, acceptorID Epoch, opts ...logdb.Option) (*Acceptor, error) {
+	db, err := logdb.OpenDBIfExistWithBackend(pg.logdbBackend, logdbDirPath, logdbOptions(opts))
 	if err != nil {
 		return nil, err
 	}
@@ -297,20 +505,11 @@ func (pg *PaxosGroup) LoadAcceptorFromLogDb(logdbDirPath string, acceptorID Epoc
 		db.Close()
 		return nil, fmt.Errorf("there is no valid idx in the logdb which path is:%s", logdbDirPath)
 	}
-	lastAcceptorSummaryIdx := toAppendIdx - 1
-	lastAcceptorSummaryBs, err := db.GetValueByIdx(lastAcceptorSummaryIdx)
-	var acceptorSummary vpb.AcceptorStateSummary
-	err = acceptorSummary.Unmarshal(lastAcceptorSummaryBs)
-	if err != nil {
-		db.Close()
-		return nil, err
-	}
 	var a Acceptor
 	a.id = acceptorID
 	a.pg = pg
 	a.db = db
-	a.stateSummary = acceptorSummary
-	err = a.CheckAcceptorStateSummary()
+	err = a.load()
 	if err != nil {
 		a.db.Close()
 		return nil, err
@@ -319,16 +518,23 @@ func (pg *PaxosGroup) LoadAcceptorFromLogDb(logdbDirPath string, acceptorID Epoc
 }
 
 func (pg *PaxosGroup) AddAcceptor(a *Acceptor) error {
-	if a == nil {
+	if a == nil || a.pg != pg {
 		panic("unexpected")
 	}
 	pg.mux.Lock()
-	defer pg.mux.Unlock()
 	id := a.id
 	_, existFlag := pg.acceptorMap[id]
 	if existFlag {
+		pg.mux.Unlock()
 		return fmt.Errorf("Acceptor %d already exist in acceptorMap", id.ToUint64())
 	}
 	pg.acceptorMap[id] = a
+	pg.mux.Unlock()
+	// the acceptor holds its mux while calling into pg, see learnerOnChosen
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	for _, term := range a.stateSummary.AcceptorTermStates {
+		pg.acceptorProxy.addAddrHints(term.AcceptorIDMapToNetworkAddr)
+	}
 	return nil
 }